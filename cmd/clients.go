@@ -1,14 +1,57 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/Packetify/packetify/networkHandler"
+	"github.com/Packetify/packetify/networkHandler/dhcp4d"
+	"github.com/Packetify/packetify/networkHandler/packetParser"
+	"github.com/Packetify/packetify/networkHandler/tc"
 	"github.com/spf13/cobra"
 	"log"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultLeaseFile   = "/var/lib/packetify/dhcp4.leases"
+	defaultLimitsFile  = "/var/lib/packetify/client-limits.json" // Rate limits of packetify clients limit
+	defaultTrafficFile = "/var/lib/packetify/traffic.json"       // Client traffic of packetify clients stats
 )
 
 var(
 	virtualInterface string
+	clientsLeaseFile string
+	listCommand      = &cobra.Command{
+		Use:   "list",
+		Short: "List dhcp clients with their device class",
+		Long:  "List dhcp leases of packetify access point with hostname, vendor and device class of clients",
+		Run: func(cmd *cobra.Command, args []string) {
+			store, err := dhcp4d.NewFileLeaseStore(clientsLeaseFile)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			leases, _ := store.Load()
+			sort.Slice(leases, func(i, j int) bool {
+				return bytes.Compare(leases[i].ReqIP.To16(), leases[j].ReqIP.To16()) < 0
+			})
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "MAC\tIP\tHOSTNAME\tCLASS\tVENDOR\tPOOL\tEXPIRES")
+			for _, l := range leases {
+				class := l.Fingerprint.Class
+				if len(class) == 0 {
+					class = dhcp4d.UnknownDevice
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Nic, l.ReqIP, l.HostName, class,
+					l.Fingerprint.Vendor, l.Pool, l.Expiry.Format(time.RFC3339))
+			}
+			w.Flush()
+		},
+	}
 	infoCommand = &cobra.Command{
         Use:   "info",
         Short: "Get information about the wifi clients",
@@ -31,6 +74,102 @@ var(
 			fmt.Println(clientsInfo)
         },
     }
+	limitDown     string
+	limitUp       string
+	limitBurst    string
+	limitRemove   bool
+	limitFile     string
+	limitsCommand = &cobra.Command{
+		Use:     "limit [mac]",
+		Short:   "Limit download and upload rates of a client",
+		Long:    "Set rate limits of a client, applied by a running access point with --shaping, or list limits without mac",
+		Example: "sudo packetify clients limit aa:bb:cc:dd:ee:ff --down 5mbit --up 1mbit",
+		Args:    cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			limits, err := tc.LoadLimits(limitFile)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if len(args) == 0 {
+				macs := make([]string, 0, len(limits))
+				for mac := range limits {
+					macs = append(macs, mac)
+				}
+				sort.Strings(macs)
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "MAC\tDOWN\tUP\tBURST")
+				for _, mac := range macs {
+					limit, burst := limits[mac], "-"
+					if limit.Burst != 0 {
+						burst = tc.FormatSize(limit.Burst)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mac, tc.FormatRate(limit.Down), tc.FormatRate(limit.Up), burst)
+				}
+				w.Flush()
+				return
+			}
+			mac, err := net.ParseMAC(args[0])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if limitRemove {
+				delete(limits, mac.String())
+			} else {
+				limit, err := tc.ParseLimit(limitDown, limitUp, limitBurst)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				if limit.IsZero() {
+					log.Println("set --down or --up, or --remove the limit")
+					return
+				}
+				limits[mac.String()] = limit
+			}
+			if err := tc.WriteLimits(limitFile, limits); err != nil {
+				log.Println(err)
+				return
+			}
+			if limitRemove {
+				fmt.Println("Removed limit of", mac)
+			} else {
+				fmt.Println("Limited", mac, "to", limits[mac.String()])
+			}
+		},
+	}
+	statsFile    string
+	statsCommand = &cobra.Command{
+		Use:   "stats",
+		Short: "Show traffic of clients",
+		Long:  "Show total and current traffic of clients counted by a running access point with --accounting",
+		Run: func(cmd *cobra.Command, args []string) {
+			updated, usages, err := packetParser.ReadUsage(statsFile)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if updated.IsZero() {
+				fmt.Println("No client traffic in", statsFile)
+				return
+			}
+			// Rates of an access point which stopped are stale
+			running := time.Since(updated) < time.Minute
+			fmt.Println("updated", updated.Format(time.RFC3339))
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "MAC\tIP\tDOWN\tUP\tPACKETS DOWN\tPACKETS UP\tRATE DOWN\tRATE UP\tLAST SEEN")
+			for _, u := range usages {
+				rateDown, rateUp := "-", "-"
+				if running {
+					rateDown, rateUp = formatBytes(uint64(u.RateDown))+"/s", formatBytes(uint64(u.RateUp))+"/s"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", u.MAC, u.IP, formatBytes(u.BytesDown),
+					formatBytes(u.BytesUp), u.PacketsDown, u.PacketsUp, rateDown, rateUp, u.LastSeen.Format(time.RFC3339))
+			}
+			w.Flush()
+		},
+	}
 	clientsCommand = &cobra.Command{
 		Use:   "clients",
         Short: "Manage clients",
@@ -47,6 +186,9 @@ var(
 func init(){
 	rootCmd.AddCommand(clientsCommand)
 	clientsCommand.AddCommand(infoCommand)
+	clientsCommand.AddCommand(listCommand)
+	clientsCommand.AddCommand(limitsCommand)
+	clientsCommand.AddCommand(statsCommand)
 	infoCommand.Flags().StringVarP(
 		&virtualInterface,
 		"virtualiface",
@@ -54,5 +196,26 @@ func init(){
 		"",
 		"The virtual interface thatpacketify use",
 	)
+	listCommand.Flags().StringVarP(&clientsLeaseFile, "leasefile", "", defaultLeaseFile, "dhcp lease file of access point")
+	limitsCommand.Flags().StringVarP(&limitDown, "down", "", "", "download rate of the client like 5mbit")
+	limitsCommand.Flags().StringVarP(&limitUp, "up", "", "", "upload rate of the client like 1mbit")
+	limitsCommand.Flags().StringVarP(&limitBurst, "burst", "", "", "bytes sent at full speed above the rates like 32kb")
+	limitsCommand.Flags().BoolVarP(&limitRemove, "remove", "", false, "remove limits of the client")
+	limitsCommand.Flags().StringVarP(&limitFile, "file", "", defaultLimitsFile, "client rate limits file of access point")
+	statsCommand.Flags().StringVarP(&statsFile, "file", "", defaultTrafficFile, "client traffic file of access point")
+
+}
 
+// formatBytes returns bytes with a binary unit like 1.5MiB
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
\ No newline at end of file
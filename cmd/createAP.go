@@ -2,10 +2,14 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"github.com/Packetify/ipcalc/ipv4calc"
 	"github.com/Packetify/packetify/networkHandler"
 	"github.com/Packetify/packetify/networkHandler/dhcp4d"
+	"github.com/Packetify/packetify/networkHandler/dhcp6d"
 	"github.com/Packetify/packetify/networkHandler/hostapd"
+	"github.com/Packetify/packetify/networkHandler/packetParser"
+	"github.com/Packetify/packetify/networkHandler/tc"
 	"github.com/krolaw/dhcp4"
 	"github.com/krolaw/dhcp4/conn"
 	"github.com/spf13/cobra"
@@ -14,6 +18,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -53,10 +58,66 @@ var (
 	denyMacFile   string
 	acceptMacFile string
 	dnsmasq       bool
-	dnsblockFile      string
+	dnsblockFiles []string
+	dnsblockMode  string
 	openvpn string
 	powersave bool
 	enablevpn bool
+	leaseFile     string
+	dhcpReserve   []string
+	reserveFile   string
+	poolsFile     string
+	dhcpRelay     net.IP
+	dhcpDomain    string
+	dhcpSearch    []string
+	dhcpNTP       []net.IP
+	dhcpRoutes    []string
+	dhcpMTU       int
+	dhcpWPAD      string
+	dhcpRawOpts   []string
+	pingCheck     bool
+	pingTimeout   time.Duration
+	quarantine    time.Duration
+	ipv6Prefix    string
+	raMode        string
+	ipv6Forwarded bool   // Ipv6 forwarding was on before the AP, so cleanup keeps it
+	uplinkRA      string // accept_ra of --netshare interface changed by the AP, restored on cleanup
+	dhcpRate      int
+	dhcpMACRate   int
+	dhcpSprayMACs int
+	dhcpMaxOffers int
+	dhcpBlock     bool
+	dhcpBlockTime time.Duration
+	blockedMACs   sync.Map // Macs blocked in firewall by dhcp flood alerts
+	localDNS      bool
+	localDNSPort  uint16
+	dnsCacheSize  int
+	dnsPrefetch   bool
+	dnsUpstreams  []string
+	dnsStrategy   string
+	localDomain   string
+	localZone     *networkHandler.LocalZone // Names of dhcp clients answered by local dns server
+	dnsLogFile    string
+	dnsLogSize    int
+	dnsQueryLog   *networkHandler.QueryLog   // Queries of clients to local dns server
+	dnsClients    *networkHandler.DNSClients // Dhcp clients of local dns server by address
+	dnsHandler    *networkHandler.DNSHandler // Local dns server, also serving ipv6 clients with --ipv6-prefix
+	dnsPolicyFile string
+	dnsForwards   []string
+	dnsOverrides  []string
+	dnssec        bool
+	dnssecAnchors string
+	firewallName  string
+	portForwards  []string
+	firewall      networkHandler.Firewall // Backend of AP firewall rules
+	dryRun        bool
+	shaping       bool
+	limitsFile    string
+	shaper        *tc.Shaper // Rate limits of clients when --shaping is set
+	clientLimits  = clientShaping{own: map[string]tc.Limit{}, pools: map[string]tc.Limit{}, leased: map[string]string{}}
+	accounting    bool
+	trafficFile   string
+	traffic       *packetParser.Accounting // Traffic of clients when --accounting is set
 
 	startAP       = &cobra.Command{
 		Use:     "createap",
@@ -67,20 +128,34 @@ var (
 			sigs := make(chan os.Signal, 1)
 			signal.Notify(sigs, syscall.SIGINT, os.Interrupt, syscall.SIGTERM)
 
-			validateWlanIface(wlanIface)
-			ctx, cancel := context.WithCancel(context.Background())
 			var wg sync.WaitGroup
 			wlanIPNet.IP = dhcp4.IPAdd(wlanIPNet.IP, 1)
+			apDNS := dnsServer
+			if len(dnsblockFiles) != 0 || len(dnsPolicyFile) != 0 || len(dnsForwards) != 0 || len(dnsOverrides) != 0 || dnssec {
+				localDNS = true // Blocklists, policies, rules and validation are applied by local dns server
+			}
+			if localDNS {
+				apDNS = wlanIPNet.IP // Clients ask the local dns server which forwards to --dns
+				if len(dhcpDomain) == 0 {
+					dhcpDomain = localDomain // Clients resolve short names of each other
+				}
+			}
 			myAccessPoint := AccessPoint{
 				virtIfaceName,
 				wlanIface,
 				wlanIPNet,
-				dnsServer,
+				apDNS,
 				ssid,
 				password,
 				"/tmp/hostapd.conf",
 				netShare,
 			}
+			if dryRun {
+				printFirewallRules(&myAccessPoint)
+				return
+			}
+			validateWlanIface(wlanIface) // After the dry run, which needs no wifi interface
+			ctx, cancel := context.WithCancel(context.Background())
 			hostapdOptions := []hostapd.HostapdOption{
 				{
 					hostapd.Interface,
@@ -155,8 +230,6 @@ var (
 					panic(err)
 				}
 			}()
-			//time.Sleep(5*time.Second)
-			//go packetParser.TotalBandWidthUsage(ctx,myAccessPoint.IfaceName, myAccessPoint.IPRange)
 			<-sigs
 
 			cancel()
@@ -188,10 +261,55 @@ func init() {
 	startAP.Flags().StringVarP(&acceptMacFile, "acceptmac", "", "", "Accept lists are read from separate files")
 	startAP.Flags().StringVarP(&denyMacFile, "denymac", "", "", "Deny lists are read from separate files")
 	startAP.Flags().BoolVarP(&dnsmasq,"dnsmasq","",false,"use dnsmasq as dhcp , dns server")
-	startAP.Flags().StringVarP(&dnsblockFile,"dnsblock","","","block dns request of domain/ip in file")
+	startAP.Flags().StringSliceVarP(&dnsblockFiles, "dnsblock", "", nil, "block dns requests of domains in hosts, plain domain or adblock files, implies --local-dns (reloaded on SIGHUP)")
+	startAP.Flags().StringVarP(&dnsPolicyFile, "dns-policies", "", "", "json file of dns policies of client macs, groups or device classes, implies --local-dns and redirects all dns of clients to it (reloaded on SIGHUP)")
+	startAP.Flags().StringVarP(&dnsblockMode, "dnsblock-mode", "", "nxdomain", "answer of blocked dns requests: nxdomain or zero (0.0.0.0)")
 	startAP.Flags().StringVarP(&openvpn,"openvpn","","","run openvpn config pass all traffic throgh vpn")
 	startAP.Flags().BoolVarP(&enablevpn,"vpn","",false,"enable clients use vpn")
 	startAP.Flags().BoolVarP(&powersave,"powersave","",false,"enable powersaving on interface")
+	startAP.Flags().StringVarP(&leaseFile, "leasefile", "", defaultLeaseFile, "file to keep dhcp leases across restarts")
+	startAP.Flags().StringSliceVarP(&dhcpReserve, "dhcp-reserve", "", nil, "reserve ip for mac address as mac=ip (repeatable)")
+	startAP.Flags().StringVarP(&dhcpDomain, "dhcp-domain", "", "", "domain name sent to dhcp clients (option 15)")
+	startAP.Flags().StringSliceVarP(&dhcpSearch, "dhcp-search", "", nil, "domain search list sent to dhcp clients (option 119)")
+	startAP.Flags().IPSliceVarP(&dhcpNTP, "dhcp-ntp", "", nil, "ntp servers sent to dhcp clients (option 42)")
+	startAP.Flags().StringArrayVarP(&dhcpRoutes, "dhcp-route", "", nil, "classless static route sent to dhcp clients as destination/prefix=gateway (option 121, repeatable)")
+	startAP.Flags().IntVarP(&dhcpMTU, "dhcp-mtu", "", 0, "interface mtu sent to dhcp clients (option 26)")
+	startAP.Flags().StringVarP(&dhcpWPAD, "dhcp-wpad", "", "", "proxy auto config url sent to dhcp clients (option 252)")
+	startAP.Flags().StringArrayVarP(&dhcpRawOpts, "dhcp-option", "", nil, "raw dhcp option as code=value, value may be hex (0x..), ip list or string (repeatable)")
+	startAP.Flags().BoolVarP(&pingCheck, "dhcp-ping-check", "", false, "probe addresses with arp before offering them to dhcp clients")
+	startAP.Flags().DurationVarP(&pingTimeout, "dhcp-ping-timeout", "", 500*time.Millisecond, "how long to wait for arp probe answers")
+	startAP.Flags().DurationVarP(&quarantine, "dhcp-quarantine", "", 10*time.Minute, "how long addresses found in use are not offered")
+	startAP.Flags().StringVarP(&ipv6Prefix, "ipv6-prefix", "", "", "enable ipv6 on access point with given /64 prefix, e.g. fd00:100::/64")
+	startAP.Flags().StringVarP(&raMode, "ra-mode", "", "slaac", "ipv6 address configuration of clients: slaac, stateful (dhcpv6) or both")
+	startAP.Flags().StringVarP(&reserveFile, "dhcp-reserve-file", "", "", "file of dhcp reservations, one \"mac ip\" per line")
+	startAP.Flags().IPVarP(&dhcpRelay, "dhcp-relay", "", nil, "relay dhcp to given server with option 82 instead of running dhcp server")
+	startAP.Flags().IntVarP(&dhcpRate, "dhcp-rate", "", 600, "dhcp messages of clients without lease served per minute on the interface, 0 disables the limit")
+	startAP.Flags().IntVarP(&dhcpMACRate, "dhcp-mac-rate", "", 30, "dhcp messages served per minute per client mac, 0 disables the limit")
+	startAP.Flags().IntVarP(&dhcpSprayMACs, "dhcp-spray-macs", "", 50, "new client macs per minute which are treated as dhcp starvation, 0 disables detection")
+	startAP.Flags().IntVarP(&dhcpMaxOffers, "dhcp-max-offers", "", 64, "outstanding dhcp offers of new addresses, 0 disables the limit")
+	startAP.Flags().BoolVarP(&dhcpBlock, "dhcp-block", "", false, "block flooding client macs in firewall")
+	startAP.Flags().DurationVarP(&dhcpBlockTime, "dhcp-block-time", "", 10*time.Minute, "how long flooding client macs are ignored or blocked")
+	startAP.Flags().BoolVarP(&localDNS, "local-dns", "", false, "run dns server on access point which forwards to --dns")
+	startAP.Flags().Uint16VarP(&localDNSPort, "local-dns-port", "", 5300, "port of local dns server, clients queries to port 53 are redirected to it")
+	startAP.Flags().IntVarP(&dnsCacheSize, "dns-cache-size", "", 10000, "answers kept in local dns cache, 0 disables the cache")
+	startAP.Flags().BoolVarP(&dnsPrefetch, "dns-prefetch", "", true, "refresh often asked dns answers before they expire")
+	startAP.Flags().StringSliceVarP(&dnsUpstreams, "dns-upstream", "", nil, "upstreams of local dns server as ip[:port], tls://ip[:port]#name or https://host/dns-query, --dns when empty")
+	startAP.Flags().StringArrayVarP(&dnsForwards, "dns-forward", "", nil, "forward a zone to other upstreams as zone=upstream[,upstream], e.g. *.corp.example=10.0.0.53, implies --local-dns")
+	startAP.Flags().StringArrayVarP(&dnsOverrides, "dns-override", "", nil, "static dns record as name=ip or name=cname-target, e.g. printer.lan=192.168.100.50, implies --local-dns")
+	startAP.Flags().BoolVarP(&dnssec, "dnssec", "", false, "validate answers of dns upstreams with dnssec, bogus answers fail with SERVFAIL, implies --local-dns")
+	startAP.Flags().StringVarP(&dnssecAnchors, "dnssec-anchors", "", "/usr/share/dns/root.key", "zone file of DS or DNSKEY trust anchors for --dnssec")
+	startAP.Flags().StringVarP(&dnsStrategy, "dns-strategy", "", "failover", "how dns upstreams are picked: failover, round-robin or fastest")
+	startAP.Flags().StringVarP(&dnsLogFile, "dns-log", "", "", "append every query to local dns server to this json lines file")
+	startAP.Flags().IntVarP(&dnsLogSize, "dns-log-size", "", 1000, "last queries to local dns server kept for packetify dns log")
+	startAP.Flags().StringVarP(&localDomain, "local-domain", "", "ap.lan", "domain of dhcp client names in local dns server, sent to clients when --dhcp-domain is empty")
+	startAP.Flags().StringVarP(&firewallName, "firewall", "", "auto", "firewall backend of AP rules: iptables, nftables or auto")
+	startAP.Flags().BoolVarP(&shaping, "shaping", "", false, "limit client rates by packetify clients limit and down, up and burst of dhcp pools")
+	startAP.Flags().StringVarP(&limitsFile, "limits-file", "", defaultLimitsFile, "client rate limits file of packetify clients limit")
+	startAP.Flags().BoolVarP(&accounting, "accounting", "", false, "count traffic of clients for packetify clients stats, totals are kept across restarts")
+	startAP.Flags().StringVarP(&trafficFile, "traffic-file", "", defaultTrafficFile, "client traffic file of packetify clients stats")
+	startAP.Flags().BoolVarP(&dryRun, "dry-run", "", false, "print the firewall rules of the access point without creating it")
+	startAP.Flags().StringArrayVarP(&portForwards, "port-forward", "", nil, "forward a port of --netshare interface to a client as proto:port=ip:port, e.g. tcp:8080=192.168.100.10:80")
+	startAP.Flags().StringVarP(&poolsFile, "dhcp-pools", "", "", "json file of dhcp pools picked by mac, vendor class or device class")
 
 
 	startAP.MarkFlagRequired("wlaniface")
@@ -243,6 +361,175 @@ func (AP *AccessPoint) CreateAP(ctx context.Context, wg *sync.WaitGroup, hostapd
 		return err
 	}
 
+	if err := wifidev.SetupIpToVirtIface(&AP.IPRange, AP.IfaceName); err != nil {
+		log.Println("Error setting up IP to virtual interface", err)
+		return err
+	}
+
+	if firewall, err = networkHandler.NewFirewall(firewallName); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := firewall.Setup(); err != nil {
+		log.Println("Error setting up firewall chains", err)
+		return err
+	}
+	log.Println("Firewall rules are managed by", firewall.Name())
+
+	if shaping {
+		shaper = tc.NewShaper(AP.IfaceName)
+		if err := shaper.Setup(); err != nil {
+			log.Println("Error setting up traffic shaping", err)
+			return err
+		}
+		if err := reloadClientLimits(); err != nil {
+			log.Println("Error loading client limits", err)
+			return err
+		}
+		go watchClientLimits(ctx, 5*time.Second)
+	}
+
+	if localDNS {
+		if localZone, err = networkHandler.NewLocalZone(localDomain, &AP.IPRange); err != nil {
+			log.Println("Error creating local dns zone", err)
+			return err
+		}
+		if dnsQueryLog, err = networkHandler.NewQueryLog(dnsLogSize, dnsLogFile); err != nil {
+			log.Println("Error opening dns query log", err)
+			return err
+		}
+		dnsClients = networkHandler.NewDNSClients()
+		dnsClients.Neighbor = func(ip net.IP) (net.HardwareAddr, bool) {
+			return networkHandler.IPv6Neighbor(AP.IfaceName, ip)
+		}
+	}
+
+	var dhcp4PacketConn net.PacketConn
+	var events *dhcp4d.EventBus
+	if dhcpRelay != nil {
+		dhcp4PacketConn, events, err = AP.StartDHCPRelay()
+	} else {
+		dhcp4PacketConn, events, err = AP.StartDHCPServer(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	devices := events.Subscribe(16)
+	go func() {
+		for {
+			select {
+			case dev, ok := <-devices:
+				if !ok {
+					return
+				}
+				log.Println(dev.Event, dev.HostName, dev.IPAddr, dev.MacAddr, dev.Fingerprint.Class, dev.Pool)
+				updateLocalDNS(dev)
+				updateClientShaping(dev)
+			case <-ctx.Done():
+				log.Println("Stoping dhcp server and user log")
+				events.Unsubscribe(devices)
+				return
+			}
+		}
+	}()
+
+	if localDNS {
+		if err := AP.StartLocalDNS(ctx); err != nil {
+			log.Println("Error starting local dns server", err)
+			return err
+		}
+	}
+
+	if len(ipv6Prefix) != 0 {
+		if err := AP.SetupIPv6(ctx, wifidev); err != nil {
+			log.Println("Error setting up ipv6", err)
+			return err
+		}
+	}
+
+	//hostapd
+	Hstapd := hostapd.New(hostapdOptions...)
+	if err := hostapd.WriteCfg(AP.HostapdCFG, Hstapd); err != nil {
+		log.Println("Error writing hostapd config file", err)
+		return err
+	}
+
+	HostapdCmd, err := hostapd.Run(AP.HostapdCFG, false)
+	if err != nil {
+		return err
+	}
+	rules, err := AP.FirewallRules()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if err = firewall.Add(rules...); err != nil {
+		log.Println("error applying firewall rules", err)
+		return err
+	}
+	var accounted <-chan struct{}
+	if accounting {
+		if accounted, err = AP.StartAccounting(ctx); err != nil {
+			log.Println("Error starting traffic accounting", err)
+			return err
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Println("ap stopped...")
+		if accounted != nil {
+			<-accounted // Last write of the traffic file
+		}
+		if err := AP.CleanupAP(HostapdCmd, dhcp4PacketConn, wifidev); err != nil {
+			log.Println("error cleaning up", err)
+			return err
+		}
+		wg.Done()
+		return nil
+	}
+}
+
+// StartAccounting counts traffic of clients on AP interface from the totals of traffic file
+// the file is written every 10 seconds and once more when ctx is done, the returned channel is closed after that
+func (AP *AccessPoint) StartAccounting(ctx context.Context) (<-chan struct{}, error) {
+	_, usages, err := packetParser.ReadUsage(trafficFile)
+	if err != nil {
+		return nil, err
+	}
+	traffic = packetParser.NewAccounting(AP.IPRange)
+	traffic.Restore(usages)
+	go func() {
+		if err := traffic.Capture(ctx, AP.IfaceName); err != nil {
+			log.Println("traffic accounting stoped....", err)
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				if err := packetParser.WriteUsage(trafficFile, t, traffic.Usages()); err != nil {
+					log.Println("error writing client traffic", err)
+				}
+			case <-ctx.Done():
+				traffic.Stop() // Frames Capture reads until the interface is gone aren't counted after the last write
+				if err := packetParser.WriteUsage(trafficFile, time.Now(), traffic.Usages()); err != nil {
+					log.Println("error writing client traffic", err)
+				}
+				return
+			}
+		}
+	}()
+	log.Println("Counting client traffic on", AP.IfaceName, "into", trafficFile)
+	return done, nil
+}
+
+// StartDHCPServer starts dhcp server on AP interface, leases are swept until ctx is done
+func (AP *AccessPoint) StartDHCPServer(ctx context.Context) (net.PacketConn, *dhcp4d.EventBus, error) {
 	ipcalc := ipv4calc.New(AP.IPRange)
 
 	//dhcpServer
@@ -252,7 +539,6 @@ func (AP *AccessPoint) CreateAP(ctx context.Context, wg *sync.WaitGroup, hostapd
 		Start:         ipcalc.GetMinHost(),
 		LeaseRange:    ipcalc.GetValidHosts(),
 		Leases:        make(map[int]dhcp4d.Lease, 10),
-		DevicesChan:   make(chan dhcp4d.DeviceInfo),
 		Options: dhcp4.Options{
 			dhcp4.OptionSubnetMask:       AP.IPRange.Mask,
 			dhcp4.OptionRouter:           AP.IPRange.IP.To4(), // Presuming Server is also your router
@@ -260,73 +546,567 @@ func (AP *AccessPoint) CreateAP(ctx context.Context, wg *sync.WaitGroup, hostapd
 		},
 	}
 
+	if err := addDHCPOptions(handler); err != nil {
+		log.Println("Error setting dhcp options", err)
+		return nil, nil, err
+	}
+	if err := addDHCPReservations(handler); err != nil {
+		log.Println("Error adding dhcp reservations", err)
+		return nil, nil, err
+	}
+	if len(poolsFile) != 0 {
+		pools, err := dhcp4d.LoadPools(poolsFile)
+		if err != nil {
+			log.Println("Error loading dhcp pools", err)
+			return nil, nil, err
+		}
+		for _, pool := range pools {
+			if err := handler.AddPool(pool); err != nil {
+				log.Println("Error adding dhcp pool", err)
+				return nil, nil, err
+			}
+			clientLimits.setPool(pool.Name, pool.Limit)
+		}
+	}
+
+	leaseStore, err := dhcp4d.NewFileLeaseStore(leaseFile)
+	if err != nil {
+		log.Println("Error opening dhcp lease file", err)
+		return nil, nil, err
+	}
+	handler.Store = leaseStore
+	if err := handler.LoadLeases(); err != nil {
+		log.Println("Error loading dhcp leases", err)
+		return nil, nil, err
+	}
+	for _, l := range handler.Leases {
+		if mac, err := net.ParseMAC(l.Nic); err == nil {
+			dev := dhcp4d.DeviceInfo{Event: dhcp4d.LeaseGranted, MacAddr: mac, IPAddr: l.ReqIP, HostName: l.HostName,
+				Fingerprint: l.Fingerprint, Pool: l.Pool}
+			updateLocalDNS(dev)
+			updateClientShaping(dev)
+		}
+	}
+
 	dhcp4PacketConn, _ := conn.NewUDP4BoundListener(AP.IfaceName, ":67")
+	if pingCheck {
+		prober, err := dhcp4d.NewARPProber(AP.IfaceName, pingTimeout)
+		if err != nil {
+			log.Println("Error creating arp prober", err)
+			return nil, nil, err
+		}
+		handler.Prober = prober
+		handler.QuarantineDuration = quarantine
+	}
+	handler.Limiter = &dhcp4d.RateLimiter{
+		Window:        time.Minute,
+		Rate:          dhcpRate,
+		MACRate:       dhcpMACRate,
+		SprayMACs:     dhcpSprayMACs,
+		MaxOffers:     dhcpMaxOffers,
+		OfferTimeout:  time.Minute,
+		BlockDuration: dhcpBlockTime,
+	}
+	if dhcpBlock {
+		handler.Limiter.OnAlert = AP.BlockFloodingMAC
+	}
+
 	go func() {
 		if err := dhcp4.Serve(dhcp4PacketConn, handler); err != nil {
 			log.Println("dhcp server stoped....")
-			close(handler.DevicesChan)
+			handler.Events.Close()
 			return
 		}
 	}()
+	go handler.RunSweeper(ctx, time.Minute)
+	return dhcp4PacketConn, &handler.Events, nil
+}
+
+// FirewallRules returns firewall rules of AP, internet sharing with port forwards and the local dns redirect
+func (AP *AccessPoint) FirewallRules() ([]networkHandler.FirewallRule, error) {
+	var rules []networkHandler.FirewallRule
+	if netShare != "false" {
+		rules = append(rules, networkHandler.InternetSharingRules(AP.IfaceName, AP.InternetIface, AP.IPRange)...)
+		for _, spec := range portForwards {
+			pf, err := networkHandler.ParsePortForward(AP.InternetIface, spec)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, pf)
+		}
+	}
+	if localDNS {
+		// Policies also catch clients asking other resolvers
+		rules = append(rules, networkHandler.DNSRedirect{IPRange: AP.IPRange, Port: localDNSPort, Iface: AP.IfaceName,
+			Intercept: len(dnsPolicyFile) != 0, IPv6: apIPv6()})
+	}
+	return rules, nil
+}
+
+// printFirewallRules prints the batch of firewall rules of AP instead of applying it
+func printFirewallRules(AP *AccessPoint) {
+	firewall, err := networkHandler.NewFirewall(firewallName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, err := AP.FirewallRules()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("# %s\n%s", firewall.Name(), firewall.Render(rules))
+}
+
+// StartLocalDNS runs dns server on AP, which clients reach by the redirect of FirewallRules, until ctx is done
+func (AP *AccessPoint) StartLocalDNS(ctx context.Context) error {
+	strategy, err := networkHandler.ParseUpstreamStrategy(dnsStrategy)
+	if err != nil {
+		return err
+	}
+	specs := dnsUpstreams
+	if len(specs) == 0 {
+		specs = []string{dnsServer.String()}
+	}
+	upstreams, err := networkHandler.NewUpstreams(strategy, specs...)
+	if err != nil {
+		return err
+	}
+	handler := &networkHandler.DNSHandler{Upstreams: upstreams, Zone: localZone, Clients: dnsClients, Log: dnsQueryLog}
+	dnsHandler = handler
+	if dnssec {
+		anchors, err := networkHandler.LoadTrustAnchors(dnssecAnchors)
+		if err != nil {
+			return err
+		}
+		handler.Validator = networkHandler.NewDNSSECValidator(anchors, upstreams)
+		log.Println("Local dns server validates dnssec with trust anchors of", dnssecAnchors)
+	}
+	for _, spec := range dnsForwards {
+		rule, err := networkHandler.ParseForwardRule(spec, strategy)
+		if err != nil {
+			return err
+		}
+		handler.Forwards = append(handler.Forwards, rule)
+		log.Println("Local dns server forwards", rule)
+	}
+	if len(dnsOverrides) != 0 {
+		handler.Overrides = networkHandler.NewDNSOverrides()
+		for _, spec := range dnsOverrides {
+			if err := handler.Overrides.Add(spec); err != nil {
+				return err
+			}
+		}
+	}
+	if dnsCacheSize > 0 {
+		handler.Cache = networkHandler.NewDNSCache(dnsCacheSize)
+		handler.Cache.Prefetch = dnsPrefetch
+	}
+	mode, err := networkHandler.ParseBlockMode(dnsblockMode)
+	if err != nil {
+		return err
+	}
+	if len(dnsblockFiles) != 0 {
+		if handler.Blocker, err = networkHandler.NewDNSBlocker(mode, dnsblockFiles...); err != nil {
+			return err
+		}
+		go handler.Blocker.Watch(ctx, 30*time.Second)
+	}
+	if len(dnsPolicyFile) != 0 {
+		if handler.Policies, err = networkHandler.NewDNSPolicies(dnsPolicyFile, mode); err != nil {
+			return err
+		}
+		go handler.Policies.Watch(ctx, 30*time.Second)
+	}
+	addr := net.JoinHostPort(AP.IPRange.IP.String(), strconv.Itoa(int(localDNSPort)))
+	listener, err := networkHandler.ListenDNS(addr) // Before the redirect of FirewallRules sends clients to it
+	if err != nil {
+		return err
+	}
 	go func() {
+		if err := listener.Serve(ctx, handler); err != nil {
+			log.Println("dns server stoped....", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		defer os.Remove(defaultDNSStatsFile)
+		defer os.Remove(defaultDNSQueryFile)
+		defer handler.Log.Close()
 		for {
 			select {
-			case dev := <-handler.DevicesChan:
-				log.Println(dev.HostName, dev.IPAddr, dev.MacAddr)
+			case <-ticker.C:
+				if err := networkHandler.WriteDNSStats(defaultDNSStatsFile, handler.Stats()); err != nil {
+					log.Println("error writing dns stats", err)
+				}
+				if err := networkHandler.WriteQueryLog(defaultDNSQueryFile, handler.Log.Entries("")); err != nil {
+					log.Println("error writing dns query log", err)
+				}
 			case <-ctx.Done():
-				log.Println("Stoping dhcp server and user log")
 				return
+			}
+		}
+	}()
+	log.Println("Local dns server on", addr, "forwards to", handler.Upstreams, "and answers", localZone.Domain)
+	return nil
+}
+
+// updateLocalDNS updates client name and query log client of local dns server by a lease event
+func updateLocalDNS(dev dhcp4d.DeviceInfo) {
+	if !localDNS {
+		return
+	}
+	granted := dev.Event == dhcp4d.LeaseGranted
+	localZone.Update(granted, dev.MacAddr, dev.HostName, dev.IPAddr)
+	if granted {
+		dnsClients.Set(dev.IPAddr, networkHandler.DNSClient{MAC: dev.MacAddr.String(), Class: dev.Fingerprint.Class})
+	} else {
+		dnsClients.Remove(dev.IPAddr)
+	}
+}
+
+// clientShaping picks rate limits of clients, own limits of the limits file win over defaults of their dhcp pool
+type clientShaping struct {
+	mu     sync.Mutex
+	own    map[string]tc.Limit // Limits by client mac
+	pools  map[string]tc.Limit // Default limits by pool name
+	leased map[string]string   // Pool by mac of clients holding a lease
+}
+
+func (c *clientShaping) setPool(name string, limit tc.Limit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pools[name] = limit
+}
+
+// limits returns limit of every limited client by mac
+func (c *clientShaping) limits() map[string]tc.Limit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limits := make(map[string]tc.Limit, len(c.own)+len(c.leased))
+	for mac, pool := range c.leased {
+		if limit := c.pools[pool]; !limit.IsZero() {
+			limits[mac] = limit
+		}
+	}
+	for mac, limit := range c.own {
+		limits[mac] = limit
+	}
+	return limits
+}
+
+// updateClientShaping applies pool limit of a client by a lease event
+func updateClientShaping(dev dhcp4d.DeviceInfo) {
+	if shaper == nil {
+		return
+	}
+	clientLimits.mu.Lock()
+	if dev.Event == dhcp4d.LeaseGranted {
+		clientLimits.leased[dev.MacAddr.String()] = dev.Pool
+	} else {
+		delete(clientLimits.leased, dev.MacAddr.String())
+	}
+	clientLimits.mu.Unlock()
+	if err := shaper.Apply(clientLimits.limits()); err != nil {
+		log.Println("error applying client limits", err)
+	}
+}
+
+// reloadClientLimits reads limits file and applies its limits
+func reloadClientLimits() error {
+	own, err := tc.LoadLimits(limitsFile)
+	if err != nil {
+		return err
+	}
+	clientLimits.mu.Lock()
+	clientLimits.own = own
+	clientLimits.mu.Unlock()
+	return shaper.Apply(clientLimits.limits())
+}
 
+// watchClientLimits reloads limits file when packetify clients limit changes it, until ctx is done
+func watchClientLimits(ctx context.Context, interval time.Duration) {
+	var modTime time.Time
+	if info, err := os.Stat(limitsFile); err == nil {
+		modTime = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(limitsFile)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			if err := reloadClientLimits(); err != nil {
+				log.Println("error reloading client limits", err)
+				continue
 			}
+			log.Println("Reloaded client limits of", limitsFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// BlockFloodingMAC blocks client of a mac flood alert in firewall until the alert ends
+func (AP *AccessPoint) BlockFloodingMAC(alert dhcp4d.Alert) {
+	if alert.Kind != dhcp4d.MACFlood {
+		return
+	}
+	mac := alert.MAC.String()
+	if _, blocked := blockedMACs.LoadOrStore(mac, alert.MAC); blocked {
+		return
+	}
+	if err := firewall.Add(networkHandler.ClientBlock{Iface: AP.IfaceName, MAC: alert.MAC}); err != nil {
+		log.Println("error blocking", mac, err)
+		blockedMACs.Delete(mac)
+		return
+	}
+	time.AfterFunc(time.Until(alert.Until), func() {
+		if _, blocked := blockedMACs.LoadAndDelete(mac); blocked {
+			if err := firewall.Delete(networkHandler.ClientBlock{Iface: AP.IfaceName, MAC: alert.MAC}); err != nil {
+				log.Println("error unblocking", mac, err)
+			}
+		}
+	})
+}
+
+// StartDHCPRelay relays dhcp messages of AP clients to --dhcp-relay server instead of serving them
+func (AP *AccessPoint) StartDHCPRelay() (net.PacketConn, *dhcp4d.EventBus, error) {
+	relay := &dhcp4d.Relay{
+		Server:    dhcpRelay.To4(),
+		IP:        AP.IPRange.IP.To4(),
+		CircuitID: []byte(AP.Ssid + "/" + AP.IfaceName),
+	}
+	clientConn, err := conn.NewUDP4BoundListener(AP.IfaceName, ":67")
+	if err != nil {
+		log.Println("Error listening for dhcp clients", err)
+		return nil, nil, err
+	}
+	serverConn, err := dhcp4d.NewRelayListener(relay.IP)
+	if err != nil {
+		log.Println("Error listening for dhcp server replies", err)
+		clientConn.Close()
+		return nil, nil, err
+	}
+	go func() {
+		if err := relay.Serve(clientConn, serverConn); err != nil {
+			log.Println("dhcp relay stoped....")
+			relay.Events.Close()
 		}
 	}()
+	log.Println("Relaying dhcp of", AP.IfaceName, "to", relay.Server)
+	return clientConn, &relay.Events, nil
+}
 
-	if err := wifidev.SetupIpToVirtIface(&AP.IPRange, AP.IfaceName); err != nil {
-		log.Println("Error setting up IP to virtual interface", err)
+// apIPv6 returns ipv6 address of the AP in --ipv6-prefix, nil without one
+func apIPv6() net.IP {
+	_, prefix, err := net.ParseCIDR(ipv6Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil
+	}
+	return dhcp6d.IPAdd(prefix.IP, 1)
+}
+
+// SetupIPv6 assigns first address of --ipv6-prefix to AP and starts router advertisements
+// and dhcpv6 server according to --ra-mode, both stop when ctx is done
+func (AP *AccessPoint) SetupIPv6(ctx context.Context, wifidev *networkHandler.WifiDevice) error {
+	_, prefix, err := net.ParseCIDR(ipv6Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return fmt.Errorf("invalid ipv6 prefix %q", ipv6Prefix)
+	}
+	if ones, _ := prefix.Mask.Size(); ones != 64 {
+		return fmt.Errorf("ipv6 prefix %v should be /64 for address autoconfiguration", prefix)
+	}
+	mode, err := dhcp6d.ParseRAMode(raMode)
+	if err != nil {
 		return err
 	}
 
-	//hostapd
-	Hstapd := hostapd.New(hostapdOptions...)
-	if err := hostapd.WriteCfg(AP.HostapdCFG, Hstapd); err != nil {
-		log.Println("Error writing hostapd config file", err)
+	apIP := &net.IPNet{IP: apIPv6(), Mask: prefix.Mask}
+	if err := wifidev.SetupIPv6ToVirtIface(apIP, AP.IfaceName); err != nil {
 		return err
 	}
+	log.Println("Assigned", apIP.String(), "to", AP.IfaceName)
+	if netShare != "false" {
+		ipv6Forwarded = networkHandler.MainNetworkService.IPv6ForwardingStatus()
+		acceptRA, err := networkHandler.MainNetworkService.AcceptRA(netShare)
+		if err != nil {
+			return err
+		}
+		if acceptRA == "1" { // Forwarding hosts ignore router advertisements of the uplink unless it's 2
+			if err := networkHandler.MainNetworkService.SetAcceptRA(netShare, "2"); err != nil {
+				return err
+			}
+			uplinkRA = acceptRA
+		}
+		if err := networkHandler.MainNetworkService.EnableIPv6Forwarding(); err != nil {
+			return err
+		}
+	}
 
-	HostapdCmd, err := hostapd.Run(AP.HostapdCFG, false)
+	dns, err := AP.IPv6DNS(ctx, apIP.IP)
 	if err != nil {
 		return err
 	}
-	if netShare != "false" {
-		err = networkHandler.EnableInternetSharing(AP.IfaceName, AP.InternetIface, AP.IPRange, true)
+	iface, err := net.InterfaceByName(AP.IfaceName)
+	if err != nil {
+		return err
+	}
+	advertiser := dhcp6d.NewRouterAdvertiser(iface, *prefix, mode)
+	advertiser.DNS = dns
+	go func() {
+		if err := advertiser.Run(ctx); err != nil {
+			log.Println("router advertisement stopped", err)
+		}
+	}()
+	log.Printf("Sending router advertisements for %v in %s mode", prefix, mode)
+
+	if mode.UsesDHCP() {
+		handler := dhcp6d.NewPoolHandler(dhcp6d.DUIDLL(iface.HardwareAddr), *prefix, 4096)
+		handler.DNS = dns
+		go func() {
+			if err := dhcp6d.Serve(ctx, iface, handler); err != nil {
+				log.Println("dhcpv6 server stopped", err)
+			}
+		}()
+		log.Println("Started dhcpv6 server on", AP.IfaceName)
+	}
+	return nil
+}
+
+// IPv6DNS returns dns servers of ipv6 clients, apIP when local dns server runs which then also serves
+// port 53 of apIP, or --dns when it's an ipv6 address
+func (AP *AccessPoint) IPv6DNS(ctx context.Context, apIP net.IP) ([]net.IP, error) {
+	if localDNS {
+		addr := net.JoinHostPort(apIP.String(), "53")
+		listener, err := networkHandler.ListenDNS(addr)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := listener.Serve(ctx, dnsHandler); err != nil {
+				log.Println("ipv6 dns server stoped....", err)
+			}
+		}()
+		log.Println("Local dns server on", addr, "for ipv6 clients")
+		return []net.IP{apIP}, nil
+	}
+	if dnsServer != nil && dnsServer.To4() == nil {
+		return []net.IP{dnsServer}, nil
+	}
+	log.Println("No dns server for ipv6 clients, they use", dnsServer, "of dhcp, set --local-dns or an ipv6 --dns")
+	return nil, nil
+}
+
+// addDHCPOptions adds options of --dhcp-* flags to options sent by handler
+func addDHCPOptions(handler *dhcp4d.DHCPHandler) error {
+	if len(dhcpDomain) != 0 {
+		handler.Options[dhcp4.OptionDomainName] = []byte(dhcpDomain)
+	}
+	if len(dhcpSearch) != 0 {
+		search, err := dhcp4d.EncodeDomainSearch(dhcpSearch)
+		if err != nil {
+			return err
+		}
+		handler.Options[dhcp4.OptionDomainSearch] = search
+	}
+	if len(dhcpNTP) != 0 {
+		ntp, err := dhcp4d.EncodeIPs(dhcpNTP)
+		if err != nil {
+			return err
+		}
+		handler.Options[dhcp4.OptionNetworkTimeProtocolServers] = ntp
+	}
+	if len(dhcpRoutes) != 0 {
+		var routes []dhcp4d.Route
+		hasDefault := false
+		for _, r := range dhcpRoutes {
+			route, err := dhcp4d.ParseRoute(r)
+			if err != nil {
+				return err
+			}
+			ones, _ := route.Destination.Mask.Size()
+			hasDefault = hasDefault || ones == 0
+			routes = append(routes, route)
+		}
+		// clients ignore router option when classless routes are sent, so keep the default route
+		if !hasDefault {
+			_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+			routes = append(routes, dhcp4d.Route{Destination: *defaultDst, Gateway: handler.IP})
+		}
+		classless, err := dhcp4d.EncodeClasslessRoutes(routes)
 		if err != nil {
-			log.Println("error Enable internet sharing", err)
 			return err
 		}
+		handler.Options[dhcp4.OptionClasslessRouteFormat] = classless
 	}
+	if dhcpMTU != 0 {
+		mtu, err := dhcp4d.EncodeMTU(dhcpMTU)
+		if err != nil {
+			return err
+		}
+		handler.Options[dhcp4.OptionInterfaceMTU] = mtu
+	}
+	if len(dhcpWPAD) != 0 {
+		handler.Options[dhcp4d.OptionWPAD] = []byte(dhcpWPAD)
+	}
+	for _, option := range dhcpRawOpts {
+		code, value, err := dhcp4d.ParseRawOption(option)
+		if err != nil {
+			return err
+		}
+		handler.Options[code] = value
+	}
+	return nil
+}
 
-	select {
-	case <-ctx.Done():
-		log.Println("ap stopped...")
-		if err := AP.CleanupAP(HostapdCmd, dhcp4PacketConn, wifidev); err != nil {
-			log.Println("error cleaning up", err)
+// addDHCPReservations reserves addresses of --dhcp-reserve-file and --dhcp-reserve flags on handler
+func addDHCPReservations(handler *dhcp4d.DHCPHandler) error {
+	if len(reserveFile) != 0 {
+		reservations, err := dhcp4d.LoadReservations(reserveFile)
+		if err != nil {
+			return err
+		}
+		for mac, ip := range reservations {
+			hwAddr, _ := net.ParseMAC(mac)
+			if err := handler.Reserve(hwAddr, ip); err != nil {
+				return err
+			}
+		}
+	}
+	for _, reservation := range dhcpReserve {
+		mac, ip, err := dhcp4d.ParseReservation(reservation)
+		if err != nil {
+			return err
+		}
+		if err := handler.Reserve(mac, ip); err != nil {
 			return err
 		}
-		wg.Done()
-		return nil
 	}
+	return nil
 }
 
 func (AP *AccessPoint) CleanupAP(HostapdCmd *exec.Cmd, dhcpPacketConn net.PacketConn,
 	wifidev *networkHandler.WifiDevice) (err error) {
 	log.Println("clean up")
-	if netShare != "false" {
-		err = networkHandler.DisableInternetSharing(AP.IfaceName, AP.InternetIface, AP.IPRange)
-		if err != nil {
-			log.Println("error Disable internet sharing", err)
+	blockedMACs.Range(func(mac, hwAddr interface{}) bool {
+		blockedMACs.Delete(mac) // Their rules go with the firewall chains
+		return true
+	})
+	if err = firewall.Cleanup(); err != nil {
+		log.Println("error removing firewall chains", err)
+		return err
+	}
+	log.Println("Remove firewall chains")
+	if shaper != nil {
+		if err = shaper.Cleanup(); err != nil {
+			log.Println("error removing traffic shaping", err)
 			return err
 		}
-		log.Println("Disable internet sharing")
+		log.Println("Remove traffic shaping")
 	}
 	if err = HostapdCmd.Process.Kill(); err != nil {
 		log.Println("error killing hostapd", err)
@@ -339,6 +1119,21 @@ func (AP *AccessPoint) CleanupAP(HostapdCmd *exec.Cmd, dhcpPacketConn net.Packet
 		return err
 	}
 
+	if len(ipv6Prefix) != 0 && netShare != "false" {
+		if !ipv6Forwarded {
+			if err = networkHandler.MainNetworkService.DisableIPv6Forwarding(); err != nil {
+				log.Println("error disabling ipv6 forwarding", err)
+				return err
+			}
+		}
+		if len(uplinkRA) != 0 {
+			if err = networkHandler.MainNetworkService.SetAcceptRA(netShare, uplinkRA); err != nil {
+				log.Println("error restoring accept_ra of", netShare, err)
+				return err
+			}
+		}
+	}
+
 	if err = wifidev.IWDeleteVirtualIface(AP.IfaceName); err != nil {
 		log.Println("error deleting virtual interface", err)
 		return err
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/Packetify/packetify/networkHandler"
+	"github.com/spf13/cobra"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultDNSStatsFile = "/var/run/packetify/dns-stats.json"
+	defaultDNSQueryFile = "/var/run/packetify/dns-queries.jsonl" // Last queries kept by local dns server
+)
+
+var (
+	dnsStatsFile  string
+	dnsQueryFile  string
+	dnsLogClient  string
+	dnsLogLines   int
+	dnsLogFollow  bool
+	dnsLogCommand = &cobra.Command{
+		Use:     "log",
+		Short:   "Show dns queries of clients",
+		Long:    "Show last dns queries of access point clients, --file also reads a --dns-log file of createap",
+		Example: "packetify dns log --client aa:bb:cc:dd:ee:ff -f",
+		Run: func(cmd *cobra.Command, args []string) {
+			if _, err := net.ParseMAC(dnsLogClient); err != nil && len(dnsLogClient) != 0 && net.ParseIP(dnsLogClient) == nil {
+				log.Println("client must be a mac or ip address:", dnsLogClient)
+				return
+			}
+			entries, err := networkHandler.ReadQueryLog(dnsQueryFile)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tCLIENT\tMAC\tNAME\tTYPE\tRCODE\tUPSTREAM\tLATENCY")
+			var last uint64 // Number of the last entry read, entries are added when answered so times aren't in order
+			if len(entries) != 0 {
+				last = entries[len(entries)-1].Seq
+			}
+			printEntries := func(entries []networkHandler.QueryLogEntry) {
+				for _, entry := range entries {
+					if !entry.Matches(dnsLogClient) {
+						continue
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format("15:04:05.000"), entry.ClientIP, entry.ClientMAC,
+						entry.Name, entry.Type, entry.Rcode, entry.Upstream, entry.Latency.Round(time.Microsecond*100))
+				}
+				w.Flush()
+			}
+			var matched []networkHandler.QueryLogEntry
+			for _, entry := range entries {
+				if entry.Matches(dnsLogClient) {
+					matched = append(matched, entry)
+				}
+			}
+			if dnsLogLines > 0 && len(matched) > dnsLogLines {
+				matched = matched[len(matched)-dnsLogLines:]
+			}
+			printEntries(matched)
+			for dnsLogFollow {
+				time.Sleep(time.Second)
+				if entries, err = networkHandler.ReadQueryLog(dnsQueryFile); err != nil {
+					log.Println(err)
+					return
+				}
+				entries = networkHandler.EntriesAfter(entries, last)
+				if len(entries) != 0 {
+					last = entries[len(entries)-1].Seq
+				}
+				printEntries(entries)
+			}
+		},
+	}
+	dnsStatsCommand = &cobra.Command{
+		Use:   "stats",
+		Short: "Show dns cache, blocklist and upstream counters",
+		Long:  "Show cache, blocklist and upstream counters of the local dns server of a running access point",
+		Run: func(cmd *cobra.Command, args []string) {
+			stats, err := networkHandler.ReadDNSStats(dnsStatsFile)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "updated\t%s\n", stats.Time.Format(time.RFC3339))
+			if cache := stats.Cache; cache != nil {
+				ratio := 0.0
+				if total := cache.Hits + cache.Misses; total != 0 {
+					ratio = float64(cache.Hits) / float64(total) * 100
+				}
+				fmt.Fprintf(w, "cache entries\t%d\n", cache.Entries)
+				fmt.Fprintf(w, "cache hits\t%d (%.1f%%)\n", cache.Hits, ratio)
+				fmt.Fprintf(w, "cache negative hits\t%d\n", cache.Negative)
+				fmt.Fprintf(w, "cache misses\t%d\n", cache.Misses)
+				fmt.Fprintf(w, "cache evictions\t%d\n", cache.Evictions)
+				fmt.Fprintf(w, "cache prefetches\t%d\n", cache.Prefetches)
+			}
+			lists := make([]string, 0, len(stats.Blocklists))
+			for list := range stats.Blocklists {
+				lists = append(lists, list)
+			}
+			sort.Strings(lists)
+			for _, list := range lists {
+				fmt.Fprintf(w, "blocked by %s\t%d\n", list, stats.Blocklists[list])
+			}
+			w.Flush()
+			if len(stats.Upstreams) == 0 {
+				return
+			}
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "UPSTREAM\tSTATE\tQUERIES\tFAILURES\tRTT\tLAST ERROR")
+			for _, upstream := range stats.Upstreams {
+				state := "up"
+				if upstream.Down {
+					state = "down"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", upstream.Upstream, state, upstream.Queries, upstream.Failures,
+					upstream.RTT.Round(time.Microsecond*100), upstream.LastError)
+			}
+			w.Flush()
+		},
+	}
+	dnsCommand = &cobra.Command{
+		Use:   "dns",
+		Short: "Inspect local dns server",
+		Long:  `Inspect local dns server of access point`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				cmd.Help()
+				return
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(dnsCommand)
+	dnsCommand.AddCommand(dnsStatsCommand)
+	dnsCommand.AddCommand(dnsLogCommand)
+	dnsStatsCommand.Flags().StringVarP(&dnsStatsFile, "statsfile", "", defaultDNSStatsFile, "dns stats file of access point")
+	dnsLogCommand.Flags().StringVarP(&dnsQueryFile, "file", "", defaultDNSQueryFile, "dns query file of access point")
+	dnsLogCommand.Flags().StringVarP(&dnsLogClient, "client", "c", "", "show queries of this client mac or ip only")
+	dnsLogCommand.Flags().IntVarP(&dnsLogLines, "lines", "n", 50, "number of last queries shown, 0 shows all")
+	dnsLogCommand.Flags().BoolVarP(&dnsLogFollow, "follow", "f", false, "keep showing new queries")
+}
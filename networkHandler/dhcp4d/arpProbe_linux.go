@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// ARPProber detects address conflicts by sending RFC 5227 arp probes on an interface
+type ARPProber struct {
+	Iface   *net.Interface
+	Timeout time.Duration // How long to wait for an answer
+}
+
+func NewARPProber(ifaceName string, timeout time.Duration) (*ARPProber, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	return &ARPProber{Iface: iface, Timeout: timeout}, nil
+}
+
+// InUse sends an arp probe for ip and reports whether any device answered it
+// failures of the probe itself are treated as not in use, so they never stop the dhcp server
+func (p *ARPProber) InUse(ip net.IP) bool {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	addr := unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: p.Iface.Index}
+	if err := unix.Bind(fd, &addr); err != nil {
+		return false
+	}
+
+	probe, err := p.probePacket(ip)
+	if err != nil {
+		return false
+	}
+	if err := unix.Sendto(fd, probe, 0, &addr); err != nil {
+		return false
+	}
+
+	deadline := time.Now().Add(p.Timeout)
+	buffer := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return false
+		}
+		n, _, err := unix.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return false
+		}
+		packet := gopacket.NewPacket(buffer[:n], layers.LayerTypeEthernet, gopacket.NoCopy)
+		if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+			arp := arpLayer.(*layers.ARP)
+			if arp.Operation == layers.ARPReply && bytes.Equal(arp.SourceProtAddress, ip.To4()) {
+				return true
+			}
+		}
+	}
+}
+
+// probePacket builds an arp request for ip with zero sender address
+func (p *ARPProber) probePacket(ip net.IP) ([]byte, error) {
+	eth := layers.Ethernet{
+		SrcMAC:       p.Iface.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   p.Iface.HardwareAddr,
+		SourceProtAddress: net.IPv4zero.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &arp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func htons(data uint16) uint16 { return data<<8 | data>>8 }
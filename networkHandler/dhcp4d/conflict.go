@@ -0,0 +1,84 @@
+package dhcp4d
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// maxProbes is how many addresses are probed for one Discover before giving up
+const maxProbes = 4
+
+// ConflictProber checks whether an address is already used on the network before it's offered
+type ConflictProber interface {
+	InUse(ip net.IP) bool
+}
+
+// Quarantined returns addresses which won't be offered until the returned time
+func (h *DHCPHandler) Quarantined() map[string]time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	quarantined := make(map[string]time.Time)
+	for i, until := range h.quarantine {
+		if until.After(now) {
+			quarantined[dhcp4.IPAdd(h.Start, i).String()] = until
+		}
+	}
+	return quarantined
+}
+
+// quarantineLease keeps lease number out of offers for QuarantineDuration, callers must hold h.mu
+func (h *DHCPHandler) quarantineLease(leaseNum int) {
+	if h.QuarantineDuration <= 0 {
+		return
+	}
+	if h.quarantine == nil {
+		h.quarantine = make(map[int]time.Time)
+	}
+	h.quarantine[leaseNum] = time.Now().Add(h.QuarantineDuration)
+}
+
+// isQuarantined reports whether lease number is in quarantine, callers must hold h.mu
+func (h *DHCPHandler) isQuarantined(leaseNum int, now time.Time) bool {
+	until, ok := h.quarantine[leaseNum]
+	if ok && !until.After(now) {
+		delete(h.quarantine, leaseNum)
+		return false
+	}
+	return ok
+}
+
+// probedFreeLease returns a free lease of pool which nobody answers probes for, callers must hold h.mu
+// h.mu is released while probing so probes don't stall other messages, leases are checked again after it
+func (h *DHCPHandler) probedFreeLease(pool *Pool) int {
+	for i := 0; i < maxProbes; i++ {
+		free := h.freeLease(pool)
+		if free == -1 || h.Prober == nil {
+			return free
+		}
+		ip := dhcp4.IPAdd(h.Start, free)
+		if h.probing == nil {
+			h.probing = make(map[int]bool)
+		}
+		h.probing[free] = true
+		h.mu.Unlock()
+		inUse := h.Prober.InUse(ip)
+		h.mu.Lock()
+		delete(h.probing, free)
+		if !inUse {
+			if h.isFreeLease(free, time.Now()) {
+				return free
+			}
+			continue // Taken by a Request or reservation while probing
+		}
+		log.Println("dhcp address", ip, "is in use by an unknown device, quarantined")
+		h.quarantineLease(free)
+		if h.QuarantineDuration <= 0 {
+			return -1 // Without quarantine the same address could be picked again
+		}
+	}
+	return -1
+}
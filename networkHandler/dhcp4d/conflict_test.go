@@ -0,0 +1,129 @@
+package dhcp4d
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// staticProber reports addresses of inUse as taken
+type staticProber struct {
+	mu     sync.Mutex
+	inUse  map[string]bool
+	probed int
+}
+
+func (p *staticProber) InUse(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probed++
+	return p.inUse[ip.String()]
+}
+
+func TestDHCPHandler_ConflictProbe(t *testing.T) {
+	handler := newTestHandler(3)
+	handler.QuarantineDuration = time.Hour
+	prober := &staticProber{inUse: map[string]bool{"192.168.100.2": true, "192.168.100.3": true}}
+	handler.Prober = prober
+
+	// With the only answering address leased one Discover probes both addresses in use
+	handler.Leases[2] = Lease{Nic: testMAC(3).String(), ReqIP: net.IP{192, 168, 100, 4}, Expiry: time.Now().Add(time.Hour)}
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(1), nil); mt != 0 {
+		t.Errorf("Discover() with free addresses in use=%v, want no reply", mt)
+	}
+	if quarantined := handler.Quarantined(); len(quarantined) != 2 || prober.probed != 2 {
+		t.Errorf("Quarantined()=%v after %d probes, want both addresses in use", quarantined, prober.probed)
+	}
+	delete(handler.Leases, 2)
+	if mt, offered := serve(handler, dhcp4.Discover, testMAC(1), nil); mt != dhcp4.Offer || !offered.Equal(net.IP{192, 168, 100, 4}) {
+		t.Fatalf("Discover()=%v %v, want Offer of the only free address", mt, offered)
+	}
+
+	serve(handler, dhcp4.Request, testMAC(1), net.IP{192, 168, 100, 4})
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(2), nil); mt != 0 {
+		t.Errorf("Discover() with all addresses quarantined or leased=%v, want no reply", mt)
+	}
+
+	probed := prober.probed
+	serve(handler, dhcp4.Discover, testMAC(1), nil)
+	if prober.probed != probed {
+		t.Errorf("Discover() of leased client probed its own address")
+	}
+}
+
+func TestDHCPHandler_RequestQuarantined(t *testing.T) {
+	handler := newTestHandler(2)
+	handler.QuarantineDuration = time.Hour
+	handler.mu.Lock()
+	handler.quarantineLease(0)
+	handler.mu.Unlock()
+
+	if mt, _ := serve(handler, dhcp4.Request, testMAC(1), net.IP{192, 168, 100, 2}); mt != dhcp4.NAK {
+		t.Errorf("Request() of quarantined address=%v, want NAK", mt)
+	}
+	if mt, _ := serve(handler, dhcp4.Request, testMAC(1), net.IP{192, 168, 100, 3}); mt != dhcp4.ACK {
+		t.Errorf("Request() of free address=%v, want ACK", mt)
+	}
+	handler.mu.Lock()
+	handler.quarantineLease(1)
+	handler.mu.Unlock()
+	if mt, _ := serve(handler, dhcp4.Request, testMAC(1), net.IP{192, 168, 100, 3}); mt != dhcp4.ACK {
+		t.Errorf("Request() renewing own quarantined address=%v, want ACK", mt)
+	}
+}
+
+// blockingProber answers probes as free once release is closed
+type blockingProber struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingProber) InUse(ip net.IP) bool {
+	p.started <- struct{}{}
+	<-p.release
+	return false
+}
+
+func TestDHCPHandler_ProbeUnlocked(t *testing.T) {
+	handler := newTestHandler(1)
+	prober := &blockingProber{started: make(chan struct{}), release: make(chan struct{})}
+	handler.Prober = prober
+	offers := make(chan net.IP, 1)
+	go func() {
+		_, offered := serve(handler, dhcp4.Discover, testMAC(1), nil)
+		offers <- offered
+	}()
+	<-prober.started
+
+	// Another client takes the address while it's probed
+	handler.SweepExpired(time.Now())
+	if mt, _ := serve(handler, dhcp4.Request, testMAC(2), net.IP{192, 168, 100, 2}); mt != dhcp4.ACK {
+		t.Errorf("Request() during probe=%v, want ACK", mt)
+	}
+	close(prober.release)
+	if offered := <-offers; offered != nil {
+		t.Errorf("Discover() offered %v leased while it was probed", offered)
+	}
+}
+
+func TestDHCPHandler_DeclineQuarantine(t *testing.T) {
+	handler := newTestHandler(1)
+	handler.QuarantineDuration = time.Hour
+
+	_, offered := serve(handler, dhcp4.Discover, testMAC(1), nil)
+	serve(handler, dhcp4.Request, testMAC(1), offered)
+	serve(handler, dhcp4.Decline, testMAC(1), nil)
+
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(1), nil); mt != 0 {
+		t.Errorf("Discover() offered declined address")
+	}
+	handler.mu.Lock()
+	handler.quarantine[0] = time.Now().Add(-time.Second)
+	handler.mu.Unlock()
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(1), nil); mt != dhcp4.Offer {
+		t.Errorf("Discover() after quarantine=%v, want Offer", mt)
+	}
+}
@@ -2,54 +2,118 @@
 package dhcp4d
 
 import (
+	"context"
 	"github.com/krolaw/dhcp4"
+	"log"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 )
 
 // TODO: add option to allow/disallow clients to request specific IPs
 
 type Lease struct {
-	ReqTime  time.Time
-	ReqIP    net.IP
-	Nic      string    // Client's CHAddr
-	Expiry   time.Time // When the lease expires
-	HostName string
+	ReqTime     time.Time   `json:"req_time"`
+	ReqIP       net.IP      `json:"req_ip"`
+	Nic         string      `json:"nic"`    // Client's CHAddr
+	Expiry      time.Time   `json:"expiry"` // When the lease expires
+	HostName    string      `json:"hostname"`
+	Fingerprint Fingerprint `json:"fingerprint"`
+	Pool        string      `json:"pool,omitempty"`
 }
 
 type DeviceInfo struct {
-	MacAddr  net.HardwareAddr
-	IPAddr   net.IP
-	HostName string
-	Time     time.Time
+	Event       EventType
+	MacAddr     net.HardwareAddr
+	IPAddr      net.IP
+	HostName    string
+	Fingerprint Fingerprint
+	Pool        string
+	Time        time.Time
 }
 
 type DHCPHandler struct {
-	IP            net.IP        // Server IP to use
-	Options       dhcp4.Options // Options to send to DHCP Clients
-	Start         net.IP        // Start of IP range to distribute
-	LeaseRange    int           // Number of IPs to distribute (starting from start)
-	LeaseDuration time.Duration // Lease period
-	Leases        map[int]Lease // Map to keep track of leases
-	DevicesChan   chan DeviceInfo
+	IP            net.IP            // Server IP to use
+	Options       dhcp4.Options     // Options to send to DHCP Clients
+	Start         net.IP            // Start of IP range to distribute
+	LeaseRange    int               // Number of IPs to distribute (starting from start)
+	LeaseDuration time.Duration     // Lease period
+	Leases        map[int]Lease     // Map to keep track of leases
+	Store         LeaseStore        // Optional persistent lease storage
+	Reservations  map[string]net.IP // Fixed addresses by client mac, kept out of the dynamic pool
+	Events        EventBus          // Lease events of clients
+	Pools         []*Pool           // Parts of the range picked by client, whole range is used without pools
+
+	Prober             ConflictProber // Optional check of new addresses before they're offered
+	QuarantineDuration time.Duration  // How long addresses in use by unknown devices are not offered
+	Limiter            *RateLimiter   // Optional flood and starvation protection
+
+	mu         sync.Mutex        // Guards Leases, Reservations, Pools, quarantine and probing
+	quarantine map[int]time.Time // Lease numbers in use by unknown devices
+	probing    map[int]bool      // Lease numbers probed without h.mu, not picked by other Discovers
+}
+
+// LoadLeases fills Leases from Store and drops expired or out of range leases
+func (h *DHCPHandler) LoadLeases() error {
+	if h.Store == nil {
+		return nil
+	}
+	leases, err := h.Store.Load()
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for _, l := range leases {
+		leaseNum := -1
+		if l.ReqIP.To4() != nil {
+			leaseNum = dhcp4.IPRange(h.Start, l.ReqIP) - 1
+		}
+		if l.Expiry.Before(now) || leaseNum < 0 || leaseNum >= h.LeaseRange {
+			if err := h.Store.Delete(l.Nic); err != nil {
+				return err
+			}
+			continue
+		}
+		h.Leases[leaseNum] = l
+	}
+	return nil
 }
 
 func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) (d dhcp4.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Limiter != nil && !h.Limiter.Allow(p.CHAddr(), msgType, h.isKnownClient(p.CHAddr().String()), time.Now()) {
+		return nil
+	}
+
 	switch msgType {
 	case dhcp4.Discover:
 		free, nic := -1, p.CHAddr().String()
+		pool, hasPool := h.selectPool(nic, NewFingerprint(p.CHAddr(), options))
+		if reserved, ok := h.Reservations[nic]; ok { // Always offer reserved address
+			free = dhcp4.IPRange(h.Start, reserved) - 1
+			goto reply
+		}
+		if !hasPool {
+			return nil // No pool takes this client
+		}
 		for i, v := range h.Leases { // Find previous lease
-			if v.Nic == nic {
+			if v.Nic == nic && !h.isReservedLease(i) && h.poolContains(pool, i) {
 				free = i
 				goto reply
 			}
 		}
-		if free = h.FreeLease(); free == -1 {
+		if h.Limiter != nil && !h.Limiter.Offer(p.CHAddr(), time.Now()) {
+			return nil
+		}
+		if free = h.probedFreeLease(pool); free == -1 {
 			return
 		}
 	reply:
-		return dhcp4.ReplyPacket(p, dhcp4.Offer, h.IP, dhcp4.IPAdd(h.Start, free), h.LeaseDuration,
+		return dhcp4.ReplyPacket(p, dhcp4.Offer, h.IP, dhcp4.IPAdd(h.Start, free), h.leaseDuration(pool),
 			h.Options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
 
 	case dhcp4.Request:
@@ -58,22 +122,55 @@ func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, optio
 		}
 		reqIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
 		hostname := options[dhcp4.OptionHostName]
-		devspec := DeviceInfo{
-			MacAddr:  p.CHAddr(),
-			IPAddr:   reqIP,
-			HostName: string(hostname),
-			Time:     time.Now(),
-		}
-		h.DevicesChan <- devspec
 		if reqIP == nil {
 			reqIP = net.IP(p.CIAddr())
 		}
 
 		if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
+			nic := p.CHAddr().String()
+			reserved, hasReservation := h.Reservations[nic]
+			if hasReservation && !reserved.Equal(reqIP) {
+				return dhcp4.ReplyPacket(p, dhcp4.NAK, h.IP, nil, 0, nil)
+			}
+			if owner, ok := h.reservedBy(reqIP); ok && owner != nic {
+				return dhcp4.ReplyPacket(p, dhcp4.NAK, h.IP, nil, 0, nil)
+			}
+			fingerprint := NewFingerprint(p.CHAddr(), options)
+			pool, hasPool := h.selectPool(nic, fingerprint)
 			if leaseNum := dhcp4.IPRange(h.Start, reqIP) - 1; leaseNum >= 0 && leaseNum < h.LeaseRange {
-				if l, exists := h.Leases[leaseNum]; !exists || l.Nic == p.CHAddr().String() {
-					h.Leases[leaseNum] = Lease{Nic: p.CHAddr().String(), Expiry: time.Now().Add(h.LeaseDuration), ReqTime: time.Now(), ReqIP: reqIP}
-					return dhcp4.ReplyPacket(p, dhcp4.ACK, h.IP, reqIP, h.LeaseDuration,
+				if !hasReservation && (!hasPool || !h.poolContains(pool, leaseNum)) {
+					return dhcp4.ReplyPacket(p, dhcp4.NAK, h.IP, nil, 0, nil) // Address of another pool
+				}
+				now := time.Now()
+				if l := h.Leases[leaseNum]; l.Nic != nic && !hasReservation && h.isQuarantined(leaseNum, now) {
+					return dhcp4.ReplyPacket(p, dhcp4.NAK, h.IP, nil, 0, nil) // Address in use by an unknown device
+				}
+				leaseDuration := h.leaseDuration(pool)
+				if l, exists := h.Leases[leaseNum]; !exists || l.Nic == nic || l.Expiry.Before(now) || hasReservation {
+					if exists && l.Nic != nic { // Address is taken back from expired lease or by reserved owner
+						h.deleteLease(l.Nic)
+					}
+					for i, v := range h.Leases { // Client moved to another address
+						if v.Nic == nic && i != leaseNum {
+							delete(h.Leases, i)
+						}
+					}
+					h.Leases[leaseNum] = Lease{Nic: nic, Expiry: now.Add(leaseDuration), ReqTime: now, ReqIP: dhcp4.IPAdd(reqIP, 0),
+						HostName: string(hostname), Fingerprint: fingerprint, Pool: poolName(pool)}
+					h.saveLease(h.Leases[leaseNum])
+					if h.Limiter != nil {
+						h.Limiter.Accepted(p.CHAddr())
+					}
+					h.Events.Publish(DeviceInfo{
+						Event:       LeaseGranted,
+						MacAddr:     append(net.HardwareAddr(nil), p.CHAddr()...),
+						IPAddr:      dhcp4.IPAdd(reqIP, 0),
+						HostName:    string(hostname),
+						Fingerprint: fingerprint,
+						Pool:        poolName(pool),
+						Time:        now,
+					})
+					return dhcp4.ReplyPacket(p, dhcp4.ACK, h.IP, reqIP, leaseDuration,
 						h.Options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
 				}
 			}
@@ -82,9 +179,26 @@ func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, optio
 
 	case dhcp4.Release, dhcp4.Decline:
 		nic := p.CHAddr().String()
+		event := LeaseReleased
+		if msgType == dhcp4.Decline {
+			event = LeaseDeclined
+		}
 		for i, v := range h.Leases {
 			if v.Nic == nic {
+				if msgType == dhcp4.Decline { // Client found the address in use
+					h.quarantineLease(i)
+				}
 				delete(h.Leases, i)
+				h.deleteLease(nic)
+				h.Events.Publish(DeviceInfo{
+					Event:       event,
+					MacAddr:     append(net.HardwareAddr(nil), p.CHAddr()...),
+					IPAddr:      v.ReqIP,
+					HostName:    v.HostName,
+					Fingerprint: v.Fingerprint,
+					Pool:        v.Pool,
+					Time:        time.Now(),
+				})
 				break
 			}
 		}
@@ -92,15 +206,106 @@ func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, optio
 	return nil
 }
 
+// isKnownClient reports whether nic has a lease or reservation, callers must hold h.mu
+func (h *DHCPHandler) isKnownClient(nic string) bool {
+	if _, ok := h.Reservations[nic]; ok {
+		return true
+	}
+	for _, l := range h.Leases {
+		if l.Nic == nic {
+			return true
+		}
+	}
+	return false
+}
+
+// FreeLease returns number of a free lease in whole range or -1 if all leases are taken
 func (h *DHCPHandler) FreeLease() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.freeLease(nil)
+}
+
+// freeLease returns number of a free lease in pool, callers must hold h.mu
+func (h *DHCPHandler) freeLease(pool *Pool) int {
 	now := time.Now()
-	b := rand.Intn(h.LeaseRange) // Try random first
-	for _, v := range [][]int{{b, h.LeaseRange}, {0, b}} {
+	first, size := h.poolBounds(pool)
+	b := first + rand.Intn(size) // Try random first
+	for _, v := range [][]int{{b, first + size}, {first, b}} {
 		for i := v[0]; i < v[1]; i++ {
-			if l, ok := h.Leases[i]; !ok || l.Expiry.Before(now) {
+			if h.isFreeLease(i, now) {
 				return i
 			}
 		}
 	}
 	return -1
 }
+
+// isFreeLease reports whether lease number may be offered at now, callers must hold h.mu
+func (h *DHCPHandler) isFreeLease(leaseNum int, now time.Time) bool {
+	if h.isReservedLease(leaseNum) || h.isQuarantined(leaseNum, now) || h.probing[leaseNum] {
+		return false
+	}
+	l, ok := h.Leases[leaseNum]
+	return !ok || l.Expiry.Before(now)
+}
+
+// SweepExpired removes leases expired before now and publishes a LeaseExpired event for each
+func (h *DHCPHandler) SweepExpired(now time.Time) []Lease {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var expired []Lease
+	for i, l := range h.Leases {
+		if !l.Expiry.Before(now) {
+			continue
+		}
+		delete(h.Leases, i)
+		h.deleteLease(l.Nic)
+		expired = append(expired, l)
+		mac, _ := net.ParseMAC(l.Nic)
+		h.Events.Publish(DeviceInfo{
+			Event:       LeaseExpired,
+			MacAddr:     mac,
+			IPAddr:      l.ReqIP,
+			HostName:    l.HostName,
+			Fingerprint: l.Fingerprint,
+			Pool:        l.Pool,
+			Time:        now,
+		})
+	}
+	return expired
+}
+
+// RunSweeper expires leases every interval until ctx is done
+func (h *DHCPHandler) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, l := range h.SweepExpired(now) {
+				log.Println("dhcp lease expired", l.Nic, l.ReqIP)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *DHCPHandler) saveLease(l Lease) {
+	if h.Store == nil {
+		return
+	}
+	if err := h.Store.Put(l); err != nil {
+		log.Println("error saving dhcp lease", err)
+	}
+}
+
+func (h *DHCPHandler) deleteLease(nic string) {
+	if h.Store == nil {
+		return
+	}
+	if err := h.Store.Delete(nic); err != nil {
+		log.Println("error deleting dhcp lease", err)
+	}
+}
@@ -0,0 +1,182 @@
+package dhcp4d
+
+import (
+	"context"
+	"fmt"
+	"github.com/krolaw/dhcp4"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestHandler(leaseRange int) *DHCPHandler {
+	return &DHCPHandler{
+		IP:            net.IP{192, 168, 100, 1},
+		Start:         net.IP{192, 168, 100, 2},
+		LeaseRange:    leaseRange,
+		LeaseDuration: time.Hour,
+		Leases:        make(map[int]Lease),
+		Options: dhcp4.Options{
+			dhcp4.OptionSubnetMask: net.IP{255, 255, 255, 0},
+			dhcp4.OptionRouter:     net.IP{192, 168, 100, 1},
+		},
+	}
+}
+
+func testMAC(i int) net.HardwareAddr {
+	return net.HardwareAddr{0x02, 0, 0, 0, byte(i >> 8), byte(i)}
+}
+
+// serve builds a synthetic client packet and returns the message type and yiaddr of the reply
+func serve(h *DHCPHandler, mt dhcp4.MessageType, mac net.HardwareAddr, reqIP net.IP) (dhcp4.MessageType, net.IP) {
+	var options []dhcp4.Option
+	if reqIP != nil {
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: reqIP.To4()})
+	}
+	options = append(options, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("host-" + mac.String())})
+	req := dhcp4.RequestPacket(mt, mac, nil, []byte{1, 2, 3, 4}, false, options)
+	reply := h.ServeDHCP(req, mt, req.ParseOptions())
+	if reply == nil {
+		return 0, nil
+	}
+	return dhcp4.MessageType(reply.ParseOptions()[dhcp4.OptionDHCPMessageType][0]), reply.YIAddr()
+}
+
+func TestDHCPHandler_ServeDHCP(t *testing.T) {
+	handler := newTestHandler(10)
+	events := handler.Events.Subscribe(10)
+	mac := testMAC(1)
+
+	mt, offered := serve(handler, dhcp4.Discover, mac, nil)
+	if mt != dhcp4.Offer || !dhcp4.IPInRange(handler.Start, dhcp4.IPAdd(handler.Start, 9), offered) {
+		t.Fatalf("Discover()=%v %v, want Offer in range", mt, offered)
+	}
+	if mt, acked := serve(handler, dhcp4.Request, mac, offered); mt != dhcp4.ACK || !acked.Equal(offered) {
+		t.Fatalf("Request(%v)=%v %v, want ACK", offered, mt, acked)
+	}
+	if mt, again := serve(handler, dhcp4.Discover, mac, nil); mt != dhcp4.Offer || !again.Equal(offered) {
+		t.Errorf("Discover() of leased client offered %v, want %v", again, offered)
+	}
+	if mt, _ := serve(handler, dhcp4.Request, testMAC(2), offered); mt != dhcp4.NAK {
+		t.Errorf("Request() of leased address by other client=%v, want NAK", mt)
+	}
+	serve(handler, dhcp4.Release, mac, nil)
+	if len(handler.Leases) != 0 {
+		t.Errorf("Release() left %d leases", len(handler.Leases))
+	}
+
+	for _, want := range []EventType{LeaseGranted, LeaseReleased} {
+		select {
+		case dev := <-events:
+			if dev.Event != want || dev.MacAddr.String() != mac.String() || !dev.IPAddr.Equal(offered) {
+				t.Errorf("event=%v %v %v, want %v %v %v", dev.Event, dev.MacAddr, dev.IPAddr, want, mac, offered)
+			}
+		default:
+			t.Fatalf("missing %v event", want)
+		}
+	}
+}
+
+func TestDHCPHandler_SweepExpired(t *testing.T) {
+	handler := newTestHandler(10)
+	handler.LeaseDuration = time.Minute
+	events := handler.Events.Subscribe(10)
+	for i := 0; i < 3; i++ {
+		_, offered := serve(handler, dhcp4.Discover, testMAC(i), nil)
+		serve(handler, dhcp4.Request, testMAC(i), offered)
+		<-events
+	}
+
+	if expired := handler.SweepExpired(time.Now()); len(expired) != 0 {
+		t.Errorf("SweepExpired(now) expired %d leases, want 0", len(expired))
+	}
+	if expired := handler.SweepExpired(time.Now().Add(2 * time.Minute)); len(expired) != 3 {
+		t.Errorf("SweepExpired(now+2m) expired %d leases, want 3", len(expired))
+	}
+	for i := 0; i < 3; i++ {
+		if dev := <-events; dev.Event != LeaseExpired {
+			t.Errorf("event=%v, want %v", dev.Event, LeaseExpired)
+		}
+	}
+}
+
+func TestDHCPHandler_SlowSubscriber(t *testing.T) {
+	handler := newTestHandler(50)
+	handler.Events.Subscribe(0) // Never read
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			_, offered := serve(handler, dhcp4.Discover, testMAC(i), nil)
+			serve(handler, dhcp4.Request, testMAC(i), offered)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeDHCP blocked on a subscriber which doesn't read events")
+	}
+}
+
+func TestDHCPHandler_Concurrent(t *testing.T) {
+	handler := newTestHandler(200)
+	handler.LeaseDuration = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handler.RunSweeper(ctx, 5*time.Millisecond)
+
+	events := handler.Events.Subscribe(8)
+	go func() {
+		for range events {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 50; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			mac := testMAC(c)
+			for i := 0; i < 20; i++ {
+				mt, offered := serve(handler, dhcp4.Discover, mac, nil)
+				if mt != dhcp4.Offer {
+					t.Errorf("client %d Discover()=%v, want Offer", c, mt)
+					return
+				}
+				serve(handler, dhcp4.Request, mac, offered)
+				if i%5 == 0 {
+					serve(handler, dhcp4.Release, mac, nil)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	handler.Events.Unsubscribe(events)
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	seen := make(map[string]int)
+	for i, l := range handler.Leases {
+		if prev, ok := seen[l.Nic]; ok {
+			t.Errorf("client %s holds leases %d and %d", l.Nic, prev, i)
+		}
+		seen[l.Nic] = i
+		if want := dhcp4.IPAdd(handler.Start, i); !l.ReqIP.Equal(want) {
+			t.Errorf("lease %d has address %v, want %v", i, l.ReqIP, want)
+		}
+	}
+}
+
+func ExampleEventBus() {
+	var bus EventBus
+	devices := bus.Subscribe(1)
+	bus.Publish(DeviceInfo{Event: LeaseGranted, HostName: "laptop"})
+	bus.Publish(DeviceInfo{Event: LeaseGranted, HostName: "dropped"}) // Subscriber buffer is full
+	bus.Close()
+	for dev := range devices {
+		fmt.Println(dev.Event, dev.HostName)
+	}
+	// Output: lease granted laptop
+}
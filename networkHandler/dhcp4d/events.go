@@ -0,0 +1,85 @@
+package dhcp4d
+
+import (
+	"sync"
+)
+
+type EventType int
+
+const (
+	LeaseGranted EventType = iota
+	LeaseReleased
+	LeaseDeclined
+	LeaseExpired
+)
+
+func (e EventType) String() string {
+	switch e {
+	case LeaseGranted:
+		return "lease granted"
+	case LeaseReleased:
+		return "lease released"
+	case LeaseDeclined:
+		return "lease declined"
+	case LeaseExpired:
+		return "lease expired"
+	}
+	return "unknown"
+}
+
+// EventBus fans out DeviceInfo events to subscribers
+// Publish never blocks, events are dropped for subscribers which don't keep up
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[<-chan DeviceInfo]chan DeviceInfo
+	closed bool
+}
+
+// Subscribe returns a channel which receives published events, size is the channel buffer size
+func (b *EventBus) Subscribe(size int) <-chan DeviceInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan DeviceInfo, size)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	if b.subs == nil {
+		b.subs = make(map[<-chan DeviceInfo]chan DeviceInfo)
+	}
+	b.subs[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops delivering events to ch and closes it
+func (b *EventBus) Unsubscribe(ch <-chan DeviceInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(sub)
+	}
+}
+
+// Publish sends dev to every subscriber which has room for it
+func (b *EventBus) Publish(dev DeviceInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		select {
+		case sub <- dev:
+		default:
+		}
+	}
+}
+
+// Close closes all subscriber channels, later subscribers get a closed channel
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, sub := range b.subs {
+		delete(b.subs, ch)
+		close(sub)
+	}
+	b.closed = true
+}
@@ -0,0 +1,112 @@
+package dhcp4d
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/macs"
+	"github.com/krolaw/dhcp4"
+)
+
+const UnknownDevice = "unknown"
+
+// Fingerprint describes a dhcp client by the options it sends
+type Fingerprint struct {
+	ParamRequestList string `json:"param_request_list,omitempty"` // Option 55 as comma separated codes
+	VendorClass      string `json:"vendor_class,omitempty"`       // Option 60
+	ClientID         string `json:"client_id,omitempty"`          // Option 61 hex encoded
+	Vendor           string `json:"vendor,omitempty"`             // Organization owning the mac OUI
+	Class            string `json:"class,omitempty"`              // Device class matched in fingerprint database
+}
+
+// FingerprintRule classifies devices matching any of its fields
+type FingerprintRule struct {
+	Class             string   `json:"class"`
+	VendorClasses     []string `json:"vendor_classes"`      // Option 60 prefixes
+	ParamRequestLists []string `json:"param_request_lists"` // Exact option 55 lists
+	Vendors           []string `json:"vendors"`             // Substrings of OUI organization
+}
+
+//go:embed fingerprints.json
+var bundledFingerprints []byte
+
+// Fingerprints is the database used by Classify, loaded from bundled fingerprints.json
+var Fingerprints = mustParseFingerprints(bundledFingerprints)
+
+func mustParseFingerprints(content []byte) []FingerprintRule {
+	rules, err := ParseFingerprints(content)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// ParseFingerprints parses a json fingerprint database
+func ParseFingerprints(content []byte) ([]FingerprintRule, error) {
+	var rules []FingerprintRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// NewFingerprint records identifying options of a client and classifies it
+func NewFingerprint(mac net.HardwareAddr, options dhcp4.Options) Fingerprint {
+	fp := Fingerprint{
+		VendorClass: string(options[dhcp4.OptionVendorClassIdentifier]),
+		ClientID:    hex.EncodeToString(options[dhcp4.OptionClientIdentifier]),
+		Vendor:      OUIVendor(mac),
+	}
+	if prl := options[dhcp4.OptionParameterRequestList]; len(prl) != 0 {
+		codes := make([]string, len(prl))
+		for i, code := range prl {
+			codes[i] = strconv.Itoa(int(code))
+		}
+		fp.ParamRequestList = strings.Join(codes, ",")
+	}
+	fp.Class = Classify(fp, Fingerprints)
+	return fp
+}
+
+// OUIVendor returns organization owning the OUI of mac, empty for unknown or locally administered addresses
+func OUIVendor(mac net.HardwareAddr) string {
+	if len(mac) < 3 || mac[0]&0x02 != 0 {
+		return ""
+	}
+	return macs.ValidMACPrefixMap[[3]byte{mac[0], mac[1], mac[2]}]
+}
+
+// Classify returns class of the rule matching fp best
+// an option 55 match weighs more than vendor class which weighs more than OUI
+func Classify(fp Fingerprint, rules []FingerprintRule) string {
+	class, best := UnknownDevice, 0
+	for _, rule := range rules {
+		score := 0
+		for _, prl := range rule.ParamRequestLists {
+			if len(fp.ParamRequestList) != 0 && prl == fp.ParamRequestList {
+				score += 4
+				break
+			}
+		}
+		for _, vc := range rule.VendorClasses {
+			if len(fp.VendorClass) != 0 && strings.HasPrefix(strings.ToLower(fp.VendorClass), strings.ToLower(vc)) {
+				score += 3
+				break
+			}
+		}
+		for _, vendor := range rule.Vendors {
+			if len(fp.Vendor) != 0 && strings.Contains(strings.ToLower(fp.Vendor), strings.ToLower(vendor)) {
+				score++
+				break
+			}
+		}
+		if score > best {
+			class, best = rule.Class, score
+		}
+	}
+	return class
+}
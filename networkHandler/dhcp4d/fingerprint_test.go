@@ -0,0 +1,58 @@
+package dhcp4d
+
+import (
+	"net"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestNewFingerprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		mac     string
+		options dhcp4.Options
+		want    string
+	}{
+		{"android", "02:00:00:00:00:01", dhcp4.Options{
+			dhcp4.OptionVendorClassIdentifier: []byte("android-dhcp-11"),
+			dhcp4.OptionParameterRequestList:  []byte{1, 3, 6, 15, 26, 28, 51, 58, 59, 43},
+		}, "Android phone"},
+		{"iphone", "02:00:00:00:00:02", dhcp4.Options{
+			dhcp4.OptionParameterRequestList: []byte{1, 121, 3, 6, 15, 108, 114, 119, 252},
+		}, "iOS device"},
+		{"windows", "02:00:00:00:00:03", dhcp4.Options{
+			dhcp4.OptionVendorClassIdentifier: []byte("MSFT 5.0"),
+			dhcp4.OptionParameterRequestList:  []byte{1, 3, 6, 15, 31, 33, 43, 44, 46, 47, 119, 121, 249, 252},
+		}, "Windows laptop"},
+		{"printer", "02:00:00:00:00:04", dhcp4.Options{
+			dhcp4.OptionVendorClassIdentifier: []byte("Hewlett-Packard JetDirect"),
+		}, "Printer"},
+		{"esp by oui", "24:0a:c4:00:00:05", dhcp4.Options{}, "IoT device"},
+		{"nothing known", "02:00:00:00:00:06", dhcp4.Options{
+			dhcp4.OptionParameterRequestList: []byte{1, 2, 3},
+		}, UnknownDevice},
+	}
+	for _, tst := range tests {
+		mac, _ := net.ParseMAC(tst.mac)
+		if fp := NewFingerprint(mac, tst.options); fp.Class != tst.want {
+			t.Errorf("%s: NewFingerprint()=%+v, want class %s", tst.name, fp, tst.want)
+		}
+	}
+}
+
+func TestOUIVendor(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{"00:00:00:00:00:01", "XEROX CORPORATION"},
+		{"02:00:00:00:00:01", ""}, // Locally administered
+	}
+	for _, tst := range tests {
+		mac, _ := net.ParseMAC(tst.mac)
+		if got := OUIVendor(mac); got != tst.want {
+			t.Errorf("OUIVendor(%s)=%q, want %q", tst.mac, got, tst.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package dhcp4d
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LeaseStore keeps leases across dhcp server restarts
+type LeaseStore interface {
+	// Load returns all leases kept by the store
+	Load() ([]Lease, error)
+	// Put adds or replaces the lease of lease.Nic
+	Put(lease Lease) error
+	// Delete removes the lease of given client hardware address
+	Delete(nic string) error
+}
+
+// FileLeaseStore is a LeaseStore which keeps leases as json in a file
+type FileLeaseStore struct {
+	Path   string
+	mu     sync.Mutex
+	leases map[string]Lease
+}
+
+// NewFileLeaseStore returns a FileLeaseStore backed by path and reads leases already in it
+// the file and its directory will be created on first write if they don't exist
+func NewFileLeaseStore(path string) (*FileLeaseStore, error) {
+	if len(path) == 0 {
+		return nil, errors.New("lease file path is empty")
+	}
+	store := &FileLeaseStore{
+		Path:   path,
+		leases: make(map[string]Lease),
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return store, nil
+	}
+	var leases []Lease
+	if err := json.Unmarshal(content, &leases); err != nil {
+		return nil, err
+	}
+	for _, l := range leases {
+		store.leases[l.Nic] = l
+	}
+	return store, nil
+}
+
+func (s *FileLeaseStore) Load() ([]Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	leases := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+func (s *FileLeaseStore) Put(lease Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases[lease.Nic] = lease
+	return s.write()
+}
+
+func (s *FileLeaseStore) Delete(nic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.leases[nic]; !ok {
+		return nil
+	}
+	delete(s.leases, nic)
+	return s.write()
+}
+
+// write replaces lease file content atomically, callers must hold s.mu
+func (s *FileLeaseStore) write() error {
+	leases := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	content, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	tmpPath := s.Path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.Path)
+}
@@ -0,0 +1,85 @@
+package dhcp4d
+
+import (
+	"github.com/krolaw/dhcp4"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLeaseStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases", "dhcp4.leases")
+	store, err := NewFileLeaseStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLeaseStore(%s) error: %v", path, err)
+	}
+
+	leases := []Lease{
+		{Nic: "aa:bb:cc:dd:ee:01", ReqIP: net.IP{192, 168, 100, 10}, HostName: "laptop", Expiry: time.Now().Add(time.Hour)},
+		{Nic: "aa:bb:cc:dd:ee:02", ReqIP: net.IP{192, 168, 100, 11}, HostName: "phone", Expiry: time.Now().Add(time.Hour)},
+	}
+	for _, l := range leases {
+		if err := store.Put(l); err != nil {
+			t.Fatalf("Put(%s) error: %v", l.Nic, err)
+		}
+	}
+	if err := store.Delete("aa:bb:cc:dd:ee:02"); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+
+	reopened, err := NewFileLeaseStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLeaseStore(%s) error: %v", path, err)
+	}
+	got, _ := reopened.Load()
+	if len(got) != 1 {
+		t.Fatalf("Load() returned %d leases, want 1", len(got))
+	}
+	if got[0].Nic != leases[0].Nic || !got[0].ReqIP.Equal(leases[0].ReqIP) || got[0].HostName != leases[0].HostName {
+		t.Errorf("Load()=%+v, want %+v", got[0], leases[0])
+	}
+}
+
+func TestDHCPHandler_LoadLeases(t *testing.T) {
+	store, err := NewFileLeaseStore(filepath.Join(t.TempDir(), "dhcp4.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		lease Lease
+		want  bool
+	}{
+		{Lease{Nic: "aa:bb:cc:dd:ee:01", ReqIP: net.IP{192, 168, 100, 2}, Expiry: time.Now().Add(time.Hour)}, true},
+		{Lease{Nic: "aa:bb:cc:dd:ee:02", ReqIP: net.IP{192, 168, 100, 3}, Expiry: time.Now().Add(-time.Hour)}, false},
+		{Lease{Nic: "aa:bb:cc:dd:ee:03", ReqIP: net.IP{10, 0, 0, 3}, Expiry: time.Now().Add(time.Hour)}, false},
+	}
+	for _, tst := range tests {
+		store.Put(tst.lease)
+	}
+
+	handler := &DHCPHandler{
+		Start:      net.IP{192, 168, 100, 1},
+		LeaseRange: 253,
+		Leases:     make(map[int]Lease),
+		Store:      store,
+	}
+	if err := handler.LoadLeases(); err != nil {
+		t.Fatalf("LoadLeases() error: %v", err)
+	}
+
+	stored, _ := store.Load()
+	for _, tst := range tests {
+		_, loaded := handler.Leases[dhcp4.IPRange(handler.Start, tst.lease.ReqIP)-1]
+		if loaded != tst.want {
+			t.Errorf("LoadLeases() loaded %s=%v, want %v", tst.lease.Nic, loaded, tst.want)
+		}
+		kept := false
+		for _, l := range stored {
+			kept = kept || l.Nic == tst.lease.Nic
+		}
+		if kept != tst.want {
+			t.Errorf("LoadLeases() kept %s in store=%v, want %v", tst.lease.Nic, kept, tst.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package dhcp4d
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/krolaw/dhcp4"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// OptionWPAD is the web proxy auto discovery url option, not defined by dhcp4
+const OptionWPAD dhcp4.OptionCode = 252
+
+// maxOptionLen is the longest value a single dhcp option can carry
+const maxOptionLen = 255
+
+// Route is a classless static route sent with OptionClasslessRouteFormat
+type Route struct {
+	Destination net.IPNet
+	Gateway     net.IP
+}
+
+// ParseRoute parses "destination/prefix=gateway" into a Route
+func ParseRoute(route string) (Route, error) {
+	parts := strings.Split(route, "=")
+	if len(parts) != 2 {
+		return Route{}, fmt.Errorf("invalid route %q, want destination/prefix=gateway", route)
+	}
+	_, dest, err := net.ParseCIDR(strings.TrimSpace(parts[0]))
+	if err != nil || dest.IP.To4() == nil {
+		return Route{}, fmt.Errorf("invalid route destination %q", parts[0])
+	}
+	gw := net.ParseIP(strings.TrimSpace(parts[1])).To4()
+	if gw == nil {
+		return Route{}, fmt.Errorf("invalid route gateway %q", parts[1])
+	}
+	return Route{Destination: *dest, Gateway: gw}, nil
+}
+
+// EncodeClasslessRoutes encodes routes as RFC 3442 option 121 value
+// clients receiving option 121 ignore the router option, so the default route should be part of routes
+func EncodeClasslessRoutes(routes []Route) ([]byte, error) {
+	var b []byte
+	for _, r := range routes {
+		ones, bits := r.Destination.Mask.Size()
+		dest := r.Destination.IP.To4()
+		if bits != 32 || dest == nil || r.Gateway.To4() == nil {
+			return nil, fmt.Errorf("route %v via %v is not ipv4", r.Destination.String(), r.Gateway)
+		}
+		significant := (ones + 7) / 8
+		b = append(b, byte(ones))
+		b = append(b, dest[:significant]...)
+		b = append(b, r.Gateway.To4()...)
+	}
+	if len(b) > maxOptionLen {
+		return nil, errors.New("classless routes don't fit in one dhcp option")
+	}
+	return b, nil
+}
+
+// EncodeDomainSearch encodes domains as RFC 3397 option 119 value using name compression
+func EncodeDomainSearch(domains []string) ([]byte, error) {
+	var b []byte
+	offsets := make(map[string]int) // Encoded name suffixes and their offset in b
+	for _, domain := range domains {
+		labels := strings.Split(strings.Trim(domain, "."), ".")
+		for i := 0; i <= len(labels); i++ {
+			if i == len(labels) {
+				b = append(b, 0)
+				break
+			}
+			suffix := strings.ToLower(strings.Join(labels[i:], "."))
+			if offset, ok := offsets[suffix]; ok {
+				b = append(b, byte(0xc0|offset>>8), byte(offset))
+				break
+			}
+			label := labels[i]
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid search domain %q", domain)
+			}
+			if len(b) < 0x3fff {
+				offsets[suffix] = len(b)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	if len(b) > maxOptionLen {
+		return nil, errors.New("search domains don't fit in one dhcp option")
+	}
+	return b, nil
+}
+
+// EncodeIPs encodes ipv4 addresses as a list option value such as NTP servers
+func EncodeIPs(ips []net.IP) ([]byte, error) {
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("%v is not an ipv4 address", ip)
+		}
+	}
+	return dhcp4.JoinIPs(ips), nil
+}
+
+// EncodeMTU encodes interface mtu as option 26 value
+func EncodeMTU(mtu int) ([]byte, error) {
+	if mtu < 68 || mtu > 65535 {
+		return nil, fmt.Errorf("invalid interface mtu %d", mtu)
+	}
+	return []byte{byte(mtu >> 8), byte(mtu)}, nil
+}
+
+// ParseRawOption parses "code=value" into an option
+// value is hex when prefixed with 0x, a list of ipv4 addresses when it only contains
+// comma separated addresses and a string otherwise
+func ParseRawOption(option string) (dhcp4.OptionCode, []byte, error) {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 {
+		return 0, nil, fmt.Errorf("invalid dhcp option %q, want code=value", option)
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || code <= int(dhcp4.Pad) || code >= int(dhcp4.End) {
+		return 0, nil, fmt.Errorf("invalid dhcp option code %q", parts[0])
+	}
+	value := parts[1]
+	if strings.HasPrefix(value, "0x") {
+		b, err := hex.DecodeString(value[2:])
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid hex value of dhcp option %d: %v", code, err)
+		}
+		value = string(b)
+	} else if ips, ok := parseIPList(value); ok {
+		value = string(dhcp4.JoinIPs(ips))
+	}
+	if len(value) > maxOptionLen {
+		return 0, nil, fmt.Errorf("value of dhcp option %d is too long", code)
+	}
+	return dhcp4.OptionCode(code), []byte(value), nil
+}
+
+func parseIPList(list string) ([]net.IP, bool) {
+	var ips []net.IP
+	for _, field := range strings.Split(list, ",") {
+		ip := net.ParseIP(strings.TrimSpace(field)).To4()
+		if ip == nil {
+			return nil, false
+		}
+		ips = append(ips, ip)
+	}
+	return ips, true
+}
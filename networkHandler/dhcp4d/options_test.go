@@ -0,0 +1,96 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+)
+
+func TestEncodeClasslessRoutes(t *testing.T) {
+	tests := []struct {
+		routes []string
+		want   []byte
+	}{
+		{[]string{"0.0.0.0/0=192.168.100.1"}, []byte{0, 192, 168, 100, 1}},
+		{[]string{"10.0.0.0/8=192.168.100.254"}, []byte{8, 10, 192, 168, 100, 254}},
+		{[]string{"10.17.0.0/20=192.168.100.254", "192.168.1.7/32=192.168.100.2"},
+			[]byte{20, 10, 17, 0, 192, 168, 100, 254, 32, 192, 168, 1, 7, 192, 168, 100, 2}},
+	}
+	for _, tst := range tests {
+		var routes []Route
+		for _, r := range tst.routes {
+			route, err := ParseRoute(r)
+			if err != nil {
+				t.Fatalf("ParseRoute(%s) error: %v", r, err)
+			}
+			routes = append(routes, route)
+		}
+		if got, err := EncodeClasslessRoutes(routes); err != nil || !bytes.Equal(got, tst.want) {
+			t.Errorf("EncodeClasslessRoutes(%v)=%v,%v want %v", tst.routes, got, err, tst.want)
+		}
+	}
+	if _, err := ParseRoute("10.0.0.0/8"); err == nil {
+		t.Errorf("ParseRoute() without gateway succeeded")
+	}
+}
+
+func TestEncodeDomainSearch(t *testing.T) {
+	// RFC 3397 section 2 example
+	got, err := EncodeDomainSearch([]string{"eng.apple.com.", "marketing.apple.com."})
+	if err != nil {
+		t.Fatalf("EncodeDomainSearch() error: %v", err)
+	}
+	want := []byte{
+		3, 'e', 'n', 'g', 5, 'a', 'p', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		9, 'm', 'a', 'r', 'k', 'e', 't', 'i', 'n', 'g', 0xc0, 4,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("EncodeDomainSearch()=%v want %v", got, want)
+	}
+	if _, err := EncodeDomainSearch([]string{"bad..domain"}); err == nil {
+		t.Errorf("EncodeDomainSearch() with empty label succeeded")
+	}
+}
+
+func TestEncodeMTU(t *testing.T) {
+	if got, err := EncodeMTU(1500); err != nil || !bytes.Equal(got, []byte{0x05, 0xdc}) {
+		t.Errorf("EncodeMTU(1500)=%v,%v", got, err)
+	}
+	if _, err := EncodeMTU(60); err == nil {
+		t.Errorf("EncodeMTU(60) succeeded")
+	}
+}
+
+func TestEncodeIPs(t *testing.T) {
+	if got, err := EncodeIPs([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}); err != nil ||
+		!bytes.Equal(got, []byte{10, 0, 0, 1, 10, 0, 0, 2}) {
+		t.Errorf("EncodeIPs()=%v,%v", got, err)
+	}
+	if _, err := EncodeIPs([]net.IP{net.ParseIP("fe80::1")}); err == nil {
+		t.Errorf("EncodeIPs() of ipv6 address succeeded")
+	}
+}
+
+func TestParseRawOption(t *testing.T) {
+	tests := []struct {
+		option   string
+		wantCode dhcp4.OptionCode
+		want     []byte
+		wantErr  bool
+	}{
+		{"66=tftp.lan", 66, []byte("tftp.lan"), false},
+		{"150=10.0.0.1,10.0.0.2", 150, []byte{10, 0, 0, 1, 10, 0, 0, 2}, false},
+		{"43=0x0104c0a80001", 43, []byte{1, 4, 192, 168, 0, 1}, false},
+		{"43=0xzz", 0, nil, true},
+		{"0=pad", 0, nil, true},
+		{"300=x", 0, nil, true},
+		{"66", 0, nil, true},
+	}
+	for _, tst := range tests {
+		code, value, err := ParseRawOption(tst.option)
+		if (err != nil) != tst.wantErr || code != tst.wantCode || !bytes.Equal(value, tst.want) {
+			t.Errorf("ParseRawOption(%s)=%v,%v,%v", tst.option, code, value, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package dhcp4d
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Packetify/packetify/networkHandler/tc"
+	"github.com/krolaw/dhcp4"
+)
+
+// Pool is a part of the handler range given to clients matching it
+// a pool without MACs, VendorClasses and Classes is the default pool of unmatched clients
+type Pool struct {
+	Name          string
+	Start         net.IP
+	End           net.IP
+	LeaseDuration time.Duration // Overrides handler lease duration when set
+	MACs          []string      // Allowed client mac addresses
+	VendorClasses []string      // Option 60 prefixes
+	Classes       []string      // Fingerprint classes
+	Limit         tc.Limit      // Default rate limit of clients without one of their own
+}
+
+// poolConfig is the json form of Pool
+type poolConfig struct {
+	Name          string   `json:"name"`
+	Start         string   `json:"start"`
+	End           string   `json:"end"`
+	LeaseTime     string   `json:"lease_time"`
+	MACs          []string `json:"macs"`
+	VendorClasses []string `json:"vendor_classes"`
+	Classes       []string `json:"classes"`
+	Down          string   `json:"down"`  // tc rate like 5mbit
+	Up            string   `json:"up"`    // tc rate like 1mbit
+	Burst         string   `json:"burst"` // tc size like 32kb
+}
+
+// LoadPools reads pools from a json file
+func LoadPools(path string) ([]*Pool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []poolConfig
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pools := make([]*Pool, 0, len(configs))
+	for _, c := range configs {
+		pool := &Pool{
+			Name:          c.Name,
+			Start:         net.ParseIP(c.Start).To4(),
+			End:           net.ParseIP(c.End).To4(),
+			VendorClasses: c.VendorClasses,
+			Classes:       c.Classes,
+		}
+		if pool.Start == nil || pool.End == nil || dhcp4.IPLess(pool.End, pool.Start) {
+			return nil, fmt.Errorf("%s: pool %q has invalid range %s-%s", path, c.Name, c.Start, c.End)
+		}
+		if len(c.LeaseTime) != 0 {
+			if pool.LeaseDuration, err = time.ParseDuration(c.LeaseTime); err != nil {
+				return nil, fmt.Errorf("%s: pool %q: %v", path, c.Name, err)
+			}
+		}
+		if pool.Limit, err = tc.ParseLimit(c.Down, c.Up, c.Burst); err != nil {
+			return nil, fmt.Errorf("%s: pool %q: %v", path, c.Name, err)
+		}
+		for _, mac := range c.MACs {
+			hwAddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return nil, fmt.Errorf("%s: pool %q: %v", path, c.Name, err)
+			}
+			pool.MACs = append(pool.MACs, hwAddr.String())
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// Size returns number of addresses in pool
+func (p *Pool) Size() int {
+	return dhcp4.IPRange(p.Start, p.End)
+}
+
+// Contains reports whether ip is in pool range
+func (p *Pool) Contains(ip net.IP) bool {
+	return ip.To4() != nil && dhcp4.IPInRange(p.Start, p.End, ip)
+}
+
+func (p *Pool) isDefault() bool {
+	return len(p.MACs) == 0 && len(p.VendorClasses) == 0 && len(p.Classes) == 0
+}
+
+// Matches reports whether client with mac and fingerprint belongs to pool
+func (p *Pool) Matches(mac string, fp Fingerprint) bool {
+	for _, m := range p.MACs {
+		if m == mac {
+			return true
+		}
+	}
+	for _, vc := range p.VendorClasses {
+		if len(fp.VendorClass) != 0 && strings.HasPrefix(strings.ToLower(fp.VendorClass), strings.ToLower(vc)) {
+			return true
+		}
+	}
+	for _, class := range p.Classes {
+		if strings.EqualFold(class, fp.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddPool adds pool to handler, pool should be inside handler range and not overlap other pools
+func (h *DHCPHandler) AddPool(pool *Pool) error {
+	first := dhcp4.IPRange(h.Start, pool.Start) - 1
+	if pool.Start.To4() == nil || pool.End.To4() == nil || first < 0 || first+pool.Size() > h.LeaseRange {
+		return fmt.Errorf("pool %q %v-%v is out of dhcp range", pool.Name, pool.Start, pool.End)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, other := range h.Pools {
+		if other.Contains(pool.Start) || other.Contains(pool.End) || pool.Contains(other.Start) {
+			return fmt.Errorf("pool %q overlaps pool %q", pool.Name, other.Name)
+		}
+	}
+	h.Pools = append(h.Pools, pool)
+	return nil
+}
+
+// selectPool returns pool of the client, nil without pools or when no pool takes the client
+// callers must hold h.mu
+func (h *DHCPHandler) selectPool(mac string, fp Fingerprint) (*Pool, bool) {
+	if len(h.Pools) == 0 {
+		return nil, true
+	}
+	var fallback *Pool
+	for _, pool := range h.Pools {
+		if pool.Matches(mac, fp) {
+			return pool, true
+		}
+		if fallback == nil && pool.isDefault() {
+			fallback = pool
+		}
+	}
+	return fallback, fallback != nil
+}
+
+// poolBounds returns first lease number and number of leases of pool, whole range for nil pool
+func (h *DHCPHandler) poolBounds(pool *Pool) (int, int) {
+	if pool == nil {
+		return 0, h.LeaseRange
+	}
+	return dhcp4.IPRange(h.Start, pool.Start) - 1, pool.Size()
+}
+
+// poolContains reports whether lease number is in pool, any lease is in nil pool
+func (h *DHCPHandler) poolContains(pool *Pool, leaseNum int) bool {
+	first, size := h.poolBounds(pool)
+	return leaseNum >= first && leaseNum < first+size
+}
+
+// leaseDuration returns lease duration of pool
+func (h *DHCPHandler) leaseDuration(pool *Pool) time.Duration {
+	if pool != nil && pool.LeaseDuration > 0 {
+		return pool.LeaseDuration
+	}
+	return h.LeaseDuration
+}
+
+// poolName returns name of pool, empty for nil pool
+func poolName(pool *Pool) string {
+	if pool == nil {
+		return ""
+	}
+	return pool.Name
+}
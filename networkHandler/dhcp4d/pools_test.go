@@ -0,0 +1,149 @@
+package dhcp4d
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestLoadPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pools.json")
+	content := `[
+		{"name": "guests", "start": "192.168.100.10", "end": "192.168.100.19", "down": "5mbit", "up": "1mbit"},
+		{"name": "iot", "start": "192.168.100.20", "end": "192.168.100.29", "lease_time": "10m",
+		 "macs": ["AA:BB:CC:00:00:01"], "classes": ["IoT device"]}
+	]`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pools, err := LoadPools(path)
+	if err != nil {
+		t.Fatalf("LoadPools()=%v", err)
+	}
+	if len(pools) != 2 || pools[0].Size() != 10 || !pools[0].isDefault() {
+		t.Fatalf("LoadPools()=%v, want default pool of 10 addresses first", pools)
+	}
+	if guests := pools[0]; guests.Limit.Down != 5e6 || guests.Limit.Up != 1e6 || !pools[1].Limit.IsZero() {
+		t.Errorf("LoadPools() limits=%v, %v", guests.Limit, pools[1].Limit)
+	}
+	if iot := pools[1]; iot.LeaseDuration != 10*time.Minute || iot.MACs[0] != "aa:bb:cc:00:00:01" {
+		t.Errorf("LoadPools() iot pool=%+v", iot)
+	}
+
+	for _, bad := range []string{
+		`[{"name": "a", "start": "192.168.100.20", "end": "192.168.100.10"}]`,
+		`[{"name": "a", "start": "192.168.100.10", "end": "192.168.100.20", "lease_time": "1 day"}]`,
+		`[{"name": "a", "start": "192.168.100.10", "end": "192.168.100.20", "macs": ["nope"]}]`,
+		`[{"name": "a", "start": "192.168.100.10", "end": "192.168.100.20", "down": "fast"}]`,
+		`{"name": "a"}`,
+	} {
+		ioutil.WriteFile(path, []byte(bad), 0644)
+		if _, err := LoadPools(path); err == nil {
+			t.Errorf("LoadPools(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestDHCPHandler_AddPool(t *testing.T) {
+	handler := newTestHandler(10) // 192.168.100.2-11
+	tests := []struct {
+		start, end net.IP
+		ok         bool
+	}{
+		{net.IP{192, 168, 100, 2}, net.IP{192, 168, 100, 5}, true},
+		{net.IP{192, 168, 100, 6}, net.IP{192, 168, 100, 11}, true},
+		{net.IP{192, 168, 100, 5}, net.IP{192, 168, 100, 6}, false},
+		{net.IP{192, 168, 100, 10}, net.IP{192, 168, 100, 12}, false},
+		{net.IP{192, 168, 100, 1}, net.IP{192, 168, 100, 1}, false},
+	}
+	for _, tt := range tests {
+		if err := handler.AddPool(&Pool{Start: tt.start, End: tt.end}); (err == nil) != tt.ok {
+			t.Errorf("AddPool(%v-%v)=%v", tt.start, tt.end, err)
+		}
+	}
+}
+
+func TestDHCPHandler_PoolSelection(t *testing.T) {
+	handler := newTestHandler(30) // 192.168.100.2-31
+	guests := &Pool{Name: "guests", Start: net.IP{192, 168, 100, 2}, End: net.IP{192, 168, 100, 11}}
+	trusted := &Pool{Name: "trusted", Start: net.IP{192, 168, 100, 12}, End: net.IP{192, 168, 100, 21},
+		MACs: []string{testMAC(1).String()}}
+	quarantine := &Pool{Name: "quarantine", Start: net.IP{192, 168, 100, 22}, End: net.IP{192, 168, 100, 22},
+		LeaseDuration: time.Minute, VendorClasses: []string{"udhcp"}}
+	for _, pool := range []*Pool{guests, trusted, quarantine} {
+		if err := handler.AddPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		mac         net.HardwareAddr
+		vendorClass string
+		pool        *Pool
+	}{
+		{testMAC(1), "", trusted},
+		{testMAC(2), "", guests},
+		{testMAC(3), "udhcp 1.30.1", quarantine},
+	}
+	for _, tt := range tests {
+		mt, offered := servePool(handler, dhcp4.Discover, tt.mac, tt.vendorClass, nil)
+		if mt != dhcp4.Offer || !tt.pool.Contains(offered) {
+			t.Errorf("Discover(%v, %q)=%v %v, want Offer in pool %s", tt.mac, tt.vendorClass, mt, offered, tt.pool.Name)
+			continue
+		}
+		if mt, _ := servePool(handler, dhcp4.Request, tt.mac, tt.vendorClass, offered); mt != dhcp4.ACK {
+			t.Errorf("Request(%v, %v)=%v, want ACK", tt.mac, offered, mt)
+		}
+	}
+
+	handler.mu.Lock()
+	for _, l := range handler.Leases {
+		if l.Pool == quarantine.Name && l.Expiry.After(time.Now().Add(quarantine.LeaseDuration)) {
+			t.Errorf("lease of quarantine pool expires at %v, want pool lease time", l.Expiry)
+		}
+	}
+	handler.mu.Unlock()
+
+	if mt, _ := servePool(handler, dhcp4.Request, testMAC(2), "", net.IP{192, 168, 100, 15}); mt != dhcp4.NAK {
+		t.Errorf("Request() of trusted address by guest=%v, want NAK", mt)
+	}
+	if mt, _ := servePool(handler, dhcp4.Discover, testMAC(4), "udhcp", nil); mt != 0 {
+		t.Errorf("Discover() with full quarantine pool=%v, want no reply", mt)
+	}
+}
+
+func TestDHCPHandler_NoDefaultPool(t *testing.T) {
+	handler := newTestHandler(10)
+	handler.AddPool(&Pool{Name: "trusted", Start: net.IP{192, 168, 100, 2}, End: net.IP{192, 168, 100, 5},
+		MACs: []string{testMAC(1).String()}})
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(2), nil); mt != 0 {
+		t.Errorf("Discover() of client without pool=%v, want no reply", mt)
+	}
+}
+
+// servePool is serve with a vendor class option
+func servePool(h *DHCPHandler, mt dhcp4.MessageType, mac net.HardwareAddr, vendorClass string, reqIP net.IP) (dhcp4.MessageType, net.IP) {
+	var options []dhcp4.Option
+	if reqIP != nil {
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: reqIP.To4()})
+	}
+	if len(vendorClass) != 0 {
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte(vendorClass)})
+	}
+	req := dhcp4.RequestPacket(mt, mac, nil, []byte{1, 2, 3, 4}, false, options)
+	reply := h.ServeDHCP(req, mt, req.ParseOptions())
+	if reply == nil {
+		return 0, nil
+	}
+	return dhcp4.MessageType(reply.ParseOptions()[dhcp4.OptionDHCPMessageType][0]), reply.YIAddr()
+}
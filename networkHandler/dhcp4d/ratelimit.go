@@ -0,0 +1,156 @@
+package dhcp4d
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+type AlertKind int
+
+const (
+	RateExceeded    AlertKind = iota // Too many messages on the interface
+	MACFlood                         // Too many messages of one mac
+	MACSpray                         // Too many new macs, typical for starvation tools
+	OffersExhausted                  // Too many offers without a request
+)
+
+func (k AlertKind) String() string {
+	switch k {
+	case RateExceeded:
+		return "dhcp rate exceeded"
+	case MACFlood:
+		return "dhcp mac flood"
+	case MACSpray:
+		return "dhcp mac spray"
+	case OffersExhausted:
+		return "dhcp offers exhausted"
+	}
+	return "unknown"
+}
+
+// Alert describes a detected flood or starvation attempt
+type Alert struct {
+	Kind  AlertKind
+	MAC   net.HardwareAddr // Client of MACFlood alerts
+	Count int              // Messages, macs or offers counted in the window
+	Time  time.Time
+	Until time.Time // When the limiter stops ignoring the client or new clients
+}
+
+// RateLimiter protects the lease range from clients asking for addresses too fast
+// every limit counts in fixed windows of Window, zero limits are disabled
+type RateLimiter struct {
+	Window        time.Duration
+	Rate          int           // Messages of clients without lease allowed on the interface per window
+	MACRate       int           // Messages allowed per mac per window
+	SprayMACs     int           // New macs without lease allowed per window
+	MaxOffers     int           // Outstanding offers of new addresses
+	OfferTimeout  time.Duration // How long an offer is outstanding without a request
+	BlockDuration time.Duration // How long flooding macs are ignored
+	OnAlert       func(Alert)   // Optional, called in its own goroutine for every alert
+
+	mu          sync.Mutex
+	windowStart time.Time
+	total       int
+	perMAC      map[string]int
+	newMACs     int
+	sprayUntil  time.Time
+	blocked     map[string]time.Time
+	offers      map[string]time.Time // Expiry of outstanding offers by mac
+}
+
+// Allow reports whether a message of mac should be served, known tells whether mac has a lease or reservation
+func (l *RateLimiter) Allow(mac net.HardwareAddr, msgType dhcp4.MessageType, known bool, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nic := mac.String()
+	if until, ok := l.blocked[nic]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(l.blocked, nic)
+	}
+	if l.windowStart.IsZero() || now.Sub(l.windowStart) >= l.Window {
+		l.windowStart, l.total, l.newMACs = now, 0, 0
+		l.perMAC = make(map[string]int)
+	}
+
+	if !known { // Renewals of leased and reserved clients go on during floods of new macs
+		l.total++
+		if l.Rate > 0 && l.total > l.Rate {
+			if l.total == l.Rate+1 {
+				l.alert(Alert{Kind: RateExceeded, Count: l.total, Time: now, Until: l.windowStart.Add(l.Window)})
+			}
+			return false
+		}
+	}
+
+	l.perMAC[nic]++
+	if count := l.perMAC[nic]; l.MACRate > 0 && count > l.MACRate {
+		if l.blocked == nil {
+			l.blocked = make(map[string]time.Time)
+		}
+		l.blocked[nic] = now.Add(l.BlockDuration)
+		l.alert(Alert{Kind: MACFlood, MAC: mac, Count: count, Time: now, Until: l.blocked[nic]})
+		return false
+	}
+
+	if known || msgType != dhcp4.Discover || l.perMAC[nic] > 1 {
+		return true
+	}
+	if now.Before(l.sprayUntil) {
+		return false // New clients wait until the spray is over
+	}
+	l.newMACs++
+	if l.SprayMACs > 0 && l.newMACs > l.SprayMACs {
+		l.sprayUntil = l.windowStart.Add(l.Window)
+		l.alert(Alert{Kind: MACSpray, Count: l.newMACs, Time: now, Until: l.sprayUntil})
+		return false
+	}
+	return true
+}
+
+// Offer reports whether a new address may be offered to mac and counts the offer as outstanding
+func (l *RateLimiter) Offer(mac net.HardwareAddr, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nic := mac.String()
+	if l.offers == nil {
+		l.offers = make(map[string]time.Time)
+	}
+	for m, expiry := range l.offers {
+		if !expiry.After(now) {
+			delete(l.offers, m)
+		}
+	}
+	if _, ok := l.offers[nic]; !ok && l.MaxOffers > 0 && len(l.offers) >= l.MaxOffers {
+		l.alert(Alert{Kind: OffersExhausted, MAC: mac, Count: len(l.offers), Time: now, Until: now.Add(l.OfferTimeout)})
+		return false
+	}
+	l.offers[nic] = now.Add(l.OfferTimeout)
+	return true
+}
+
+// Accepted stops counting the offer of mac as outstanding
+func (l *RateLimiter) Accepted(mac net.HardwareAddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.offers, mac.String())
+}
+
+// alert logs a and hands it to OnAlert, callers must hold l.mu
+func (l *RateLimiter) alert(a Alert) {
+	if a.MAC != nil {
+		a.MAC = append(net.HardwareAddr(nil), a.MAC...)
+		log.Println(a.Kind, a.MAC, a.Count, "until", a.Until.Format(time.RFC3339))
+	} else {
+		log.Println(a.Kind, a.Count, "until", a.Until.Format(time.RFC3339))
+	}
+	if l.OnAlert != nil {
+		go l.OnAlert(a)
+	}
+}
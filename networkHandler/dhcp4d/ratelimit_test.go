@@ -0,0 +1,120 @@
+package dhcp4d
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestRateLimiter_MACFlood(t *testing.T) {
+	alerts := make(chan Alert, 10)
+	limiter := &RateLimiter{Window: time.Minute, MACRate: 3, BlockDuration: time.Hour, OnAlert: func(a Alert) { alerts <- a }}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(testMAC(1), dhcp4.Discover, false, now) {
+			t.Fatalf("Allow() message %d denied", i)
+		}
+	}
+	if limiter.Allow(testMAC(1), dhcp4.Discover, false, now) {
+		t.Errorf("Allow() over mac rate allowed")
+	}
+	if !limiter.Allow(testMAC(2), dhcp4.Discover, false, now) {
+		t.Errorf("Allow() of other mac denied")
+	}
+	if limiter.Allow(testMAC(1), dhcp4.Request, true, now.Add(2*time.Minute)) {
+		t.Errorf("Allow() of blocked mac in next window allowed")
+	}
+	if !limiter.Allow(testMAC(1), dhcp4.Request, true, now.Add(2*time.Hour)) {
+		t.Errorf("Allow() after block denied")
+	}
+	select {
+	case a := <-alerts:
+		if a.Kind != MACFlood || a.MAC.String() != testMAC(1).String() {
+			t.Errorf("OnAlert(%+v), want mac flood of %v", a, testMAC(1))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no alert of mac flood")
+	}
+}
+
+func TestRateLimiter_Spray(t *testing.T) {
+	limiter := &RateLimiter{Window: time.Minute, SprayMACs: 5}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(testMAC(i), dhcp4.Discover, false, now) {
+			t.Fatalf("Allow() of new mac %d denied", i)
+		}
+	}
+	if limiter.Allow(testMAC(5), dhcp4.Discover, false, now) || limiter.Allow(testMAC(6), dhcp4.Discover, false, now) {
+		t.Errorf("Allow() of new macs during spray allowed")
+	}
+	if !limiter.Allow(testMAC(7), dhcp4.Request, true, now) || !limiter.Allow(testMAC(1), dhcp4.Discover, false, now) {
+		t.Errorf("Allow() of known clients during spray denied")
+	}
+	if !limiter.Allow(testMAC(8), dhcp4.Discover, false, now.Add(time.Minute)) {
+		t.Errorf("Allow() of new mac after spray window denied")
+	}
+}
+
+func TestRateLimiter_Rate(t *testing.T) {
+	limiter := &RateLimiter{Window: time.Second, Rate: 10}
+	now := time.Now()
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if limiter.Allow(testMAC(i), dhcp4.Discover, false, now) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Allow() allowed %d of 20 messages, want 10", allowed)
+	}
+	if !limiter.Allow(testMAC(100), dhcp4.Request, true, now) {
+		t.Errorf("Allow() of known client above rate denied")
+	}
+}
+
+func TestDHCPHandler_MaxOffers(t *testing.T) {
+	handler := newTestHandler(50)
+	handler.Limiter = &RateLimiter{Window: time.Minute, MaxOffers: 3, OfferTimeout: time.Minute}
+	for i := 0; i < 3; i++ {
+		if mt, _ := serve(handler, dhcp4.Discover, testMAC(i), nil); mt != dhcp4.Offer {
+			t.Fatalf("Discover() of client %d=%v, want Offer", i, mt)
+		}
+	}
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(3), nil); mt != 0 {
+		t.Errorf("Discover() over outstanding offers=%v, want no reply", mt)
+	}
+	if mt, offered := serve(handler, dhcp4.Discover, testMAC(0), nil); mt != dhcp4.Offer {
+		t.Errorf("Discover() retransmitted by offered client=%v, want Offer", mt)
+	} else {
+		serve(handler, dhcp4.Request, testMAC(0), offered)
+	}
+	if mt, _ := serve(handler, dhcp4.Discover, testMAC(3), nil); mt != dhcp4.Offer {
+		t.Errorf("Discover() after accepted offer=%v, want Offer", mt)
+	}
+}
+
+func TestDHCPHandler_Starvation(t *testing.T) {
+	handler := newTestHandler(50)
+	handler.Limiter = &RateLimiter{Window: time.Minute, SprayMACs: 10, MaxOffers: 20, OfferTimeout: time.Minute}
+	_, offered := serve(handler, dhcp4.Discover, testMAC(100), nil)
+	serve(handler, dhcp4.Request, testMAC(100), offered)
+
+	for i := 0; i < 100; i++ {
+		mac := net.HardwareAddr{0x02, 0, 0, 0, byte(i >> 8), byte(i)}
+		if _, offered := serve(handler, dhcp4.Discover, mac, nil); offered != nil {
+			serve(handler, dhcp4.Request, mac, offered)
+		}
+	}
+	handler.mu.Lock()
+	leased := len(handler.Leases)
+	handler.mu.Unlock()
+	if leased > 11 {
+		t.Errorf("starvation leased %d addresses, want at most 11", leased)
+	}
+	if mt, _ := serve(handler, dhcp4.Request, testMAC(100), offered); mt != dhcp4.ACK {
+		t.Errorf("Request() of known client during starvation=%v, want ACK", mt)
+	}
+}
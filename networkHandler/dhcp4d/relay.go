@@ -0,0 +1,208 @@
+package dhcp4d
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// Relay agent information sub options (RFC 3046)
+const (
+	AgentCircuitID = 1
+	AgentRemoteID  = 2
+)
+
+// maxHops is the hop count after which requests aren't relayed anymore
+const maxHops = 16
+
+// Relay forwards dhcp messages of local clients to an upstream dhcp server
+// and adds relay agent information (option 82) to requests
+type Relay struct {
+	Server    net.IP   // Upstream dhcp server
+	IP        net.IP   // Relay address on the clients network, sent as giaddr
+	CircuitID []byte   // Option 82 circuit-id, identifies the access point
+	Events    EventBus // Lease events of clients seen in relayed messages
+
+	mu      sync.Mutex
+	clients map[string]relayClient // Last request of clients by mac
+}
+
+// relayClient keeps what clients tell only in requests, so events of server replies can carry it
+type relayClient struct {
+	hostName    string
+	fingerprint Fingerprint
+}
+
+// RelayRequest returns p prepared for the upstream server or nil if it shouldn't be relayed
+func (r *Relay) RelayRequest(p dhcp4.Packet) dhcp4.Packet {
+	if len(p) < 240 || p.OpCode() != dhcp4.BootRequest || p.Hops() >= maxHops {
+		return nil
+	}
+	options := p.ParseOptions()
+	mt := messageType(options)
+	if mt == 0 {
+		return nil
+	}
+	r.track(mt, p, options)
+
+	req := relayPacket(p, dhcp4.OptionRelayAgentInformation)
+	req.SetHops(p.Hops() + 1)
+	if req.GIAddr().Equal(net.IPv4zero) {
+		req.SetGIAddr(r.IP)
+	}
+	info, ok := options[dhcp4.OptionRelayAgentInformation]
+	if !ok { // Keep information of relays closer to the client
+		info = r.agentInformation(p.CHAddr())
+	}
+	req.AddOption(dhcp4.OptionRelayAgentInformation, info)
+	req.PadToMinSize()
+	return req
+}
+
+// RelayReply returns p prepared for the client and where to send it, nil if it isn't a reply to this relay
+func (r *Relay) RelayReply(p dhcp4.Packet) (dhcp4.Packet, *net.UDPAddr) {
+	if len(p) < 240 || p.OpCode() != dhcp4.BootReply || !p.GIAddr().Equal(r.IP) {
+		return nil, nil
+	}
+	options := p.ParseOptions()
+	mt := messageType(options)
+	if mt == 0 {
+		return nil, nil
+	}
+	if mt == dhcp4.ACK && !p.YIAddr().Equal(net.IPv4zero) {
+		r.publish(LeaseGranted, p.CHAddr(), p.YIAddr())
+	}
+
+	reply := relayPacket(p, dhcp4.OptionRelayAgentInformation)
+	reply.PadToMinSize()
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	if !p.CIAddr().Equal(net.IPv4zero) && mt != dhcp4.NAK {
+		dst.IP = dhcp4.IPAdd(p.CIAddr(), 0) // Renewing clients have an address already
+	}
+	return reply, dst
+}
+
+// Serve relays requests read from clients to the server and replies read from server back to clients
+// it returns when reading from either connection fails and closes the other one
+func (r *Relay) Serve(clients, server net.PacketConn) error {
+	serverAddr := &net.UDPAddr{IP: r.Server, Port: 67}
+	errs := make(chan error, 2)
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, _, err := server.ReadFrom(buffer)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if reply, dst := r.RelayReply(dhcp4.Packet(buffer[:n])); reply != nil {
+				if _, err := clients.WriteTo(reply, dst); err != nil {
+					log.Println("dhcp relay error sending reply to", dst, err)
+				}
+			}
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, _, err := clients.ReadFrom(buffer)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if req := r.RelayRequest(dhcp4.Packet(buffer[:n])); req != nil {
+				if _, err := server.WriteTo(req, serverAddr); err != nil {
+					log.Println("dhcp relay error sending request to", serverAddr, err)
+				}
+			}
+		}
+	}()
+	err := <-errs
+	clients.Close()
+	server.Close()
+	<-errs
+	return err
+}
+
+// agentInformation returns option 82 value with circuit-id and client mac as remote-id
+func (r *Relay) agentInformation(mac net.HardwareAddr) []byte {
+	circuitID := r.CircuitID
+	if len(circuitID) > maxOptionLen-2-2-len(mac) {
+		circuitID = circuitID[:maxOptionLen-2-2-len(mac)]
+	}
+	info := append([]byte{AgentCircuitID, byte(len(circuitID))}, circuitID...)
+	info = append(info, AgentRemoteID, byte(len(mac)))
+	return append(info, mac...)
+}
+
+// track remembers hostname and fingerprint of requests and publishes releases and declines
+func (r *Relay) track(mt dhcp4.MessageType, p dhcp4.Packet, options dhcp4.Options) {
+	nic := p.CHAddr().String()
+	switch mt {
+	case dhcp4.Discover, dhcp4.Request, dhcp4.Inform:
+		r.mu.Lock()
+		if r.clients == nil {
+			r.clients = make(map[string]relayClient)
+		}
+		r.clients[nic] = relayClient{
+			hostName:    string(options[dhcp4.OptionHostName]),
+			fingerprint: NewFingerprint(p.CHAddr(), options),
+		}
+		r.mu.Unlock()
+	case dhcp4.Release:
+		r.publish(LeaseReleased, p.CHAddr(), p.CIAddr())
+	case dhcp4.Decline:
+		r.publish(LeaseDeclined, p.CHAddr(), options[dhcp4.OptionRequestedIPAddress])
+	}
+}
+
+func (r *Relay) publish(event EventType, mac net.HardwareAddr, ip net.IP) {
+	r.mu.Lock()
+	client := r.clients[mac.String()]
+	if event != LeaseGranted {
+		delete(r.clients, mac.String())
+	}
+	r.mu.Unlock()
+	r.Events.Publish(DeviceInfo{
+		Event:       event,
+		MacAddr:     append(net.HardwareAddr(nil), mac...),
+		IPAddr:      append(net.IP(nil), ip...),
+		HostName:    client.hostName,
+		Fingerprint: client.fingerprint,
+		Time:        time.Now(),
+	})
+}
+
+// messageType returns dhcp message type of options, 0 if missing
+func messageType(options dhcp4.Options) dhcp4.MessageType {
+	if t := options[dhcp4.OptionDHCPMessageType]; len(t) == 1 {
+		return dhcp4.MessageType(t[0])
+	}
+	return 0
+}
+
+// relayPacket copies header and options of p except skipped option into a new packet
+func relayPacket(p dhcp4.Packet, skip dhcp4.OptionCode) dhcp4.Packet {
+	out := make(dhcp4.Packet, 240, len(p)+maxOptionLen)
+	copy(out, p[:240])
+	out = append(out, byte(dhcp4.End))
+	opts := p.Options()
+	for len(opts) >= 2 && dhcp4.OptionCode(opts[0]) != dhcp4.End {
+		if dhcp4.OptionCode(opts[0]) == dhcp4.Pad {
+			opts = opts[1:]
+			continue
+		}
+		size := int(opts[1])
+		if len(opts) < 2+size {
+			break
+		}
+		if code := dhcp4.OptionCode(opts[0]); code != skip {
+			out.AddOption(code, opts[2:2+size])
+		}
+		opts = opts[2+size:]
+	}
+	return out
+}
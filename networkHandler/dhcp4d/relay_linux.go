@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package dhcp4d
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// NewRelayListener listens on ip port 67 for replies of the upstream server
+// the port is shared with the dhcp listener bound to the clients interface
+func NewRelayListener(ip net.IP) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp4", (&net.UDPAddr{IP: ip, Port: 67}).String())
+}
@@ -0,0 +1,108 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func newTestRelay() *Relay {
+	return &Relay{
+		Server:    net.IP{10, 0, 0, 1},
+		IP:        net.IP{192, 168, 100, 1},
+		CircuitID: []byte("packetify/ap0"),
+	}
+}
+
+func TestRelay_RelayRequest(t *testing.T) {
+	relay := newTestRelay()
+	mac := testMAC(1)
+	req := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 4}, false,
+		[]dhcp4.Option{{Code: dhcp4.OptionHostName, Value: []byte("phone")}})
+
+	relayed := relay.RelayRequest(req)
+	if relayed == nil {
+		t.Fatal("RelayRequest()=nil")
+	}
+	if !relayed.GIAddr().Equal(relay.IP) || relayed.Hops() != 1 || !bytes.Equal(relayed.XId(), req.XId()) {
+		t.Errorf("RelayRequest() giaddr=%v hops=%d xid=%v", relayed.GIAddr(), relayed.Hops(), relayed.XId())
+	}
+	options := relayed.ParseOptions()
+	want := append([]byte{AgentCircuitID, 13}, "packetify/ap0"...)
+	want = append(want, AgentRemoteID, 6)
+	want = append(want, mac...)
+	if info := options[dhcp4.OptionRelayAgentInformation]; !bytes.Equal(info, want) {
+		t.Errorf("RelayRequest() option 82=%v, want %v", info, want)
+	}
+	if string(options[dhcp4.OptionHostName]) != "phone" || messageType(options) != dhcp4.Discover {
+		t.Errorf("RelayRequest() lost client options %v", options)
+	}
+
+	req.SetHops(maxHops)
+	if relay.RelayRequest(req) != nil {
+		t.Errorf("RelayRequest() relayed request with %d hops", maxHops)
+	}
+	if relay.RelayRequest(dhcp4.ReplyPacket(req, dhcp4.Offer, relay.Server, nil, 0, nil)) != nil {
+		t.Errorf("RelayRequest() relayed a reply")
+	}
+}
+
+func TestRelay_RelayReply(t *testing.T) {
+	relay := newTestRelay()
+	events := relay.Events.Subscribe(10)
+	mac := testMAC(1)
+	req := relay.RelayRequest(dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{1, 2, 3, 4}, false,
+		[]dhcp4.Option{{Code: dhcp4.OptionHostName, Value: []byte("phone")}}))
+	yiaddr := net.IP{192, 168, 100, 50}
+
+	ack := dhcp4.ReplyPacket(req, dhcp4.ACK, relay.Server, yiaddr, time.Hour,
+		[]dhcp4.Option{{Code: dhcp4.OptionRelayAgentInformation, Value: req.ParseOptions()[dhcp4.OptionRelayAgentInformation]}})
+	reply, dst := relay.RelayReply(ack)
+	if reply == nil {
+		t.Fatal("RelayReply()=nil")
+	}
+	if _, ok := reply.ParseOptions()[dhcp4.OptionRelayAgentInformation]; ok {
+		t.Errorf("RelayReply() kept option 82")
+	}
+	if !dst.IP.Equal(net.IPv4bcast) || dst.Port != 68 || !reply.YIAddr().Equal(yiaddr) {
+		t.Errorf("RelayReply() to %v yiaddr %v, want broadcast of %v", dst, reply.YIAddr(), yiaddr)
+	}
+	select {
+	case dev := <-events:
+		if dev.Event != LeaseGranted || !dev.IPAddr.Equal(yiaddr) || dev.HostName != "phone" || dev.MacAddr.String() != mac.String() {
+			t.Errorf("RelayReply() event=%+v", dev)
+		}
+	default:
+		t.Errorf("RelayReply() of ACK published no event")
+	}
+
+	renew := dhcp4.Packet(append([]byte(nil), ack...))
+	renew.SetCIAddr(yiaddr)
+	if _, dst := relay.RelayReply(renew); !dst.IP.Equal(yiaddr) {
+		t.Errorf("RelayReply() of renewal to %v, want %v", dst, yiaddr)
+	}
+
+	other := dhcp4.Packet(append([]byte(nil), ack...))
+	other.SetGIAddr(net.IP{192, 168, 200, 1})
+	if reply, _ := relay.RelayReply(other); reply != nil {
+		t.Errorf("RelayReply() relayed reply for another relay")
+	}
+}
+
+func TestRelay_Release(t *testing.T) {
+	relay := newTestRelay()
+	events := relay.Events.Subscribe(10)
+	ip := net.IP{192, 168, 100, 50}
+	relay.RelayRequest(dhcp4.RequestPacket(dhcp4.Release, testMAC(1), ip, []byte{1, 2, 3, 4}, false, nil))
+	select {
+	case dev := <-events:
+		if dev.Event != LeaseReleased || !dev.IPAddr.Equal(ip) {
+			t.Errorf("RelayRequest(Release) event=%+v", dev)
+		}
+	default:
+		t.Errorf("RelayRequest(Release) published no event")
+	}
+}
@@ -0,0 +1,90 @@
+package dhcp4d
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/krolaw/dhcp4"
+	"net"
+	"os"
+	"strings"
+)
+
+// ParseReservation parses "mac=ip" (or "mac,ip" / "mac ip") into its hardware and ip address
+func ParseReservation(reservation string) (net.HardwareAddr, net.IP, error) {
+	fields := strings.FieldsFunc(reservation, func(r rune) bool {
+		return r == '=' || r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) != 2 {
+		return nil, nil, fmt.Errorf("invalid dhcp reservation %q, want mac=ip", reservation)
+	}
+	mac, err := net.ParseMAC(fields[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid dhcp reservation %q: %v", reservation, err)
+	}
+	ip := net.ParseIP(fields[1]).To4()
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid dhcp reservation %q: %s is not an ipv4 address", reservation, fields[1])
+	}
+	return mac, ip, nil
+}
+
+// LoadReservations reads reservations from file, one "mac ip" per line
+// empty lines and lines starting with # are ignored
+func LoadReservations(path string) (map[string]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reservations := make(map[string]net.IP)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mac, ip, err := ParseReservation(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		reservations[mac.String()] = ip
+	}
+	return reservations, scanner.Err()
+}
+
+// Reserve binds ip to mac, ip should be in the range of the handler and not reserved by other mac
+func (h *DHCPHandler) Reserve(mac net.HardwareAddr, ip net.IP) error {
+	if ip.To4() == nil {
+		return fmt.Errorf("reserved address %v is not ipv4", ip)
+	}
+	if leaseNum := dhcp4.IPRange(h.Start, ip) - 1; leaseNum < 0 || leaseNum >= h.LeaseRange {
+		return fmt.Errorf("reserved address %v is out of dhcp range", ip)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if owner, ok := h.reservedBy(ip); ok && owner != mac.String() {
+		return fmt.Errorf("address %v is already reserved for %s", ip, owner)
+	}
+	if h.Reservations == nil {
+		h.Reservations = make(map[string]net.IP)
+	}
+	h.Reservations[mac.String()] = ip.To4()
+	return nil
+}
+
+// reservedBy returns the mac address that ip is reserved for, callers must hold h.mu
+func (h *DHCPHandler) reservedBy(ip net.IP) (string, bool) {
+	for mac, reserved := range h.Reservations {
+		if reserved.Equal(ip) {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+// isReservedLease reports whether lease number is reserved for any client, callers must hold h.mu
+func (h *DHCPHandler) isReservedLease(leaseNum int) bool {
+	_, ok := h.reservedBy(dhcp4.IPAdd(h.Start, leaseNum))
+	return ok
+}
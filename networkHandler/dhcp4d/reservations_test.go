@@ -0,0 +1,87 @@
+package dhcp4d
+
+import (
+	"github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseReservation(t *testing.T) {
+	tests := []struct {
+		reservation string
+		wantIP      net.IP
+		wantErr     bool
+	}{
+		{"aa:bb:cc:dd:ee:ff=192.168.100.20", net.IP{192, 168, 100, 20}, false},
+		{"AA:BB:CC:DD:EE:FF,192.168.100.20", net.IP{192, 168, 100, 20}, false},
+		{"aa:bb:cc:dd:ee:ff 192.168.100.20", net.IP{192, 168, 100, 20}, false},
+		{"aa:bb:cc:dd:ee:ff=fe80::1", nil, true},
+		{"aa:bb:cc:dd:ee=192.168.100.20", nil, true},
+		{"192.168.100.20", nil, true},
+	}
+	for _, tst := range tests {
+		_, ip, err := ParseReservation(tst.reservation)
+		if (err != nil) != tst.wantErr || !ip.Equal(tst.wantIP) {
+			t.Errorf("ParseReservation(%s)=%v,%v", tst.reservation, ip, err)
+		}
+	}
+}
+
+func TestDHCPHandler_Reservations(t *testing.T) {
+	owner, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	other, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
+	reserved := net.IP{192, 168, 100, 50}
+	handler := &DHCPHandler{
+		IP:            net.IP{192, 168, 100, 1},
+		Start:         net.IP{192, 168, 100, 2},
+		LeaseRange:    100,
+		LeaseDuration: time.Hour,
+		Leases:        make(map[int]Lease),
+	}
+	if err := handler.Reserve(owner, reserved); err != nil {
+		t.Fatalf("Reserve() error: %v", err)
+	}
+	if err := handler.Reserve(other, reserved); err == nil {
+		t.Errorf("Reserve() of reserved address for other mac succeeded")
+	}
+	if err := handler.Reserve(other, net.IP{10, 0, 0, 1}); err == nil {
+		t.Errorf("Reserve() of out of range address succeeded")
+	}
+
+	discover := dhcp4.RequestPacket(dhcp4.Discover, owner, nil, []byte{1, 2, 3, 4}, false, nil)
+	offer := handler.ServeDHCP(discover, dhcp4.Discover, discover.ParseOptions())
+	if offer == nil || !offer.YIAddr().Equal(reserved) {
+		t.Fatalf("Discover from reserved mac offered %v, want %v", offer.YIAddr(), reserved)
+	}
+
+	for i := 0; i < 99; i++ {
+		if free := handler.FreeLease(); dhcp4.IPAdd(handler.Start, free).Equal(reserved) {
+			t.Fatalf("FreeLease() returned reserved address")
+		} else {
+			handler.Leases[free] = Lease{Nic: "filler", Expiry: time.Now().Add(time.Hour)}
+		}
+	}
+	if free := handler.FreeLease(); free != -1 {
+		t.Errorf("FreeLease()=%d when only reserved address left, want -1", free)
+	}
+
+	tests := []struct {
+		mac    net.HardwareAddr
+		reqIP  net.IP
+		wantMT dhcp4.MessageType
+	}{
+		{other, reserved, dhcp4.NAK},
+		{owner, net.IP{192, 168, 100, 60}, dhcp4.NAK},
+		{owner, reserved, dhcp4.ACK},
+	}
+	for _, tst := range tests {
+		req := dhcp4.RequestPacket(dhcp4.Request, tst.mac, nil, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+			{Code: dhcp4.OptionRequestedIPAddress, Value: tst.reqIP},
+		})
+		reply := handler.ServeDHCP(req, dhcp4.Request, req.ParseOptions())
+		if mt := dhcp4.MessageType(reply.ParseOptions()[dhcp4.OptionDHCPMessageType][0]); mt != tst.wantMT {
+			t.Errorf("Request(%v, %v)=%v, want %v", tst.mac, tst.reqIP, mt, tst.wantMT)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Stateful DHCPv6 server handing out addresses of a prefix pool
+package dhcp6d
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+var AllDHCPRelayAgentsAndServers = net.ParseIP("ff02::1:2")
+
+// advertiseHold is how long an advertised address is kept for the Request of its client
+const advertiseHold = time.Minute
+
+type Lease struct {
+	ClientID string // Hex encoded client DUID
+	IAID     uint32
+	IP       net.IP
+	Expiry   time.Time
+}
+
+type DHCPHandler struct {
+	ServerID          []byte        // Server DUID
+	Prefix            net.IPNet     // On-link prefix of the pool
+	Start             net.IP        // Start of IP range to distribute
+	LeaseRange        int           // Number of IPs to distribute (starting from start)
+	PreferredLifetime time.Duration // Preferred lifetime of addresses
+	ValidLifetime     time.Duration // Valid lifetime of addresses
+	DNS               []net.IP      // DNS servers sent to clients
+	Leases            map[int]Lease // Map to keep track of leases
+	mu                sync.Mutex
+}
+
+// NewPoolHandler returns a handler distributing size addresses of prefix starting from prefix::1000
+func NewPoolHandler(serverID []byte, prefix net.IPNet, size int) *DHCPHandler {
+	return &DHCPHandler{
+		ServerID:          serverID,
+		Prefix:            prefix,
+		Start:             IPAdd(prefix.IP, 0x1000),
+		LeaseRange:        size,
+		PreferredLifetime: 4 * time.Hour,
+		ValidLifetime:     5 * time.Hour,
+		Leases:            make(map[int]Lease),
+	}
+}
+
+func (h *DHCPHandler) ServeDHCP(req *Message) *Message {
+	clientID, ok := req.Option(OptionClientID)
+	if !ok && req.Type != InformationRequest {
+		return nil
+	}
+	serverID, hasServerID := req.Option(OptionServerID)
+	switch req.Type {
+	case Solicit, Rebind, Confirm:
+		if hasServerID {
+			return nil // Must not carry server id
+		}
+	case Request, Renew, Release, Decline:
+		if !hasServerID || !bytes.Equal(serverID, h.ServerID) {
+			return nil // Message not for this dhcp server
+		}
+	case InformationRequest:
+		if hasServerID && !bytes.Equal(serverID, h.ServerID) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	reply := &Message{Type: Reply, TransactionID: req.TransactionID}
+	if clientID != nil {
+		reply.AddOption(OptionClientID, clientID)
+	}
+	reply.AddOption(OptionServerID, h.ServerID)
+
+	ias, err := req.IANAs()
+	if err != nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client := hex.EncodeToString(clientID)
+	switch req.Type {
+	case Solicit:
+		if _, rapid := req.Option(OptionRapidCommit); rapid {
+			reply.AddOption(OptionRapidCommit, nil)
+			for _, ia := range ias {
+				reply.Options = append(reply.Options, h.bind(client, ia, true))
+			}
+		} else {
+			reply.Type = Advertise
+			for _, ia := range ias {
+				reply.Options = append(reply.Options, h.bind(client, ia, false))
+			}
+		}
+	case Request, Renew, Rebind:
+		for _, ia := range ias {
+			reply.Options = append(reply.Options, h.bind(client, ia, true))
+		}
+	case Release, Decline:
+		for _, ia := range ias {
+			if i, ok := h.findLease(client, ia.IAID); ok {
+				delete(h.Leases, i)
+			}
+		}
+		reply.Options = append(reply.Options, StatusOption(StatusSuccess, "released"))
+	case Confirm:
+		status := StatusOption(StatusSuccess, "all addresses on link")
+		for _, ia := range ias {
+			for _, addr := range ia.Addrs() {
+				if !h.Prefix.Contains(addr.IP) {
+					status = StatusOption(StatusNotOnLink, "address not on link")
+				}
+			}
+		}
+		reply.Options = append(reply.Options, status)
+	}
+	if len(h.DNS) != 0 {
+		var dns []byte
+		for _, ip := range h.DNS {
+			dns = append(dns, ip.To16()...)
+		}
+		reply.AddOption(OptionDNSServers, dns)
+	}
+	return reply
+}
+
+// bind returns IA_NA option for ia, commit stores the lease and advertised leases are held for advertiseHold
+// a client without lease gets the address it asks for in ia when that one is free
+func (h *DHCPHandler) bind(client string, ia IANA, commit bool) Option {
+	now := time.Now()
+	leaseNum, ok := h.findLease(client, ia.IAID)
+	if !ok {
+		if leaseNum = h.requestedLease(ia, now); leaseNum == -1 {
+			leaseNum = h.freeLease()
+		}
+		if leaseNum == -1 {
+			ia.Options = []Option{StatusOption(StatusNoAddrsAvail, "no addresses available")}
+			return Option{Code: OptionIANA, Data: ia.Marshal()}
+		}
+	}
+	ip := IPAdd(h.Start, leaseNum)
+	if commit {
+		h.Leases[leaseNum] = Lease{ClientID: client, IAID: ia.IAID, IP: ip, Expiry: now.Add(h.ValidLifetime)}
+	} else if !ok {
+		// Tentative, so the Request gets the advertised address and other clients are advertised others
+		h.Leases[leaseNum] = Lease{ClientID: client, IAID: ia.IAID, IP: ip, Expiry: now.Add(advertiseHold)}
+	}
+	ia.T1 = h.PreferredLifetime / 2
+	ia.T2 = h.PreferredLifetime * 4 / 5
+	addr := IAAddr{IP: ip, PreferredLifetime: h.PreferredLifetime, ValidLifetime: h.ValidLifetime}
+	ia.Options = []Option{{Code: OptionIAAddr, Data: addr.Marshal()}}
+	return Option{Code: OptionIANA, Data: ia.Marshal()}
+}
+
+func (h *DHCPHandler) findLease(client string, iaid uint32) (int, bool) {
+	for i, l := range h.Leases {
+		if l.ClientID == client && l.IAID == iaid {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// requestedLease returns lease number of a free address of ia in the range, -1 if there is none
+func (h *DHCPHandler) requestedLease(ia IANA, now time.Time) int {
+	for _, addr := range ia.Addrs() {
+		leaseNum := h.leaseNum(addr.IP)
+		if leaseNum == -1 {
+			continue
+		}
+		if l, ok := h.Leases[leaseNum]; !ok || l.Expiry.Before(now) {
+			return leaseNum
+		}
+	}
+	return -1
+}
+
+// leaseNum returns lease number of ip, -1 if ip isn't in the range
+func (h *DHCPHandler) leaseNum(ip net.IP) int {
+	ip, start := ip.To16(), h.Start.To16()
+	if ip == nil || !bytes.Equal(ip[:8], start[:8]) {
+		return -1
+	}
+	n := binary.BigEndian.Uint64(ip[8:]) - binary.BigEndian.Uint64(start[8:])
+	if n >= uint64(h.LeaseRange) {
+		return -1
+	}
+	return int(n)
+}
+
+func (h *DHCPHandler) freeLease() int {
+	now := time.Now()
+	b := rand.Intn(h.LeaseRange) // Try random first
+	for _, v := range [][]int{{b, h.LeaseRange}, {0, b}} {
+		for i := v[0]; i < v[1]; i++ {
+			if l, ok := h.Leases[i]; !ok || l.Expiry.Before(now) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Serve listens on dhcpv6 server port of iface and answers client messages until ctx is done
+func Serve(ctx context.Context, iface *net.Interface, handler *DHCPHandler) error {
+	conn, err := net.ListenPacket("udp6", "[::]:547")
+	if err != nil {
+		return err
+	}
+	p := ipv6.NewPacketConn(conn)
+	if err := p.JoinGroup(iface, &net.UDPAddr{IP: AllDHCPRelayAgentsAndServers}); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		conn.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buffer := make([]byte, 1500)
+	for {
+		n, cm, addr, err := p.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if cm != nil && cm.IfIndex != iface.Index {
+			continue
+		}
+		req, err := ParseMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		if res := handler.ServeDHCP(req); res != nil {
+			if _, err := p.WriteTo(res.Marshal(), &ipv6.ControlMessage{IfIndex: iface.Index}, addr); err != nil {
+				log.Println("error writing dhcpv6 reply", err)
+			}
+		}
+	}
+}
+
+// IPAdd returns a copy of start + add, carrying only over the interface identifier
+func IPAdd(start net.IP, add int) net.IP {
+	result := make(net.IP, net.IPv6len)
+	copy(result, start.To16())
+	binary.BigEndian.PutUint64(result[8:], binary.BigEndian.Uint64(result[8:])+uint64(add))
+	return result
+}
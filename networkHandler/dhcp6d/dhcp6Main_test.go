@@ -0,0 +1,171 @@
+package dhcp6d
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestHandler() *DHCPHandler {
+	_, prefix, _ := net.ParseCIDR("fd00:100::/64")
+	return NewPoolHandler(DUIDLL(net.HardwareAddr{2, 0, 0, 0, 0, 1}), *prefix, 16)
+}
+
+func clientMessage(mt MessageType, clientID, serverID []byte, iaid uint32) *Message {
+	m := &Message{Type: mt, TransactionID: [3]byte{1, 2, 3}}
+	m.AddOption(OptionClientID, clientID)
+	if serverID != nil {
+		m.AddOption(OptionServerID, serverID)
+	}
+	m.AddOption(OptionIANA, IANA{IAID: iaid}.Marshal())
+	return m
+}
+
+// replyAddr parses a wire reply and returns its type and first leased address
+func replyAddr(t *testing.T, reply *Message) (MessageType, net.IP) {
+	t.Helper()
+	if reply == nil {
+		t.Fatal("no reply")
+	}
+	parsed, err := ParseMessage(reply.Marshal())
+	if err != nil {
+		t.Fatalf("ParseMessage() error: %v", err)
+	}
+	ias, err := parsed.IANAs()
+	if err != nil || len(ias) != 1 {
+		t.Fatalf("IANAs()=%v,%v want one IA_NA", ias, err)
+	}
+	addrs := ias[0].Addrs()
+	if len(addrs) == 0 {
+		return parsed.Type, nil
+	}
+	return parsed.Type, addrs[0].IP
+}
+
+func TestDHCPHandler_ServeDHCP(t *testing.T) {
+	handler := newTestHandler()
+	client := DUIDLL(net.HardwareAddr{2, 0, 0, 0, 0, 2})
+
+	mt, advertised := replyAddr(t, handler.ServeDHCP(clientMessage(Solicit, client, nil, 7)))
+	if mt != Advertise || !handler.Prefix.Contains(advertised) {
+		t.Fatalf("Solicit()=%v %v, want Advertise in %v", mt, advertised, handler.Prefix.String())
+	}
+	for _, l := range handler.Leases {
+		if l.Expiry.After(time.Now().Add(advertiseHold)) {
+			t.Errorf("Solicit() without rapid commit stored lease %+v", l)
+		}
+	}
+	if reply := handler.ServeDHCP(clientMessage(Request, client, []byte{0, 3, 0, 1, 9, 9, 9, 9, 9, 9}, 7)); reply != nil {
+		t.Errorf("Request() for other server got a reply")
+	}
+
+	mt, leased := replyAddr(t, handler.ServeDHCP(clientMessage(Request, client, handler.ServerID, 7)))
+	if mt != Reply || !leased.Equal(advertised) {
+		t.Fatalf("Request()=%v %v, want Reply with %v", mt, leased, advertised)
+	}
+	if _, renewed := replyAddr(t, handler.ServeDHCP(clientMessage(Renew, client, handler.ServerID, 7))); !renewed.Equal(leased) {
+		t.Errorf("Renew() leased %v, want %v", renewed, leased)
+	}
+
+	handler.ServeDHCP(clientMessage(Release, client, handler.ServerID, 7))
+	if len(handler.Leases) != 0 {
+		t.Errorf("Release() left %d leases", len(handler.Leases))
+	}
+}
+
+// requestAddr returns a client message of iaid asking for ip
+func requestAddr(mt MessageType, clientID, serverID []byte, iaid uint32, ip net.IP) *Message {
+	m := clientMessage(mt, clientID, serverID, 0)
+	m.Options = m.Options[:len(m.Options)-1]
+	ia := IANA{IAID: iaid, Options: []Option{{Code: OptionIAAddr, Data: IAAddr{IP: ip}.Marshal()}}}
+	m.AddOption(OptionIANA, ia.Marshal())
+	return m
+}
+
+func TestDHCPHandler_AdvertiseRequest(t *testing.T) {
+	handler := newTestHandler()
+	handler.LeaseRange = 2
+	clients := [][]byte{DUIDLL(net.HardwareAddr{2, 0, 0, 0, 0, 2}), DUIDLL(net.HardwareAddr{2, 0, 0, 0, 0, 3})}
+	var advertised []net.IP
+	for _, client := range clients {
+		_, addr := replyAddr(t, handler.ServeDHCP(clientMessage(Solicit, client, nil, 1)))
+		advertised = append(advertised, addr)
+	}
+	if advertised[0] == nil || advertised[0].Equal(advertised[1]) {
+		t.Fatalf("Solicit() of two clients advertised %v", advertised)
+	}
+	for i := len(clients) - 1; i >= 0; i-- {
+		request := requestAddr(Request, clients[i], handler.ServerID, 1, advertised[i])
+		if _, leased := replyAddr(t, handler.ServeDHCP(request)); !leased.Equal(advertised[i]) {
+			t.Errorf("Request(%v)=%v, want the advertised address", advertised[i], leased)
+		}
+	}
+
+	// A server without the advertised lease, as after a restart, keeps the address of the client
+	handler = newTestHandler()
+	var tests = []struct {
+		mt     MessageType
+		client []byte
+		ip     net.IP
+		keeps  bool
+	}{
+		{Request, []byte{1}, IPAdd(handler.Start, 9), true},
+		{Renew, []byte{2}, IPAdd(handler.Start, 10), true},
+		{Request, []byte{3}, IPAdd(handler.Start, 9), false},
+		{Request, []byte{4}, IPAdd(handler.Start, 16), false},
+	}
+	for _, test := range tests {
+		_, leased := replyAddr(t, handler.ServeDHCP(requestAddr(test.mt, test.client, handler.ServerID, 1, test.ip)))
+		if leased.Equal(test.ip) != test.keeps {
+			t.Errorf("%v(%v)=%v", test.mt, test.ip, leased)
+		}
+	}
+}
+
+func TestDHCPHandler_RapidCommit(t *testing.T) {
+	handler := newTestHandler()
+	solicit := clientMessage(Solicit, DUIDLL(net.HardwareAddr{2, 0, 0, 0, 0, 2}), nil, 1)
+	solicit.AddOption(OptionRapidCommit, nil)
+	if mt, _ := replyAddr(t, handler.ServeDHCP(solicit)); mt != Reply || len(handler.Leases) != 1 {
+		t.Errorf("Solicit() with rapid commit=%v with %d leases, want Reply with 1 lease", mt, len(handler.Leases))
+	}
+}
+
+func TestDHCPHandler_NoAddrsAvail(t *testing.T) {
+	handler := newTestHandler()
+	handler.LeaseRange = 1
+	handler.ServeDHCP(clientMessage(Request, []byte{1}, handler.ServerID, 1))
+	if _, addr := replyAddr(t, handler.ServeDHCP(clientMessage(Request, []byte{2}, handler.ServerID, 1))); addr != nil {
+		t.Errorf("Request() of exhausted pool leased %v", addr)
+	}
+}
+
+func TestRouterAdvertiser_Marshal(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fd00:100::/64")
+	iface := &net.Interface{Index: 1, Name: "hotSpot", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	tests := []struct {
+		mode       RAMode
+		wantFlags  byte
+		wantPrefix byte
+	}{
+		{SLAAC, 0, 0xc0},
+		{Stateful, 0xc0, 0x80},
+		{Both, 0xc0, 0xc0},
+	}
+	for _, tst := range tests {
+		ra := NewRouterAdvertiser(iface, *prefix, tst.mode)
+		b := ra.Marshal()
+		if b[1] != tst.wantFlags {
+			t.Errorf("%s advertisement flags=%#x, want %#x", tst.mode, b[1], tst.wantFlags)
+		}
+		// header(12) + source link-layer(8) + prefix information
+		pi := b[20:52]
+		if pi[0] != 3 || pi[2] != 64 || pi[3] != tst.wantPrefix || !bytes.Equal(pi[16:32], prefix.IP) {
+			t.Errorf("%s prefix information=%v", tst.mode, pi)
+		}
+	}
+	if _, err := ParseRAMode("dhcp"); err == nil {
+		t.Errorf("ParseRAMode(dhcp) succeeded")
+	}
+}
@@ -0,0 +1,242 @@
+package dhcp6d
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+type MessageType byte
+
+// DHCPv6 message types (RFC 8415)
+const (
+	Solicit            MessageType = 1
+	Advertise          MessageType = 2
+	Request            MessageType = 3
+	Confirm            MessageType = 4
+	Renew              MessageType = 5
+	Rebind             MessageType = 6
+	Reply              MessageType = 7
+	Release            MessageType = 8
+	Decline            MessageType = 9
+	InformationRequest MessageType = 11
+)
+
+type OptionCode uint16
+
+// DHCPv6 option codes
+const (
+	OptionClientID    OptionCode = 1
+	OptionServerID    OptionCode = 2
+	OptionIANA        OptionCode = 3
+	OptionIAAddr      OptionCode = 5
+	OptionORO         OptionCode = 6
+	OptionPreference  OptionCode = 7
+	OptionElapsedTime OptionCode = 8
+	OptionStatusCode  OptionCode = 13
+	OptionRapidCommit OptionCode = 14
+	OptionDNSServers  OptionCode = 23
+	OptionDomainList  OptionCode = 24
+)
+
+type StatusCode uint16
+
+// DHCPv6 status codes
+const (
+	StatusSuccess      StatusCode = 0
+	StatusUnspecFail   StatusCode = 1
+	StatusNoAddrsAvail StatusCode = 2
+	StatusNoBinding    StatusCode = 3
+	StatusNotOnLink    StatusCode = 4
+)
+
+var ErrorShortMessage = errors.New("dhcpv6 message is too short")
+
+type Option struct {
+	Code OptionCode
+	Data []byte
+}
+
+type Message struct {
+	Type          MessageType
+	TransactionID [3]byte
+	Options       []Option
+}
+
+// IANA is an identity association for non-temporary addresses
+type IANA struct {
+	IAID    uint32
+	T1      time.Duration
+	T2      time.Duration
+	Options []Option
+}
+
+// IAAddr is an address option carried inside IANA
+type IAAddr struct {
+	IP                net.IP
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	Options           []Option
+}
+
+// ParseMessage parses a client/server DHCPv6 message
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, ErrorShortMessage
+	}
+	m := &Message{Type: MessageType(b[0])}
+	copy(m.TransactionID[:], b[1:4])
+	options, err := parseOptions(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	m.Options = options
+	return m, nil
+}
+
+// Marshal returns wire format of message
+func (m *Message) Marshal() []byte {
+	b := []byte{byte(m.Type), m.TransactionID[0], m.TransactionID[1], m.TransactionID[2]}
+	return append(b, marshalOptions(m.Options)...)
+}
+
+// Option returns data of the first option with code
+func (m *Message) Option(code OptionCode) ([]byte, bool) {
+	return findOption(m.Options, code)
+}
+
+// AddOption appends option to message
+func (m *Message) AddOption(code OptionCode, data []byte) {
+	m.Options = append(m.Options, Option{Code: code, Data: data})
+}
+
+// IANAs returns all identity associations requested in message
+func (m *Message) IANAs() ([]IANA, error) {
+	var ias []IANA
+	for _, o := range m.Options {
+		if o.Code != OptionIANA {
+			continue
+		}
+		ia, err := ParseIANA(o.Data)
+		if err != nil {
+			return nil, err
+		}
+		ias = append(ias, ia)
+	}
+	return ias, nil
+}
+
+func ParseIANA(b []byte) (IANA, error) {
+	if len(b) < 12 {
+		return IANA{}, ErrorShortMessage
+	}
+	options, err := parseOptions(b[12:])
+	if err != nil {
+		return IANA{}, err
+	}
+	return IANA{
+		IAID:    binary.BigEndian.Uint32(b[0:4]),
+		T1:      time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Second,
+		T2:      time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Second,
+		Options: options,
+	}, nil
+}
+
+func (ia IANA) Marshal() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:4], ia.IAID)
+	binary.BigEndian.PutUint32(b[4:8], uint32(ia.T1/time.Second))
+	binary.BigEndian.PutUint32(b[8:12], uint32(ia.T2/time.Second))
+	return append(b, marshalOptions(ia.Options)...)
+}
+
+// Addrs returns addresses of the identity association
+func (ia IANA) Addrs() []IAAddr {
+	var addrs []IAAddr
+	for _, o := range ia.Options {
+		if o.Code != OptionIAAddr {
+			continue
+		}
+		if addr, err := ParseIAAddr(o.Data); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func ParseIAAddr(b []byte) (IAAddr, error) {
+	if len(b) < 24 {
+		return IAAddr{}, ErrorShortMessage
+	}
+	options, err := parseOptions(b[24:])
+	if err != nil {
+		return IAAddr{}, err
+	}
+	return IAAddr{
+		IP:                append(net.IP(nil), b[0:16]...),
+		PreferredLifetime: time.Duration(binary.BigEndian.Uint32(b[16:20])) * time.Second,
+		ValidLifetime:     time.Duration(binary.BigEndian.Uint32(b[20:24])) * time.Second,
+		Options:           options,
+	}, nil
+}
+
+func (a IAAddr) Marshal() []byte {
+	b := make([]byte, 24)
+	copy(b[0:16], a.IP.To16())
+	binary.BigEndian.PutUint32(b[16:20], uint32(a.PreferredLifetime/time.Second))
+	binary.BigEndian.PutUint32(b[20:24], uint32(a.ValidLifetime/time.Second))
+	return append(b, marshalOptions(a.Options)...)
+}
+
+// StatusOption returns a status code option with message
+func StatusOption(code StatusCode, message string) Option {
+	b := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return Option{Code: OptionStatusCode, Data: append(b, message...)}
+}
+
+// DUIDLL returns a link-layer address DUID (type 3) of hardware address
+func DUIDLL(mac net.HardwareAddr) []byte {
+	return append([]byte{0, 3, 0, 1}, mac...)
+}
+
+func findOption(options []Option, code OptionCode) ([]byte, bool) {
+	for _, o := range options {
+		if o.Code == code {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
+func parseOptions(b []byte) ([]Option, error) {
+	var options []Option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrorShortMessage
+		}
+		size := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+size {
+			return nil, ErrorShortMessage
+		}
+		options = append(options, Option{
+			Code: OptionCode(binary.BigEndian.Uint16(b[0:2])),
+			Data: append([]byte(nil), b[4:4+size]...),
+		})
+		b = b[4+size:]
+	}
+	return options, nil
+}
+
+func marshalOptions(options []Option) []byte {
+	var b []byte
+	for _, o := range options {
+		var head [4]byte
+		binary.BigEndian.PutUint16(head[0:2], uint16(o.Code))
+		binary.BigEndian.PutUint16(head[2:4], uint16(len(o.Data)))
+		b = append(b, head[:]...)
+		b = append(b, o.Data...)
+	}
+	return b
+}
@@ -0,0 +1,195 @@
+package dhcp6d
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// RAMode decides how clients configure their addresses from router advertisements
+type RAMode string
+
+const (
+	SLAAC    RAMode = "slaac"    // Clients autoconfigure addresses from prefix
+	Stateful RAMode = "stateful" // Clients get addresses from DHCPv6
+	Both     RAMode = "both"     // Clients autoconfigure and ask DHCPv6 as well
+)
+
+var AllNodes = net.ParseIP("ff02::1")
+var AllRouters = net.ParseIP("ff02::2")
+
+// ParseRAMode validates mode name
+func ParseRAMode(mode string) (RAMode, error) {
+	switch RAMode(mode) {
+	case SLAAC, Stateful, Both:
+		return RAMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid router advertisement mode %q, want slaac, stateful or both", mode)
+}
+
+// UsesDHCP reports whether clients should ask DHCPv6 for addresses
+func (m RAMode) UsesDHCP() bool {
+	return m == Stateful || m == Both
+}
+
+// RouterAdvertiser sends router advertisements for Prefix on Iface
+type RouterAdvertiser struct {
+	Iface             *net.Interface
+	Prefix            net.IPNet     // /64 prefix advertised to clients
+	Mode              RAMode        // Address configuration mode of clients
+	Interval          time.Duration // Interval of unsolicited advertisements
+	RouterLifetime    time.Duration // Zero means the AP is not a default router
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	DNS               []net.IP // Recursive DNS servers (RFC 8106)
+	MTU               int      // Optional link mtu
+}
+
+// NewRouterAdvertiser returns an advertiser with lifetimes suited for an access point
+func NewRouterAdvertiser(iface *net.Interface, prefix net.IPNet, mode RAMode) *RouterAdvertiser {
+	return &RouterAdvertiser{
+		Iface:             iface,
+		Prefix:            prefix,
+		Mode:              mode,
+		Interval:          200 * time.Second,
+		RouterLifetime:    30 * time.Minute,
+		PreferredLifetime: 4 * time.Hour,
+		ValidLifetime:     24 * time.Hour,
+	}
+}
+
+// Marshal returns body of a router advertisement icmpv6 message
+func (ra *RouterAdvertiser) Marshal() []byte {
+	b := make([]byte, 12)
+	b[0] = 64 // Current hop limit
+	if ra.Mode.UsesDHCP() {
+		b[1] |= 0x80 | 0x40 // Managed address and other configuration over DHCPv6
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(ra.RouterLifetime/time.Second))
+
+	// Source link-layer address
+	if len(ra.Iface.HardwareAddr) == 6 {
+		b = append(b, 1, 1)
+		b = append(b, ra.Iface.HardwareAddr...)
+	}
+	if ra.MTU != 0 {
+		mtu := make([]byte, 8)
+		mtu[0], mtu[1] = 5, 1
+		binary.BigEndian.PutUint32(mtu[4:8], uint32(ra.MTU))
+		b = append(b, mtu...)
+	}
+
+	// Prefix information
+	prefix := make([]byte, 32)
+	prefix[0], prefix[1] = 3, 4
+	ones, _ := ra.Prefix.Mask.Size()
+	prefix[2] = byte(ones)
+	prefix[3] = 0x80 // On-link
+	if ra.Mode == SLAAC || ra.Mode == Both {
+		prefix[3] |= 0x40 // Autonomous address configuration
+	}
+	binary.BigEndian.PutUint32(prefix[4:8], uint32(ra.ValidLifetime/time.Second))
+	binary.BigEndian.PutUint32(prefix[8:12], uint32(ra.PreferredLifetime/time.Second))
+	copy(prefix[16:32], ra.Prefix.IP.To16())
+	b = append(b, prefix...)
+
+	if len(ra.DNS) != 0 {
+		rdnss := make([]byte, 8)
+		rdnss[0], rdnss[1] = 25, byte(1+2*len(ra.DNS))
+		binary.BigEndian.PutUint32(rdnss[4:8], uint32(3*ra.Interval/time.Second))
+		for _, ip := range ra.DNS {
+			rdnss = append(rdnss, ip.To16()...)
+		}
+		b = append(b, rdnss...)
+	}
+	return b
+}
+
+// Run sends router advertisements every Interval and answers router solicitations until ctx is done
+func (ra *RouterAdvertiser) Run(ctx context.Context) error {
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	p := conn.IPv6PacketConn()
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := p.SetHopLimit(255); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := p.SetMulticastInterface(ra.Iface); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := p.JoinGroup(ra.Iface, &net.IPAddr{IP: AllRouters}); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		conn.Close()
+		return err
+	}
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := p.SetICMPFilter(&filter); err != nil {
+		conn.Close()
+		return err
+	}
+
+	solicited := make(chan struct{}, 1)
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			_, cm, _, err := p.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if cm != nil && cm.IfIndex != ra.Iface.Index {
+				continue
+			}
+			select {
+			case solicited <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	send := func() {
+		msg := icmp.Message{Type: ipv6.ICMPTypeRouterAdvertisement, Body: &icmp.RawBody{Data: ra.Marshal()}}
+		b, err := msg.Marshal(nil) // Kernel computes checksum of icmpv6 sockets
+		if err != nil {
+			log.Println("error marshaling router advertisement", err)
+			return
+		}
+		if _, err := p.WriteTo(b, &ipv6.ControlMessage{IfIndex: ra.Iface.Index}, &net.IPAddr{IP: AllNodes, Zone: ra.Iface.Name}); err != nil {
+			log.Println("error sending router advertisement", err)
+		}
+	}
+
+	ticker := time.NewTicker(ra.Interval)
+	defer ticker.Stop()
+	send()
+	for {
+		select {
+		case <-ticker.C:
+			send()
+		case <-solicited:
+			send()
+		case <-ctx.Done():
+			// Final advertisement with zero lifetimes tells clients to stop using the router
+			ra.RouterLifetime, ra.PreferredLifetime = 0, 0
+			send()
+			return conn.Close()
+		}
+	}
+}
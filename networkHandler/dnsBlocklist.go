@@ -0,0 +1,322 @@
+package networkHandler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type BlockMode int
+
+const (
+	BlockNXDomain BlockMode = iota // Blocked names don't exist
+	BlockZeroIP                    // Blocked names resolve to 0.0.0.0 and ::
+)
+
+// ParseBlockMode parses nxdomain or zero (0.0.0.0) block mode
+func ParseBlockMode(mode string) (BlockMode, error) {
+	switch strings.ToLower(mode) {
+	case "nxdomain":
+		return BlockNXDomain, nil
+	case "zero", "0.0.0.0":
+		return BlockZeroIP, nil
+	}
+	return 0, fmt.Errorf("unknown dns block mode %q", mode)
+}
+
+// Blocklist is the set of names blocked by one file
+// files may mix hosts file lines, plain domains and AdBlock rules
+type Blocklist struct {
+	Path    string
+	names   map[string]bool // Blocked exact names
+	zones   map[string]bool // Blocked names with their subdomains
+	wild    map[string]bool // Names whose subdomains are blocked (*.name)
+	allowed map[string]bool // AdBlock @@ exceptions, with their subdomains
+	hits    uint64
+	modTime time.Time
+}
+
+// LoadBlocklist reads blocklist file of path
+func LoadBlocklist(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	list := &Blocklist{
+		Path:    path,
+		names:   make(map[string]bool),
+		zones:   make(map[string]bool),
+		wild:    make(map[string]bool),
+		allowed: make(map[string]bool),
+		modTime: info.ModTime(),
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		list.addLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// addLine adds rule of one blocklist line, unknown rules are skipped
+func (l *Blocklist) addLine(line string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+	if strings.HasPrefix(line, "@@||") || strings.HasPrefix(line, "||") { // AdBlock rule
+		allow := strings.HasPrefix(line, "@@")
+		rule := strings.TrimPrefix(strings.TrimPrefix(line, "@@"), "||")
+		end := strings.IndexAny(rule, "^/$")
+		if end != -1 && rule[end] != '^' {
+			return // Path and option rules aren't about whole names
+		}
+		if end != -1 {
+			if rest := rule[end+1:]; len(rest) != 0 && !strings.HasPrefix(rest, "$important") {
+				return
+			}
+			rule = rule[:end]
+		}
+		if name := normalizeName(rule); len(name) != 0 {
+			if allow {
+				l.allowed[name] = true
+			} else {
+				l.zones[name] = true
+			}
+		}
+		return
+	}
+	if i := strings.IndexByte(line, '#'); i != -1 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil { // Hosts file line
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		if strings.HasPrefix(field, "*.") {
+			if name := normalizeName(field[2:]); len(name) != 0 {
+				l.wild[name] = true
+			}
+			continue
+		}
+		if name := normalizeName(field); len(name) != 0 && !isLocalHostName(name) {
+			l.names[name] = true
+		}
+	}
+}
+
+// blocks reports whether name (lowercase, no trailing dot) is blocked by list
+func (l *Blocklist) blocks(name string) bool {
+	if l.names[name] {
+		return !l.allowedName(name)
+	}
+	for zone := name; ; {
+		if l.zones[zone] || (zone != name && l.wild[zone]) {
+			return !l.allowedName(name)
+		}
+		i := strings.IndexByte(zone, '.')
+		if i == -1 {
+			return false
+		}
+		zone = zone[i+1:]
+	}
+}
+
+func (l *Blocklist) allowedName(name string) bool {
+	for zone := name; ; {
+		if l.allowed[zone] {
+			return true
+		}
+		i := strings.IndexByte(zone, '.')
+		if i == -1 {
+			return false
+		}
+		zone = zone[i+1:]
+	}
+}
+
+// Len returns number of rules in list
+func (l *Blocklist) Len() int {
+	return len(l.names) + len(l.zones) + len(l.wild)
+}
+
+// Hits returns number of queries blocked by list
+func (l *Blocklist) Hits() uint64 {
+	return atomic.LoadUint64(&l.hits)
+}
+
+// normalizeName returns name in lowercase without trailing dot, empty for invalid names
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if len(name) == 0 || net.ParseIP(name) != nil || strings.ContainsAny(name, "*/:|^$@") {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return ""
+	}
+	return name
+}
+
+func isLocalHostName(name string) bool {
+	switch name {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+		return true
+	}
+	return false
+}
+
+// DNSBlocker decides which queries are answered as blocked instead of forwarded
+type DNSBlocker struct {
+	Mode BlockMode
+
+	mu    sync.RWMutex
+	paths []string
+	lists []*Blocklist
+}
+
+// NewDNSBlocker loads blocklists of paths
+func NewDNSBlocker(mode BlockMode, paths ...string) (*DNSBlocker, error) {
+	b := &DNSBlocker{Mode: mode, paths: paths}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads all blocklist files again, hit counters are kept
+// lists stay unchanged when a file can't be read
+func (b *DNSBlocker) Reload() error {
+	lists := make([]*Blocklist, 0, len(b.paths))
+	for _, path := range b.paths {
+		list, err := LoadBlocklist(path)
+		if err != nil {
+			return err
+		}
+		lists = append(lists, list)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, list := range lists {
+		if i < len(b.lists) {
+			list.hits = atomic.LoadUint64(&b.lists[i].hits)
+		}
+		log.Printf("dns blocklist %s: %d names", list.Path, list.Len())
+	}
+	b.lists = lists
+	return nil
+}
+
+// Blocked returns the list blocking name, counting the hit
+func (b *DNSBlocker) Blocked(name string) (*Blocklist, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, list := range b.lists {
+		if list.blocks(name) {
+			atomic.AddUint64(&list.hits, 1)
+			return list, true
+		}
+	}
+	return nil, false
+}
+
+// Hits returns blocked queries by blocklist path
+func (b *DNSBlocker) Hits() map[string]uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	hits := make(map[string]uint64, len(b.lists))
+	for _, list := range b.lists {
+		hits[list.Path] = list.Hits()
+	}
+	return hits
+}
+
+// Watch reloads blocklists on SIGHUP or when a file changes, checked every interval, until ctx is done
+func (b *DNSBlocker) Watch(ctx context.Context, interval time.Duration) {
+	watchFiles(ctx, interval, "dns blocklists", b.changed, b.Reload)
+}
+
+// watchFiles calls reload on SIGHUP or when changed reports a modified file, checked every interval, until ctx is done
+func watchFiles(ctx context.Context, interval time.Duration, what string, changed func() bool, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			log.Println("reloading", what)
+		case <-ticker.C:
+			if !changed() {
+				continue
+			}
+			log.Println(what, "changed, reloading")
+		case <-ctx.Done():
+			return
+		}
+		if err := reload(); err != nil {
+			log.Println("error reloading", what, err)
+		}
+	}
+}
+
+// changed reports whether a blocklist file was modified since it was loaded
+func (b *DNSBlocker) changed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return listsChanged(b.lists)
+}
+
+// listsChanged reports whether a file of lists was modified since it was loaded
+func listsChanged(lists []*Blocklist) bool {
+	for _, list := range lists {
+		if info, err := os.Stat(list.Path); err == nil && !info.ModTime().Equal(list.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedReply returns answer to a query of a blocked name
+func (b *DNSBlocker) blockedReply(r *dns.Msg) *dns.Msg {
+	return blockedReply(r, b.Mode)
+}
+
+// blockedReply returns answer to a query r of a name blocked in mode
+func blockedReply(r *dns.Msg, mode BlockMode) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	if mode == BlockNXDomain {
+		msg.Rcode = dns.RcodeNameError
+		return msg
+	}
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch q.Qtype {
+	case dns.TypeA:
+		msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+	}
+	return msg
+}
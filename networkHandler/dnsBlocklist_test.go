@@ -0,0 +1,149 @@
+package networkHandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testBlocklist = `# hosts file
+0.0.0.0 ads.example.com tracker.example.com
+127.0.0.1 localhost
+::1 ip6-localhost
+plain.example.org # trailing comment
+*.wild.example.net
+! adblock
+[Adblock Plus 2.0]
+||adnet.example^
+||cdn.adnet.example^$third-party
+||example.io/banner.gif
+@@||good.adnet.example^
+`
+
+func writeBlocklist(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "dnsblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "blocklist.txt")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBlocklist(t *testing.T) {
+	list, err := LoadBlocklist(writeBlocklist(t, testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name string
+		want bool
+	}{
+		{"ads.example.com", true},
+		{"tracker.example.com", true},
+		{"sub.ads.example.com", false},
+		{"example.com", false},
+		{"localhost", false},
+		{"plain.example.org", true},
+		{"wild.example.net", false},
+		{"a.wild.example.net", true},
+		{"a.b.wild.example.net", true},
+		{"adnet.example", true},
+		{"x.adnet.example", true},
+		{"good.adnet.example", false},
+		{"x.good.adnet.example", false},
+		{"cdn.adnet.example", true},
+		{"example.io", false},
+	}
+	for _, test := range tests {
+		if got := list.blocks(test.name); got != test.want {
+			t.Errorf("blocks(%s)=%v", test.name, got)
+		}
+	}
+}
+
+func TestDNSBlocker(t *testing.T) {
+	path := writeBlocklist(t, testBlocklist)
+	blocker, err := NewDNSBlocker(BlockNXDomain, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, ok := blocker.Blocked("ADS.example.com."); !ok || list.Path != path {
+		t.Errorf("Blocked(ADS.example.com.)=%v %v", list, ok)
+	}
+	blocker.Blocked("adnet.example.")
+	blocker.Blocked("example.com.")
+	if hits := blocker.Hits()[path]; hits != 2 {
+		t.Errorf("Hits()=%d, want 2", hits)
+	}
+
+	later := time.Now().Add(time.Second)
+	if err := ioutil.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, later, later)
+	if !blocker.changed() {
+		t.Errorf("changed()=false after blocklist write")
+	}
+	if err := blocker.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blocker.Blocked("example.com."); !ok {
+		t.Errorf("Blocked(example.com.) after reload=false")
+	}
+	if hits := blocker.Hits()[path]; hits != 3 {
+		t.Errorf("Hits() after reload=%d, want hits kept", hits)
+	}
+	if _, err := NewDNSBlocker(BlockNXDomain, path+".missing"); err == nil {
+		t.Errorf("NewDNSBlocker() of missing file succeeded")
+	}
+}
+
+func TestDNSBlocker_blockedReply(t *testing.T) {
+	var tests = []struct {
+		mode    BlockMode
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{BlockNXDomain, dns.TypeA, dns.RcodeNameError, 0},
+		{BlockZeroIP, dns.TypeA, dns.RcodeSuccess, 1},
+		{BlockZeroIP, dns.TypeAAAA, dns.RcodeSuccess, 1},
+		{BlockZeroIP, dns.TypeMX, dns.RcodeSuccess, 0},
+	}
+	for _, test := range tests {
+		blocker := &DNSBlocker{Mode: test.mode}
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", test.qtype)
+		msg := blocker.blockedReply(req)
+		if msg.Rcode != test.rcode || len(msg.Answer) != test.answers {
+			t.Errorf("blockedReply(%v, %s)=%v", test.mode, dns.TypeToString[test.qtype], msg)
+		}
+	}
+}
+
+func TestParseBlockMode(t *testing.T) {
+	var tests = []struct {
+		mode string
+		want BlockMode
+		ok   bool
+	}{
+		{"nxdomain", BlockNXDomain, true},
+		{"NXDOMAIN", BlockNXDomain, true},
+		{"zero", BlockZeroIP, true},
+		{"0.0.0.0", BlockZeroIP, true},
+		{"refused", 0, false},
+	}
+	for _, test := range tests {
+		if got, err := ParseBlockMode(test.mode); got != test.want || (err == nil) != test.ok {
+			t.Errorf("ParseBlockMode(%s)=%v %v", test.mode, got, err)
+		}
+	}
+}
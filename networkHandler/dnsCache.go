@@ -0,0 +1,184 @@
+package networkHandler
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// prefetchHits is how many hits make an entry hot enough to be refreshed before it expires
+const prefetchHits = 3
+
+// CacheStats are counters of a DNSCache
+type CacheStats struct {
+	Entries    int    `json:"entries"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Negative   uint64 `json:"negative_hits"` // Hits answered with NXDOMAIN or NODATA
+	Evictions  uint64 `json:"evictions"`
+	Prefetches uint64 `json:"prefetches"`
+}
+
+type cacheKey struct {
+	name   string // Lowercase
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+// DNSCache keeps upstream answers until their ttl expires, negative answers as RFC 2308
+// the least recently used entry is evicted when Size entries are cached
+type DNSCache struct {
+	Size     int           // Max entries
+	MaxTTL   time.Duration // Upper bound of entry lifetime, no bound when zero
+	Prefetch bool          // Refresh hot entries shortly before they expire
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // Front is most recently used
+	stats   CacheStats
+}
+
+// NewDNSCache returns empty cache of size entries
+func NewDNSCache(size int) *DNSCache {
+	return &DNSCache{
+		Size:     size,
+		Prefetch: true,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// Get returns a copy of cached answer of q with ttls lowered by its age
+// prefetch tells whether the caller should refresh the entry now
+func (c *DNSCache) Get(q dns.Question, now time.Time) (msg *dns.Msg, prefetch bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[newCacheKey(q)]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+	c.stats.Hits++
+	if entry.msg.Rcode == dns.RcodeNameError || len(entry.msg.Answer) == 0 {
+		c.stats.Negative++
+	}
+
+	msg = entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				if hdr.Ttl > age {
+					hdr.Ttl -= age
+				} else {
+					hdr.Ttl = 0
+				}
+			}
+		}
+	}
+
+	lifetime := entry.expires.Sub(entry.stored)
+	if c.Prefetch && !entry.prefetching && entry.hits >= prefetchHits && entry.expires.Sub(now) < lifetime/10 {
+		entry.prefetching = true
+		c.stats.Prefetches++
+		prefetch = true
+	}
+	return msg, prefetch
+}
+
+// Put caches msg, answers without a ttl to respect aren't cached
+func (c *DNSCache) Put(msg *dns.Msg, now time.Time) {
+	if len(msg.Question) != 1 || msg.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	if c.MaxTTL > 0 && lifetime > c.MaxTTL {
+		lifetime = c.MaxTTL
+	}
+	key := newCacheKey(msg.Question[0])
+	entry := &cacheEntry{key: key, msg: msg.Copy(), stored: now, expires: now.Add(lifetime)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry.hits = elem.Value.(*cacheEntry).hits // Prefetched entries stay hot
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.Size > 0 && c.lru.Len() > c.Size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Stats returns counters of cache
+func (c *DNSCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// remove drops elem from cache, callers must hold c.mu
+func (c *DNSCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+	c.lru.Remove(elem)
+}
+
+// cacheTTL returns how long msg may be cached
+// positive answers live as long as their shortest ttl, negative answers as their SOA (RFC 2308)
+func cacheTTL(msg *dns.Msg) (uint32, bool) {
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) != 0:
+		ttl, found := uint32(0), false
+		for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+			for _, rr := range section {
+				if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && (!found || hdr.Ttl < ttl) {
+					ttl, found = hdr.Ttl, true
+				}
+			}
+		}
+		return ttl, found
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError: // NODATA or NXDOMAIN
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Minttl < soa.Hdr.Ttl {
+					return soa.Minttl, true
+				}
+				return soa.Hdr.Ttl, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,182 @@
+package networkHandler
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testAnswer(name string, qtype uint16, records ...string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			panic(err)
+		}
+		if _, ok := rr.(*dns.SOA); ok {
+			msg.Ns = append(msg.Ns, rr)
+		} else {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg
+}
+
+func TestDNSCache_TTL(t *testing.T) {
+	cache := NewDNSCache(10)
+	now := time.Now()
+	cache.Put(testAnswer("example.com.", dns.TypeA,
+		"example.com. 300 IN A 192.0.2.1", "example.com. 100 IN A 192.0.2.2"), now)
+
+	msg, _ := cache.Get(dns.Question{Name: "EXAMPLE.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, now.Add(40*time.Second))
+	if msg == nil || msg.Answer[0].Header().Ttl != 260 || msg.Answer[1].Header().Ttl != 60 {
+		t.Fatalf("Get() after 40s=%v, want ttls lowered by 40", msg)
+	}
+	if msg, _ := cache.Get(dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, now); msg != nil {
+		t.Errorf("Get(AAAA)=%v, want miss of other type", msg)
+	}
+	if msg, _ := cache.Get(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, now.Add(100*time.Second)); msg != nil {
+		t.Errorf("Get() after shortest ttl=%v, want expired", msg)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 0 {
+		t.Errorf("Stats()=%+v", stats)
+	}
+}
+
+func TestDNSCache_Negative(t *testing.T) {
+	const soa = "example.com. 3600 IN SOA ns.example.com. host.example.com. 1 7200 900 1209600 60"
+	nxdomain := testAnswer("nx.example.com.", dns.TypeA, soa)
+	nxdomain.Rcode = dns.RcodeNameError
+	servfail := testAnswer("fail.example.com.", dns.TypeA, soa)
+	servfail.Rcode = dns.RcodeServerFailure
+	var tests = []struct {
+		msg *dns.Msg
+		ttl time.Duration
+	}{
+		{nxdomain, 60 * time.Second},
+		{testAnswer("nodata.example.com.", dns.TypeAAAA, "example.com. 30 IN SOA ns.example.com. host.example.com. 1 7200 900 1209600 600"), 30 * time.Second},
+		{testAnswer("nosoa.example.com.", dns.TypeA), 0},
+		{servfail, 0},
+	}
+
+	for _, test := range tests {
+		cache := NewDNSCache(10)
+		now := time.Now()
+		cache.Put(test.msg, now)
+		q := test.msg.Question[0]
+		before, _ := cache.Get(q, now.Add(test.ttl-time.Second))
+		after, _ := cache.Get(q, now.Add(test.ttl))
+		if test.ttl != 0 && (before == nil || before.Rcode != test.msg.Rcode || after != nil) {
+			t.Errorf("Get(%s) around %v=%v %v, want cached for negative ttl", q.Name, test.ttl, before, after)
+		}
+		if test.ttl == 0 && before != nil {
+			t.Errorf("Get(%s)=%v, want not cached", q.Name, before)
+		}
+	}
+}
+
+func TestDNSCache_LRU(t *testing.T) {
+	cache := NewDNSCache(3)
+	now := time.Now()
+	question := func(i int) dns.Question {
+		return dns.Question{Name: fmt.Sprintf("host%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+	for i := 0; i < 3; i++ {
+		cache.Put(testAnswer(question(i).Name, dns.TypeA, question(i).Name+" 300 IN A 192.0.2.1"), now)
+	}
+	cache.Get(question(0), now) // host0 is used, host1 is least recently used
+	cache.Put(testAnswer(question(3).Name, dns.TypeA, question(3).Name+" 300 IN A 192.0.2.1"), now)
+
+	for i, want := range []bool{true, false, true, true} {
+		if msg, _ := cache.Get(question(i), now); (msg != nil) != want {
+			t.Errorf("Get(%s) cached=%v, want %v", question(i).Name, msg != nil, want)
+		}
+	}
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Entries != 3 {
+		t.Errorf("Stats()=%+v", stats)
+	}
+}
+
+func TestDNSCache_Prefetch(t *testing.T) {
+	cache := NewDNSCache(10)
+	now := time.Now()
+	cache.Put(testAnswer("hot.example.com.", dns.TypeA, "hot.example.com. 100 IN A 192.0.2.1"), now)
+	q := dns.Question{Name: "hot.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for i := 0; i < prefetchHits; i++ {
+		if _, prefetch := cache.Get(q, now.Add(10*time.Second)); prefetch {
+			t.Errorf("Get() early in ttl asked for prefetch")
+		}
+	}
+	if _, prefetch := cache.Get(q, now.Add(95*time.Second)); !prefetch {
+		t.Errorf("Get() of hot entry near expiry didn't ask for prefetch")
+	}
+	if _, prefetch := cache.Get(q, now.Add(96*time.Second)); prefetch {
+		t.Errorf("Get() asked for prefetch twice")
+	}
+}
+
+func TestDNSHandler_Cache(t *testing.T) {
+	var queries int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	})
+	handler := &DNSHandler{Upstreams: testUpstreams(t, upstream, time.Second), Cache: NewDNSCache(10)}
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := newUDPWriter()
+		handler.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Id != req.Id || len(w.msg.Answer) != 1 {
+			t.Fatalf("ServeDNS() %d=%v", i, w.msg)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+}
+
+func TestDNSHandler_CacheDO(t *testing.T) {
+	var queries int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		if opt := r.IsEdns0(); opt != nil && opt.Do() {
+			sig, _ := dns.NewRR(r.Question[0].Name + " 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA")
+			msg.Answer = append(msg.Answer, sig)
+		}
+		w.WriteMsg(msg)
+	})
+	handler := &DNSHandler{Upstreams: testUpstreams(t, upstream, time.Second), Cache: NewDNSCache(10)}
+	// The first client doesn't ask for DNSSEC records, the cached answer keeps them for the second
+	for _, do := range []bool{false, true, false} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(1232, do)
+		w := newUDPWriter()
+		handler.ServeDNS(w, req)
+		want := 1
+		if do {
+			want = 2
+		}
+		if w.msg == nil || len(w.msg.Answer) != want {
+			t.Errorf("ServeDNS(DO %v)=%v, want %d records", do, w.msg, want)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+}
@@ -0,0 +1,115 @@
+package networkHandler
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// neighborTime is how long a mac found in the neighbor table is used for an ipv6 address
+const neighborTime = time.Minute
+
+// DNSClient is a dhcp client asking the dns server
+type DNSClient struct {
+	MAC   string // Lowercase mac address
+	Class string // Device class of dhcp fingerprint
+}
+
+// DNSClients maps addresses of clients to their dhcp lease, fed by lease events
+// ipv6 addresses are joined to the lease of their mac in the neighbor table
+type DNSClients struct {
+	Neighbor func(ip net.IP) (net.HardwareAddr, bool) // Optional mac of an ipv6 address, like IPv6Neighbor
+
+	mu        sync.RWMutex
+	byIP      map[string]DNSClient
+	byMAC     map[string]DNSClient
+	neighbors map[string]neighbor // Macs of ipv6 addresses found by Neighbor
+}
+
+// neighbor is a mac of the neighbor table
+type neighbor struct {
+	mac     string
+	expires time.Time
+}
+
+// NewDNSClients returns empty client table
+func NewDNSClients() *DNSClients {
+	return &DNSClients{byIP: make(map[string]DNSClient), byMAC: make(map[string]DNSClient), neighbors: make(map[string]neighbor)}
+}
+
+// Set joins later queries of ip to client
+func (c *DNSClients) Set(ip net.IP, client DNSClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byIP[ip.String()] = client
+	c.byMAC[client.MAC] = client
+}
+
+// Remove forgets client of ip
+func (c *DNSClients) Remove(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.byIP[ip.String()]; ok {
+		delete(c.byMAC, client.MAC)
+	}
+	delete(c.byIP, ip.String())
+}
+
+// Lookup returns client of ip
+func (c *DNSClients) Lookup(ip net.IP) (DNSClient, bool) {
+	c.mu.RLock()
+	client, ok := c.byIP[ip.String()]
+	n, known := c.neighbors[ip.String()]
+	c.mu.RUnlock()
+	if ok || ip.To4() != nil || c.Neighbor == nil {
+		return client, ok
+	}
+	if !known || time.Now().After(n.expires) {
+		mac, found := c.Neighbor(ip)
+		if !found {
+			return client, false
+		}
+		n = neighbor{mac: mac.String(), expires: time.Now().Add(neighborTime)}
+		c.mu.Lock()
+		c.neighbors[ip.String()] = n
+		c.mu.Unlock()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	client, ok = c.byMAC[n.mac]
+	return client, ok
+}
+
+// IPv6Neighbor returns mac of ip in the neighbor table of iface
+func IPv6Neighbor(iface string, ip net.IP) (net.HardwareAddr, bool) {
+	output, err := exec.Command("ip", "-6", "neigh", "show", ip.String(), "dev", iface).Output()
+	if err != nil {
+		return nil, false
+	}
+	return parseNeighbor(string(output))
+}
+
+// parseNeighbor returns lladdr of ip neigh output, entries still resolving have none
+func parseNeighbor(output string) (net.HardwareAddr, bool) {
+	fields := strings.Fields(output)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "lladdr" {
+			mac, err := net.ParseMAC(fields[i+1])
+			return mac, err == nil
+		}
+	}
+	return nil, false
+}
+
+// addrIP returns ip of a udp or tcp address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package networkHandler
+
+import "testing"
+
+func TestParseNeighbor(t *testing.T) {
+	var tests = []struct {
+		output string
+		mac    string
+	}{
+		{"fd00::10 lladdr aa:bb:cc:dd:ee:01 STALE\n", "aa:bb:cc:dd:ee:01"},
+		{"fd00::10 lladdr aa:bb:cc:dd:ee:01 router REACHABLE\n", "aa:bb:cc:dd:ee:01"},
+		{"fd00::10 INCOMPLETE\n", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		mac, ok := parseNeighbor(test.output)
+		if ok != (len(test.mac) != 0) || mac.String() != test.mac {
+			t.Errorf("parseNeighbor(%q)=%v, %v", test.output, mac, ok)
+		}
+	}
+}
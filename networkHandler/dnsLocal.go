@@ -0,0 +1,208 @@
+package networkHandler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// localHost is a client name of the local zone
+type localHost struct {
+	mac string
+	ip  net.IP
+}
+
+// LocalZone answers authoritatively for names of AP clients under Domain and for reverse names of Subnet
+// hosts are added from dhcp leases and removed when the lease ends
+type LocalZone struct {
+	Domain string     // Fqdn of the zone, e.g. ap.lan.
+	Subnet *net.IPNet // Addresses whose PTR records are answered locally
+	TTL    uint32
+
+	mu    sync.RWMutex
+	hosts map[string]localHost // Fqdn of hosts
+	macs  map[string]string    // Fqdn by client mac
+	ptrs  map[string]string    // Fqdn by ip
+}
+
+// NewLocalZone returns empty zone of domain for subnet
+func NewLocalZone(domain string, subnet *net.IPNet) (*LocalZone, error) {
+	name := normalizeName(domain)
+	if len(name) == 0 {
+		return nil, fmt.Errorf("invalid local domain %q", domain)
+	}
+	return &LocalZone{
+		Domain: dns.Fqdn(name),
+		Subnet: subnet,
+		TTL:    60,
+		hosts:  make(map[string]localHost),
+		macs:   make(map[string]string),
+		ptrs:   make(map[string]string),
+	}, nil
+}
+
+// Add makes hostname of client mac resolve to ip, replacing older records of the client
+// a name already used by another client is kept by that client
+func (z *LocalZone) Add(mac net.HardwareAddr, hostname string, ip net.IP) error {
+	label := hostLabel(hostname)
+	if len(label) == 0 {
+		return fmt.Errorf("no valid dns name in hostname %q", hostname)
+	}
+	name := label + "." + z.Domain
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if host, ok := z.hosts[name]; ok && host.mac != mac.String() {
+		return fmt.Errorf("%s is already used by %s", name, host.mac)
+	}
+	z.remove(mac.String())
+	z.hosts[name] = localHost{mac: mac.String(), ip: append(net.IP(nil), ip...)}
+	z.macs[mac.String()] = name
+	z.ptrs[ip.String()] = name
+	return nil
+}
+
+// Remove drops records of client mac
+func (z *LocalZone) Remove(mac net.HardwareAddr) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.remove(mac.String())
+}
+
+// Update adds or removes client records of a dhcp lease event, granted tells whether the lease is held
+func (z *LocalZone) Update(granted bool, mac net.HardwareAddr, hostname string, ip net.IP) {
+	if !granted {
+		z.Remove(mac)
+		return
+	}
+	if len(hostname) == 0 {
+		z.Remove(mac) // Client may have dropped its name
+		return
+	}
+	if err := z.Add(mac, hostname, ip); err != nil {
+		log.Println("local dns", err)
+	}
+}
+
+// remove drops records of mac, callers must hold z.mu
+func (z *LocalZone) remove(mac string) {
+	name, ok := z.macs[mac]
+	if !ok {
+		return
+	}
+	if ip := z.hosts[name].ip.String(); z.ptrs[ip] == name {
+		delete(z.ptrs, ip)
+	}
+	delete(z.hosts, name)
+	delete(z.macs, mac)
+}
+
+// Hosts returns addresses of zone names
+func (z *LocalZone) Hosts() map[string]net.IP {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	hosts := make(map[string]net.IP, len(z.hosts))
+	for name, host := range z.hosts {
+		hosts[name] = host.ip
+	}
+	return hosts
+}
+
+// Answer returns authoritative answer to r, ok is false when r isn't about the zone
+func (z *LocalZone) Answer(r *dns.Msg) (msg *dns.Msg, ok bool) {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	msg = new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	switch {
+	case dns.IsSubDomain(z.Domain, name):
+		z.mu.RLock()
+		host, found := z.hosts[name]
+		z.mu.RUnlock()
+		switch {
+		case name == z.Domain && q.Qtype == dns.TypeSOA:
+			msg.Answer = append(msg.Answer, z.soa())
+		case found && q.Qtype == dns.TypeA && host.ip.To4() != nil:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: z.header(q.Name, dns.TypeA), A: host.ip})
+		case found && q.Qtype == dns.TypeAAAA && host.ip.To4() == nil:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: z.header(q.Name, dns.TypeAAAA), AAAA: host.ip})
+		case !found && name != z.Domain:
+			msg.Rcode = dns.RcodeNameError
+		}
+	case q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY:
+		ip := reverseIP(name)
+		if ip == nil || z.Subnet == nil || !z.Subnet.Contains(ip) {
+			return nil, false
+		}
+		z.mu.RLock()
+		target, found := z.ptrs[ip.String()]
+		z.mu.RUnlock()
+		if !found {
+			msg.Rcode = dns.RcodeNameError
+		} else if q.Qtype == dns.TypePTR {
+			msg.Answer = append(msg.Answer, &dns.PTR{Hdr: z.header(q.Name, dns.TypePTR), Ptr: target})
+		}
+	default:
+		return nil, false
+	}
+	if len(msg.Answer) == 0 {
+		msg.Ns = append(msg.Ns, z.soa())
+	}
+	return msg, true
+}
+
+func (z *LocalZone) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: z.TTL}
+}
+
+// soa returns SOA record of the zone for negative answers
+func (z *LocalZone) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     z.header(z.Domain, dns.TypeSOA),
+		Ns:      z.Domain,
+		Mbox:    "hostmaster." + z.Domain,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  z.TTL,
+	}
+}
+
+// hostLabel turns dhcp hostname into a dns label, only its first label is used
+// invalid characters become dashes, empty when nothing valid is left
+func hostLabel(hostname string) string {
+	if i := strings.IndexByte(hostname, '.'); i != -1 {
+		hostname = hostname[:i]
+	}
+	label := []byte(strings.ToLower(hostname))
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			label[i] = '-'
+		}
+	}
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return strings.Trim(string(label), "-")
+}
+
+// reverseIP returns ipv4 address of a full in-addr.arpa name, nil for other names
+func reverseIP(name string) net.IP {
+	const suffix = ".in-addr.arpa."
+	if !strings.HasSuffix(name, suffix) {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	if len(labels) != 4 {
+		return nil
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return net.ParseIP(strings.Join(labels, ".")).To4()
+}
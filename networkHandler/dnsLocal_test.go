@@ -0,0 +1,130 @@
+package networkHandler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestZone(t *testing.T) *LocalZone {
+	_, subnet, _ := net.ParseCIDR("192.168.100.0/24")
+	zone, err := NewLocalZone("AP.lan", subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+func zoneQuery(zone *LocalZone, name string, qtype uint16) (*dns.Msg, bool) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return zone.Answer(req)
+}
+
+func TestHostLabel(t *testing.T) {
+	var tests = []struct {
+		hostname string
+		label    string
+	}{
+		{"laptop", "laptop"},
+		{"Johns-iPhone", "johns-iphone"},
+		{"laptop.home", "laptop"},
+		{"my pc_2", "my-pc-2"},
+		{"--", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if label := hostLabel(test.hostname); label != test.label {
+			t.Errorf("hostLabel(%s)=%s, want %s", test.hostname, label, test.label)
+		}
+	}
+}
+
+func TestLocalZone(t *testing.T) {
+	zone := newTestZone(t)
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	other, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
+	if err := zone.Add(mac, "Laptop", net.IPv4(192, 168, 100, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zone.Add(other, "laptop", net.IPv4(192, 168, 100, 11)); err == nil {
+		t.Errorf("Add() of a name used by another client succeeded")
+	}
+
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		ok     bool
+		rcode  int
+		answer string
+	}{
+		{"laptop.ap.lan.", dns.TypeA, true, dns.RcodeSuccess, "192.168.100.10"},
+		{"LAPTOP.ap.lan.", dns.TypeA, true, dns.RcodeSuccess, "192.168.100.10"},
+		{"laptop.ap.lan.", dns.TypeAAAA, true, dns.RcodeSuccess, ""},
+		{"phone.ap.lan.", dns.TypeA, true, dns.RcodeNameError, ""},
+		{"ap.lan.", dns.TypeA, true, dns.RcodeSuccess, ""},
+		{"10.100.168.192.in-addr.arpa.", dns.TypePTR, true, dns.RcodeSuccess, "laptop.ap.lan."},
+		{"11.100.168.192.in-addr.arpa.", dns.TypePTR, true, dns.RcodeNameError, ""},
+		{"10.0.0.10.in-addr.arpa.", dns.TypePTR, false, 0, ""},
+		{"example.com.", dns.TypeA, false, 0, ""},
+	}
+	for _, test := range tests {
+		msg, ok := zoneQuery(zone, test.name, test.qtype)
+		if ok != test.ok {
+			t.Errorf("Answer(%s)=%v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		answer := ""
+		switch rr := firstRR(msg).(type) {
+		case *dns.A:
+			answer = rr.A.String()
+		case *dns.PTR:
+			answer = rr.Ptr
+		}
+		if !msg.Authoritative || msg.Rcode != test.rcode || answer != test.answer {
+			t.Errorf("Answer(%s)=%v", test.name, msg)
+		}
+		if len(msg.Answer) == 0 && len(msg.Ns) != 1 {
+			t.Errorf("Answer(%s) negative answer without SOA", test.name)
+		}
+	}
+
+	zone.Update(true, mac, "desktop", net.IPv4(192, 168, 100, 12))
+	if msg, _ := zoneQuery(zone, "laptop.ap.lan.", dns.TypeA); msg.Rcode != dns.RcodeNameError {
+		t.Errorf("old name of renamed client still resolves")
+	}
+	if msg, _ := zoneQuery(zone, "10.100.168.192.in-addr.arpa.", dns.TypePTR); msg.Rcode != dns.RcodeNameError {
+		t.Errorf("old address of renamed client still resolves")
+	}
+	zone.Update(false, mac, "desktop", net.IPv4(192, 168, 100, 12))
+	if hosts := zone.Hosts(); len(hosts) != 0 {
+		t.Errorf("Hosts()=%v after release, want none", hosts)
+	}
+}
+
+func TestDNSHandler_LocalZone(t *testing.T) {
+	zone := newTestZone(t)
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	zone.Add(mac, "laptop", net.IPv4(192, 168, 100, 10))
+	handler := &DNSHandler{Upstreams: testUpstreams(t, deadUpstream(t), 50*time.Millisecond), Zone: zone}
+
+	w := newUDPWriter()
+	req := new(dns.Msg)
+	req.SetQuestion("laptop.ap.lan.", dns.TypeA)
+	handler.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Id != req.Id || len(w.msg.Answer) != 1 {
+		t.Errorf("ServeDNS(laptop.ap.lan.)=%v, want local answer", w.msg)
+	}
+}
+
+func firstRR(msg *dns.Msg) dns.RR {
+	if len(msg.Answer) == 0 {
+		return nil
+	}
+	return msg.Answer[0]
+}
@@ -0,0 +1,216 @@
+package networkHandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// safeSearchHosts maps search engine names to names which enforce safe search
+var safeSearchHosts = map[string]string{
+	"www.bing.com":             "strict.bing.com",
+	"duckduckgo.com":           "safe.duckduckgo.com",
+	"www.duckduckgo.com":       "safe.duckduckgo.com",
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+// safeSearchTarget returns safe search name of search engine name (lowercase, no trailing dot), empty for other names
+func safeSearchTarget(name string) string {
+	if target, ok := safeSearchHosts[name]; ok {
+		return target
+	}
+	if tld := strings.TrimPrefix(strings.TrimPrefix(name, "www."), "google."); tld != name && len(tld) != 0 && strings.Count(tld, ".") < 2 {
+		return "forcesafesearch.google.com" // google.com, www.google.de, www.google.co.uk
+	}
+	return ""
+}
+
+// DNSPolicy is a filter of dns queries of some clients
+type DNSPolicy struct {
+	Name       string
+	MACs       []string     // Client macs, with macs of groups of the policy
+	Classes    []string     // Device classes of dhcp fingerprints
+	SafeSearch bool         // Search engines resolve to their safe search names
+	Blocklists []*Blocklist // Names blocked for clients of policy
+	Allowlists []*Blocklist // When set, only names in these lists resolve
+}
+
+// policyFile is the json form of a policy file
+type policyFile struct {
+	Groups   map[string][]string `json:"groups"` // Client macs by group name
+	Policies []policyConfig      `json:"policies"`
+}
+
+// policyConfig is the json form of DNSPolicy
+type policyConfig struct {
+	Name       string   `json:"name"`
+	MACs       []string `json:"macs"`
+	Groups     []string `json:"groups"`
+	Classes    []string `json:"classes"`
+	SafeSearch bool     `json:"safe_search"`
+	Blocklists []string `json:"blocklists"`
+	Allowlists []string `json:"allowlists"`
+}
+
+// LoadDNSPolicies reads policies and their lists from a json file
+func LoadDNSPolicies(path string) ([]*DNSPolicy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file policyFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	policies := make([]*DNSPolicy, 0, len(file.Policies))
+	for _, c := range file.Policies {
+		policy := &DNSPolicy{Name: c.Name, Classes: c.Classes, SafeSearch: c.SafeSearch}
+		macs := c.MACs
+		for _, group := range c.Groups {
+			members, ok := file.Groups[group]
+			if !ok {
+				return nil, fmt.Errorf("%s: policy %q: unknown group %q", path, c.Name, group)
+			}
+			macs = append(macs, members...)
+		}
+		for _, mac := range macs {
+			hwAddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return nil, fmt.Errorf("%s: policy %q: %v", path, c.Name, err)
+			}
+			policy.MACs = append(policy.MACs, hwAddr.String())
+		}
+		for _, listPath := range c.Blocklists {
+			list, err := LoadBlocklist(listPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: policy %q: %v", path, c.Name, err)
+			}
+			policy.Blocklists = append(policy.Blocklists, list)
+		}
+		for _, listPath := range c.Allowlists {
+			list, err := LoadBlocklist(listPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: policy %q: %v", path, c.Name, err)
+			}
+			policy.Allowlists = append(policy.Allowlists, list)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// Matches reports whether client belongs to policy
+func (p *DNSPolicy) Matches(client DNSClient) bool {
+	for _, mac := range p.MACs {
+		if len(client.MAC) != 0 && mac == client.MAC {
+			return true
+		}
+	}
+	for _, class := range p.Classes {
+		if len(client.Class) != 0 && strings.EqualFold(class, client.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks reports whether policy blocks name (lowercase, no trailing dot)
+func (p *DNSPolicy) blocks(name string) bool {
+	for _, list := range p.Blocklists {
+		if list.blocks(name) {
+			return true
+		}
+	}
+	if len(p.Allowlists) == 0 {
+		return false
+	}
+	for _, list := range p.Allowlists {
+		if list.blocks(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// DNSPolicies picks the policy of a client from a policy file, clients without policy get the default filtering
+type DNSPolicies struct {
+	Path string
+	Mode BlockMode // Answer of names blocked by policies
+
+	mu       sync.RWMutex
+	policies []*DNSPolicy
+	modTime  time.Time
+}
+
+// NewDNSPolicies loads policy file of path
+func NewDNSPolicies(path string, mode BlockMode) (*DNSPolicies, error) {
+	p := &DNSPolicies{Path: path, Mode: mode}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads policy file and its lists again, policies stay unchanged when a file can't be read
+func (p *DNSPolicies) Reload() error {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+	policies, err := LoadDNSPolicies(p.Path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, policy := range policies {
+		log.Printf("dns policy %s: %d macs, %d classes, %d blocklists, %d allowlists, safe search %v", policy.Name,
+			len(policy.MACs), len(policy.Classes), len(policy.Blocklists), len(policy.Allowlists), policy.SafeSearch)
+	}
+	p.policies = policies
+	p.modTime = info.ModTime()
+	return nil
+}
+
+// For returns first policy matching client, nil when none does
+func (p *DNSPolicies) For(client DNSClient) *DNSPolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, policy := range p.policies {
+		if policy.Matches(client) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// Watch reloads policies on SIGHUP or when the policy file or one of its lists changes, until ctx is done
+func (p *DNSPolicies) Watch(ctx context.Context, interval time.Duration) {
+	watchFiles(ctx, interval, "dns policies", p.changed, p.Reload)
+}
+
+// changed reports whether policy file or a list of it was modified since it was loaded
+func (p *DNSPolicies) changed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if info, err := os.Stat(p.Path); err == nil && !info.ModTime().Equal(p.modTime) {
+		return true
+	}
+	for _, policy := range p.policies {
+		if listsChanged(policy.Blocklists) || listsChanged(policy.Allowlists) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package networkHandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func writePolicies(t *testing.T, path, adult, iot string) {
+	content := fmt.Sprintf(`{
+	"groups": {"kids": ["AA:BB:CC:DD:EE:01"]},
+	"policies": [
+		{"name": "kids", "groups": ["kids"], "safe_search": true, "blocklists": [%q]},
+		{"name": "iot", "classes": ["iot"], "allowlists": [%q]}
+	]
+}`, adult, iot)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafeSearchTarget(t *testing.T) {
+	var tests = []struct {
+		name   string
+		target string
+	}{
+		{"www.google.com", "forcesafesearch.google.com"},
+		{"google.de", "forcesafesearch.google.com"},
+		{"www.google.co.uk", "forcesafesearch.google.com"},
+		{"mail.google.com", ""},
+		{"www.youtube.com", "restrict.youtube.com"},
+		{"www.bing.com", "strict.bing.com"},
+		{"duckduckgo.com", "safe.duckduckgo.com"},
+		{"example.com", ""},
+	}
+	for _, test := range tests {
+		if target := safeSearchTarget(test.name); target != test.target {
+			t.Errorf("safeSearchTarget(%s)=%s, want %s", test.name, target, test.target)
+		}
+	}
+}
+
+func TestDNSPolicies(t *testing.T) {
+	adult := writeBlocklist(t, "adult.example.com\n")
+	iot := writeBlocklist(t, "||vendor.example^\n")
+	path := writeBlocklist(t, "")
+	writePolicies(t, path, adult, iot)
+	policies, err := NewDNSPolicies(path, BlockNXDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	})
+	clients := NewDNSClients()
+	clients.Set(net.IPv4(192, 168, 100, 10), DNSClient{MAC: "aa:bb:cc:dd:ee:01"})
+	clients.Set(net.IPv4(192, 168, 100, 11), DNSClient{MAC: "aa:bb:cc:dd:ee:02", Class: "IoT"})
+	clients.Set(net.IPv4(192, 168, 100, 12), DNSClient{MAC: "aa:bb:cc:dd:ee:03"})
+	clients.Neighbor = func(ip net.IP) (net.HardwareAddr, bool) {
+		if ip.Equal(net.ParseIP("fd00::10")) {
+			return net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}, true
+		}
+		return nil, false
+	}
+	handler := &DNSHandler{Upstreams: testUpstreams(t, upstream, time.Second), Clients: clients, Policies: policies}
+
+	var tests = []struct {
+		client string
+		name   string
+		rcode  int
+		cname  string
+	}{
+		{"192.168.100.10", "adult.example.com.", dns.RcodeNameError, ""},
+		{"192.168.100.10", "www.google.com.", dns.RcodeSuccess, "forcesafesearch.google.com."},
+		{"192.168.100.10", "example.com.", dns.RcodeSuccess, ""},
+		{"192.168.100.11", "api.vendor.example.", dns.RcodeSuccess, ""},
+		{"192.168.100.11", "example.com.", dns.RcodeNameError, ""},
+		{"192.168.100.12", "adult.example.com.", dns.RcodeSuccess, ""},
+		{"192.168.100.12", "www.google.com.", dns.RcodeSuccess, ""},
+		{"fd00::10", "adult.example.com.", dns.RcodeNameError, ""},
+		{"fd00::10", "www.google.com.", dns.RcodeSuccess, "forcesafesearch.google.com."},
+		{"fd00::11", "example.com.", dns.RcodeRefused, ""},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(test.client), Port: 5000}}
+		handler.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != test.rcode {
+			t.Errorf("ServeDNS(%s, %s)=%v", test.client, test.name, w.msg)
+			continue
+		}
+		cname := ""
+		if len(w.msg.Answer) != 0 {
+			if rr, ok := w.msg.Answer[0].(*dns.CNAME); ok {
+				cname = rr.Target
+			}
+		}
+		if cname != test.cname || (test.rcode == dns.RcodeSuccess && len(w.msg.Answer) == 0) {
+			t.Errorf("ServeDNS(%s, %s)=%v, want cname %q", test.client, test.name, w.msg, test.cname)
+		}
+	}
+
+	writePolicies(t, path, iot, adult) // Swap lists
+	if err := policies.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	kids := policies.For(DNSClient{MAC: "aa:bb:cc:dd:ee:01"})
+	if kids == nil || kids.blocks("adult.example.com") || !kids.blocks("www.vendor.example") {
+		t.Errorf("kids policy after reload=%+v", kids)
+	}
+	if policy := policies.For(DNSClient{MAC: "aa:bb:cc:dd:ee:03"}); policy != nil {
+		t.Errorf("For(guest)=%+v, want default", policy)
+	}
+}
+
+func TestLoadDNSPolicies_UnknownGroup(t *testing.T) {
+	path := writeBlocklist(t, `{"policies": [{"name": "kids", "groups": ["kids"]}]}`)
+	if _, err := LoadDNSPolicies(path); err == nil {
+		t.Errorf("LoadDNSPolicies() with unknown group succeeded")
+	}
+}
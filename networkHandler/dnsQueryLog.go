@@ -0,0 +1,179 @@
+package networkHandler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answer sources of queries which weren't forwarded
+const (
+	SourceCache    = "cache"
+	SourceLocal    = "local"
+	SourceOverride = "override"
+	SourceBlocked  = "blocked"
+)
+
+// QueryLogEntry is one query of a client
+type QueryLogEntry struct {
+	Seq       uint64        `json:"seq"`  // Number of the entry in the log, from 1 in order of Add
+	Time      time.Time     `json:"time"` // Start of the query, entries are added when answered
+	ClientIP  string        `json:"client_ip"`
+	ClientMAC string        `json:"client_mac,omitempty"`
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Rcode     string        `json:"rcode"`
+	Upstream  string        `json:"upstream"` // Upstream which answered, or cache, local, override or blocked
+	Policy    string        `json:"policy,omitempty"`
+	Latency   time.Duration `json:"latency"`
+}
+
+// Matches reports whether entry is of client, given as mac or ip
+func (e *QueryLogEntry) Matches(client string) bool {
+	if len(client) == 0 {
+		return true
+	}
+	if mac, err := net.ParseMAC(client); err == nil {
+		return strings.EqualFold(e.ClientMAC, mac.String())
+	}
+	if ip := net.ParseIP(client); ip != nil {
+		return ip.Equal(net.ParseIP(e.ClientIP))
+	}
+	return false
+}
+
+// QueryLog keeps the last Size queries in memory and optionally appends every query to a JSON lines file
+type QueryLog struct {
+	Size int
+
+	mu      sync.Mutex
+	entries []QueryLogEntry // Ring buffer, next is the oldest entry once full
+	next    int
+	seq     uint64 // Number of the last entry
+	file    *os.File
+}
+
+// NewQueryLog returns query log of size entries, queries are appended to path too unless it's empty
+func NewQueryLog(size int, path string) (*QueryLog, error) {
+	l := &QueryLog{Size: size}
+	if len(path) != 0 {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+	}
+	return l, nil
+}
+
+// Add records entry with the next number
+func (l *QueryLog) Add(entry QueryLogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	entry.Seq = l.seq
+	if l.Size > 0 {
+		if len(l.entries) < l.Size {
+			l.entries = append(l.entries, entry)
+		} else {
+			l.entries[l.next] = entry
+			l.next = (l.next + 1) % l.Size
+		}
+	}
+	if l.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// Entries returns kept entries of client (mac or ip, all clients when empty), oldest first
+func (l *QueryLog) Entries(client string) []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]QueryLogEntry, 0, len(l.entries))
+	for i := range l.entries {
+		entry := l.entries[(l.next+i)%len(l.entries)]
+		if entry.Matches(client) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Close closes the JSON lines file
+func (l *QueryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// WriteQueryLog replaces JSON lines file of path with entries atomically
+func WriteQueryLog(path string, entries []QueryLogEntry) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadQueryLog reads JSON lines file of path, lines which can't be parsed are skipped
+func ReadQueryLog(path string) ([]QueryLogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []QueryLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry QueryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// EntriesAfter returns entries of a query file added after the entry numbered seq
+// a file appended by several runs is numbered from 1 by each, only entries of the last run are returned
+// a newest entry numbered below seq means the log was restarted, all entries of its run are new then
+func EntriesAfter(entries []QueryLogEntry, seq uint64) []QueryLogEntry {
+	if len(entries) != 0 && entries[len(entries)-1].Seq < seq {
+		seq = 0
+	}
+	i := len(entries)
+	for i > 0 && entries[i-1].Seq > seq && (i == len(entries) || entries[i-1].Seq < entries[i].Seq) {
+		i--
+	}
+	return entries[i:]
+}
@@ -0,0 +1,122 @@
+package networkHandler
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	queryLog, err := NewQueryLog(3, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	for _, name := range []string{"a.com.", "b.com.", "c.com.", "d.com."} {
+		queryLog.Add(QueryLogEntry{ClientIP: "192.168.100.10", ClientMAC: mac.String(), Name: name})
+	}
+	queryLog.Add(QueryLogEntry{ClientIP: "192.168.100.11", Name: "e.com."})
+	if err := queryLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		client string
+		names  []string
+	}{
+		{"", []string{"c.com.", "d.com.", "e.com."}},
+		{"AA:BB:CC:DD:EE:01", []string{"c.com.", "d.com."}},
+		{"192.168.100.11", []string{"e.com."}},
+		{"aa:bb:cc:dd:ee:02", nil},
+	}
+	for _, test := range tests {
+		entries := queryLog.Entries(test.client)
+		if len(entries) != len(test.names) {
+			t.Errorf("Entries(%s)=%v, want %v", test.client, entries, test.names)
+			continue
+		}
+		for i, entry := range entries {
+			if entry.Name != test.names[i] {
+				t.Errorf("Entries(%s)=%v, want %v", test.client, entries, test.names)
+				break
+			}
+		}
+	}
+
+	entries, err := ReadQueryLog(path)
+	if err != nil || len(entries) != 5 || entries[0].Name != "a.com." || entries[0].ClientMAC != mac.String() {
+		t.Errorf("ReadQueryLog()=%v %v, want every query with client mac", entries, err)
+	}
+	for i, entry := range entries {
+		if entry.Seq != uint64(i+1) {
+			t.Errorf("ReadQueryLog()[%d].Seq=%d, want %d", i, entry.Seq, i+1)
+		}
+	}
+}
+
+func TestEntriesAfter(t *testing.T) {
+	numbered := func(seqs ...uint64) []QueryLogEntry {
+		var entries []QueryLogEntry
+		for _, seq := range seqs {
+			entries = append(entries, QueryLogEntry{Seq: seq})
+		}
+		return entries
+	}
+	var tests = []struct {
+		entries []QueryLogEntry
+		seq     uint64
+		want    []uint64
+	}{
+		{numbered(1, 2, 3), 0, []uint64{1, 2, 3}},
+		{numbered(1, 2, 3), 2, []uint64{3}},
+		{numbered(1, 2, 3), 3, nil},
+		{numbered(4, 5, 6, 7), 5, []uint64{6, 7}},    // Rewritten file of the last queries
+		{numbered(1, 2, 3, 1, 2), 1, []uint64{2}},    // Appended by two runs
+		{numbered(1, 2, 3, 1, 2), 3, []uint64{1, 2}}, // Restarted since the last read
+		{nil, 3, nil},
+	}
+	for _, test := range tests {
+		var seqs []uint64
+		for _, entry := range EntriesAfter(test.entries, test.seq) {
+			seqs = append(seqs, entry.Seq)
+		}
+		if fmt.Sprint(seqs) != fmt.Sprint(test.want) {
+			t.Errorf("EntriesAfter(%v, %d)=%v, want %v", test.entries, test.seq, seqs, test.want)
+		}
+	}
+}
+
+func TestDNSHandler_QueryLog(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	})
+	queryLog, _ := NewQueryLog(10, "")
+	clients := NewDNSClients()
+	clients.Set(net.IPv4(192, 168, 100, 10), DNSClient{MAC: "aa:bb:cc:dd:ee:01"})
+	handler := &DNSHandler{Upstreams: testUpstreams(t, upstream, time.Second), Cache: NewDNSCache(10), Clients: clients, Log: queryLog}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		handler.ServeDNS(newUDPWriter(), req)
+	}
+
+	entries := queryLog.Entries("aa:bb:cc:dd:ee:01")
+	if len(entries) != 2 {
+		t.Fatalf("Entries()=%v, want 2 queries", entries)
+	}
+	if entry := entries[0]; entry.Upstream != upstream || entry.Type != "A" || entry.Rcode != "NOERROR" || entry.Name != "example.com." {
+		t.Errorf("first query logged as %+v", entry)
+	}
+	if entry := entries[1]; entry.Upstream != SourceCache {
+		t.Errorf("cached query logged as %+v", entry)
+	}
+}
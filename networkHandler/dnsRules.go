@@ -0,0 +1,130 @@
+package networkHandler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ForwardRule sends queries of names under Zone to its own upstreams instead of the default ones
+type ForwardRule struct {
+	Zone      string // Fqdn, lowercase
+	Upstreams *Upstreams
+}
+
+// ParseForwardRule parses zone=upstream[,upstream...] like *.corp.example=10.0.0.53, see ParseUpstream for upstreams
+func ParseForwardRule(spec string, strategy UpstreamStrategy) (*ForwardRule, error) {
+	i := strings.IndexByte(spec, '=')
+	if i == -1 {
+		return nil, fmt.Errorf("dns forward rule %q isn't zone=upstream", spec)
+	}
+	zone := normalizeName(strings.TrimPrefix(spec[:i], "*."))
+	if len(zone) == 0 {
+		return nil, fmt.Errorf("dns forward rule %q has invalid zone", spec)
+	}
+	upstreams, err := NewUpstreams(strategy, strings.Split(spec[i+1:], ",")...)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardRule{Zone: dns.Fqdn(zone), Upstreams: upstreams}, nil
+}
+
+func (r *ForwardRule) String() string {
+	return r.Zone + "=" + r.Upstreams.String()
+}
+
+// forwardRule returns the most specific rule of name, nil when none matches
+func forwardRule(rules []*ForwardRule, name string) *ForwardRule {
+	name = strings.ToLower(dns.Fqdn(name))
+	var found *ForwardRule
+	for _, rule := range rules {
+		if dns.IsSubDomain(rule.Zone, name) && (found == nil || len(rule.Zone) > len(found.Zone)) {
+			found = rule
+		}
+	}
+	return found
+}
+
+// DNSOverrides answers names with static records, taking precedence over cache and upstreams
+type DNSOverrides struct {
+	TTL uint32
+
+	mu      sync.RWMutex
+	records map[string][]dns.RR // Records by lowercase fqdn
+}
+
+// NewDNSOverrides returns overrides without records
+func NewDNSOverrides() *DNSOverrides {
+	return &DNSOverrides{TTL: 300, records: make(map[string][]dns.RR)}
+}
+
+// Add parses name=ip (A or AAAA record) or name=target (CNAME record) like printer.lan=192.168.100.50 and adds it
+// a name has either a CNAME or addresses
+func (o *DNSOverrides) Add(spec string) error {
+	i := strings.IndexByte(spec, '=')
+	if i == -1 {
+		return fmt.Errorf("dns override %q isn't name=ip or name=target", spec)
+	}
+	name, value := normalizeName(spec[:i]), spec[i+1:]
+	if len(name) == 0 {
+		return fmt.Errorf("dns override %q has invalid name", spec)
+	}
+	name = dns.Fqdn(name)
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: o.TTL}
+	var rr dns.RR
+	if ip := net.ParseIP(value); ip == nil {
+		target := normalizeName(value)
+		if len(target) == 0 {
+			return fmt.Errorf("dns override %q has invalid target", spec)
+		}
+		hdr.Rrtype = dns.TypeCNAME
+		rr = &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(target)}
+	} else if ip.To4() != nil {
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: ip.To4()}
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, old := range o.records[name] {
+		if (old.Header().Rrtype == dns.TypeCNAME) != (hdr.Rrtype == dns.TypeCNAME) {
+			return fmt.Errorf("dns override %q: %s can't have a CNAME and other records", spec, name)
+		}
+	}
+	if hdr.Rrtype == dns.TypeCNAME && len(o.records[name]) != 0 {
+		return fmt.Errorf("dns override %q: %s has a CNAME already", spec, name)
+	}
+	o.records[name] = append(o.records[name], rr)
+	return nil
+}
+
+// Answer returns static answer to r, target is set when the name is a CNAME to be resolved further
+// ok is false when r has no override
+func (o *DNSOverrides) Answer(r *dns.Msg) (msg *dns.Msg, target string, ok bool) {
+	q := r.Question[0]
+	o.mu.RLock()
+	records, ok := o.records[strings.ToLower(q.Name)]
+	o.mu.RUnlock()
+	if !ok {
+		return nil, "", false
+	}
+	msg = new(dns.Msg)
+	msg.SetReply(r)
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		switch {
+		case rr.Header().Rrtype == dns.TypeCNAME && q.Qtype != dns.TypeCNAME:
+			return nil, rr.(*dns.CNAME).Target, true
+		case rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg, "", true // No records of the type is a NODATA answer
+}
@@ -0,0 +1,151 @@
+package networkHandler
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	var tests = []struct {
+		spec      string
+		zone      string
+		upstreams string
+		ok        bool
+	}{
+		{"*.corp.example=10.0.0.53", "corp.example.", "10.0.0.53:53", true},
+		{"Corp.Example.=10.0.0.53,10.0.0.54:5353", "corp.example.", "10.0.0.53:53,10.0.0.54:5353", true},
+		{"10.in-addr.arpa=10.0.0.53", "10.in-addr.arpa.", "10.0.0.53:53", true},
+		{"corp.example", "", "", false},
+		{"=10.0.0.53", "", "", false},
+		{"corp.example=", "", "", false},
+	}
+	for _, test := range tests {
+		rule, err := ParseForwardRule(test.spec, Failover)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseForwardRule(%s)=%v", test.spec, err)
+			continue
+		}
+		if err == nil && (rule.Zone != test.zone || rule.Upstreams.String() != test.upstreams) {
+			t.Errorf("ParseForwardRule(%s)=%v", test.spec, rule)
+		}
+	}
+}
+
+func TestForwardRule(t *testing.T) {
+	corp, _ := ParseForwardRule("corp.example=10.0.0.53", Failover)
+	lab, _ := ParseForwardRule("lab.corp.example=10.0.1.53", Failover)
+	rules := []*ForwardRule{corp, lab}
+	var tests = []struct {
+		name string
+		rule *ForwardRule
+	}{
+		{"corp.example.", corp},
+		{"host.corp.example.", corp},
+		{"HOST.LAB.corp.example.", lab},
+		{"corp.example.com.", nil},
+		{"example.", nil},
+	}
+	for _, test := range tests {
+		if rule := forwardRule(rules, test.name); rule != test.rule {
+			t.Errorf("forwardRule(%s)=%v, want %v", test.name, rule, test.rule)
+		}
+	}
+}
+
+func TestDNSOverrides_Add(t *testing.T) {
+	overrides := NewDNSOverrides()
+	var tests = []struct {
+		spec string
+		ok   bool
+	}{
+		{"printer.lan=192.168.100.50", true},
+		{"printer.lan=2001:db8::50", true},
+		{"nas.lan=storage.corp.example", true},
+		{"nas.lan=192.168.100.51", false},
+		{"printer.lan=other.lan", false},
+		{"printer.lan", false},
+		{"=192.168.100.50", false},
+	}
+	for _, test := range tests {
+		if err := overrides.Add(test.spec); (err == nil) != test.ok {
+			t.Errorf("Add(%s)=%v", test.spec, err)
+		}
+	}
+}
+
+func TestDNSHandler_Rules(t *testing.T) {
+	var defaultQueries, corpQueries int32
+	defaultUpstream := countingUpstream(t, "192.0.2.1", &defaultQueries)
+	corpUpstream := countingUpstream(t, "10.0.0.1", &corpQueries)
+	rule, err := ParseForwardRule("*.corp.example="+corpUpstream, Failover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides := NewDNSOverrides()
+	for _, spec := range []string{"printer.lan=192.168.100.50", "nas.lan=storage.corp.example"} {
+		if err := overrides.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := &DNSHandler{
+		Upstreams: testUpstreams(t, defaultUpstream, time.Second),
+		Forwards:  []*ForwardRule{rule},
+		Overrides: overrides,
+		Cache:     NewDNSCache(10),
+	}
+
+	var tests = []struct {
+		name    string
+		qtype   uint16
+		answers []string
+	}{
+		{"printer.lan.", dns.TypeA, []string{"192.168.100.50"}},
+		{"Printer.LAN.", dns.TypeAAAA, nil},
+		{"nas.lan.", dns.TypeA, []string{"storage.corp.example.", "10.0.0.1"}},
+		{"host.corp.example.", dns.TypeA, []string{"10.0.0.1"}},
+		{"example.com.", dns.TypeA, []string{"192.0.2.1"}},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		w := newUDPWriter()
+		handler.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != len(test.answers) {
+			t.Errorf("ServeDNS(%s)=%v, want %v", test.name, w.msg, test.answers)
+			continue
+		}
+		for i, rr := range w.msg.Answer {
+			var answer string
+			switch rr := rr.(type) {
+			case *dns.A:
+				answer = rr.A.String()
+			case *dns.CNAME:
+				answer = rr.Target
+			}
+			if answer != test.answers[i] || (i == 0 && rr.Header().Name != test.name) {
+				t.Errorf("ServeDNS(%s)=%v, want %v", test.name, w.msg, test.answers)
+				break
+			}
+		}
+	}
+	if atomic.LoadInt32(&corpQueries) != 2 || atomic.LoadInt32(&defaultQueries) != 1 {
+		t.Errorf("corp upstream got %d and default upstream %d queries, want 2 and 1", atomic.LoadInt32(&corpQueries), atomic.LoadInt32(&defaultQueries))
+	}
+	if handler.Cache.Stats().Entries != 3 || len(handler.Stats().Upstreams) != 2 {
+		t.Errorf("cache=%+v stats=%+v", handler.Cache.Stats(), handler.Stats())
+	}
+
+	if err := overrides.Add("example.com=10.0.0.81"); err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := newUDPWriter()
+	handler.ServeDNS(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "10.0.0.81" {
+		t.Errorf("ServeDNS(example.com.)=%v, want override before cached answer", w.msg)
+	}
+}
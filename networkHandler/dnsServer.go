@@ -3,122 +3,313 @@ package networkHandler
 import (
 	"context"
 	"log"
-	"math/rand"
 	"net"
-	"regexp"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// TODO: add blacklisting
-
-var dataCH = make(map[string]string)
-var datamx = &sync.Mutex{}
-var flush = make(chan struct{})
-
-type DNSHandler struct{}
-
-func (*DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	msg := dns.Msg{}
-	msg.SetReply(r)
-	switch r.Question[0].Qtype {
-	case dns.TypeA:
-		msg.Authoritative = true
-		domain := msg.Question[0].Name
-		address, ok := haveIT(domain)
-		if ok {
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   net.ParseIP(address),
-			})
+// ednsSize is the udp buffer size asked from upstream, answers are truncated for clients with smaller buffers
+const ednsSize = 1232
+
+// DNSHandler forwards queries of clients to Upstreams
+type DNSHandler struct {
+	Upstreams *Upstreams       // Resolvers queries are forwarded to
+	Forwards  []*ForwardRule   // Zones forwarded to other resolvers than Upstreams
+	Zone      *LocalZone       // Optional names of clients, answered without forwarding
+	Overrides *DNSOverrides    // Optional static records, answered without forwarding
+	Clients   *DNSClients      // Optional dhcp clients by address, for policies and query log
+	Policies  *DNSPolicies     // Optional filters of clients, checked before Blocker
+	Blocker   *DNSBlocker      // Optional blocklists checked before forwarding
+	Cache     *DNSCache        // Optional cache of upstream answers
+	Log       *QueryLog        // Optional log of client queries
+	Validator *DNSSECValidator // Optional DNSSEC validation of answers of Upstreams
+}
+
+func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		dns.HandleFailed(w, r)
+		return
+	}
+	start := time.Now()
+	client := h.client(w.RemoteAddr())
+	var policy *DNSPolicy
+	if h.Policies != nil {
+		if ip := addrIP(w.RemoteAddr()); len(client.MAC) == 0 && ip != nil && ip.To4() == nil && !ip.IsLoopback() {
+			// An unknown ipv6 address may be a client with a policy, it asks again over ipv4
+			resp := new(dns.Msg)
+			resp.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(resp)
+			return
 		}
+		policy = h.Policies.For(client)
+	}
+	resp, source, err := h.answer(r, policy)
+	if err != nil {
+		log.Println("dns upstreams of", r.Question[0].Name, err)
+		resp = new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeServerFailure)
+	} else {
+		_, udp := w.RemoteAddr().(*net.UDPAddr)
+		resp = replyTo(r, resp, udp)
+	}
+	w.WriteMsg(resp)
+	if h.Log != nil {
+		h.logQuery(w.RemoteAddr(), client, policy, r, resp, source, start)
 	}
-	w.WriteMsg(&msg)
 }
 
-func flushCH() {
-	for {
-		<-flush
-		log.Printf("dropping memory cache .... %v recored", len(dataCH))
-		dataCH = make(map[string]string)
+// client returns dhcp client of addr, zero when it's unknown
+func (h *DNSHandler) client(addr net.Addr) DNSClient {
+	if h.Clients == nil {
+		return DNSClient{}
 	}
+	client, _ := h.Clients.Lookup(addrIP(addr))
+	return client
 }
 
-func haveIT(domain string) (string, bool) {
-	for k, v := range dataCH {
-		if ok, _ := regexp.MatchString(k, domain); ok {
-			return v, true
+// answer returns answer to r of a client with policy (nil for default filtering) and where it comes from
+func (h *DNSHandler) answer(r *dns.Msg, policy *DNSPolicy) (*dns.Msg, string, error) {
+	if h.Zone != nil {
+		if resp, ok := h.Zone.Answer(r); ok {
+			return resp, SourceLocal, nil
+		}
+	}
+	if h.Overrides != nil {
+		if resp, target, ok := h.Overrides.Answer(r); ok {
+			if len(target) != 0 {
+				resp, _, err := h.alias(r, target, h.Overrides.TTL)
+				return resp, SourceOverride, err
+			}
+			return resp, SourceOverride, nil
+		}
+	}
+	if policy != nil {
+		name := strings.ToLower(strings.TrimSuffix(r.Question[0].Name, "."))
+		if policy.blocks(name) {
+			return blockedReply(r, h.Policies.Mode), SourceBlocked, nil
+		}
+		if target := safeSearchTarget(name); policy.SafeSearch && len(target) != 0 {
+			return h.alias(r, target, 300)
+		}
+	}
+	if h.Blocker != nil {
+		if _, blocked := h.Blocker.Blocked(r.Question[0].Name); blocked {
+			return h.Blocker.blockedReply(r), SourceBlocked, nil
 		}
 	}
+	return h.resolve(r)
+}
 
-	if addr, ok := askUpstr(domain); ok {
-		datamx.Lock()
-		dataCH[domain] = addr
-		datamx.Unlock()
-		return addr, true
+// alias answers r with a CNAME to target followed by the answer of target
+func (h *DNSHandler) alias(r *dns.Msg, target string, ttl uint32) (*dns.Msg, string, error) {
+	req := r.Copy()
+	req.Question[0].Name = dns.Fqdn(target)
+	resp, source, err := h.resolve(req)
+	if err != nil {
+		return nil, source, err
+	}
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: dns.Fqdn(target),
 	}
-	return "err", false
+	resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+	return resp, source, nil
 }
 
-func timeCh() {
-	for {
-		time.Sleep(time.Second*time.Duration(rand.Intn(120)) + 90)
-		flush <- struct{}{}
+// resolve answers r from cache or upstream
+func (h *DNSHandler) resolve(r *dns.Msg) (*dns.Msg, string, error) {
+	if h.Cache == nil {
+		return h.forward(r)
+	}
+	if resp, prefetch := h.Cache.Get(r.Question[0], time.Now()); resp != nil {
+		if prefetch {
+			go h.refresh(r.Copy())
+		}
+		return resp, SourceCache, nil
 	}
+	resp, source, err := h.forward(r)
+	if err != nil {
+		return nil, source, err
+	}
+	h.Cache.Put(resp, time.Now())
+	return resp, source, nil
 }
 
-func memCH() {
-	for {
-		time.Sleep(time.Millisecond * 100)
-		if len(dataCH) > 900000 {
-			flush <- struct{}{}
+// refresh replaces cached answer of r before it expires
+func (h *DNSHandler) refresh(r *dns.Msg) {
+	resp, _, err := h.forward(r)
+	if err != nil {
+		log.Println("dns prefetch", r.Question[0].Name, err)
+		return
+	}
+	h.Cache.Put(resp, time.Now())
+}
+
+// forward exchanges r with upstreams of its forward rule or default ones, asking for answers as large as ednsSize
+func (h *DNSHandler) forward(r *dns.Msg) (*dns.Msg, string, error) {
+	upstreams, validator := h.Upstreams, h.Validator
+	if rule := forwardRule(h.Forwards, r.Question[0].Name); rule != nil {
+		upstreams, validator = rule.Upstreams, nil // Forwarded zones are usually private, their resolvers are trusted
+	}
+	req := r.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetUDPSize(ednsSize)
+	} else {
+		req.SetEdns0(ednsSize, false)
+	}
+	req.IsEdns0().SetDo() // Answers are cached for all clients, replyTo strips DNSSEC records for those without DO
+	if validator != nil {
+		req.CheckingDisabled = true // Bogus answers are answered with SERVFAIL by validator, not upstream
+	}
+	resp, upstream, err := upstreams.Exchange(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if validator != nil {
+		secure, err := validator.Validate(resp)
+		if err != nil {
+			return nil, upstream.String(), err
 		}
+		resp.AuthenticatedData = secure
+		resp.CheckingDisabled = false
+	}
+	return resp, upstream.String(), nil
+}
 
+// logQuery adds query r of client at addr and its answer to h.Log
+func (h *DNSHandler) logQuery(addr net.Addr, client DNSClient, policy *DNSPolicy, r, resp *dns.Msg, source string, start time.Time) {
+	q := r.Question[0]
+	entry := QueryLogEntry{
+		Time:      start,
+		ClientIP:  addrIP(addr).String(),
+		ClientMAC: client.MAC,
+		Name:      q.Name,
+		Type:      dns.Type(q.Qtype).String(),
+		Rcode:     dns.RcodeToString[resp.Rcode],
+		Upstream:  source,
+		Latency:   time.Since(start),
+	}
+	if policy != nil {
+		entry.Policy = policy.Name
+	}
+	err := h.Log.Add(entry)
+	if err != nil {
+		log.Println("error writing dns query log", err)
 	}
 }
 
-func RunDNS(ctx context.Context, addr string) {
-	go flushCH()
-	go timeCh()
-	go memCH()
-	go func() {
-		srv := &dns.Server{Addr: addr, Net: "udp"}
-		srv.Handler = &DNSHandler{}
-		dns.NewServeMux()
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to set udp DNS listener %s\n", err.Error())
+// replyTo fits upstream or cached resp to the query r of a client
+// the OPT record is only kept for EDNS0 clients and udp answers are truncated to their buffer size
+// DNSSEC records and the AD bit are only kept for clients which asked for them (RFC 3225, RFC 6840 5.8)
+func replyTo(r, resp *dns.Msg, udp bool) *dns.Msg {
+	resp.Id = r.Id
+	resp.Question = r.Question
+	opt := r.IsEdns0()
+	do := opt != nil && opt.Do()
+	resp.Answer = dnssecFiltered(resp.Answer, r.Question[0].Qtype, do)
+	resp.Ns = dnssecFiltered(resp.Ns, r.Question[0].Qtype, do)
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT && (do || !isDNSSECType(rr.Header().Rrtype)) {
+			extra = append(extra, rr)
 		}
-	}()
+	}
+	resp.Extra = extra
+	resp.AuthenticatedData = resp.AuthenticatedData && (do || r.AuthenticatedData)
+	if opt != nil {
+		resp.SetEdns0(ednsSize, do)
+	}
+	if udp {
+		resp.Truncate(udpSize(r))
+	}
+	return resp
+}
 
-	go func() {
-		srv := &dns.Server{Addr: addr, Net: "tcp"}
-		srv.Handler = &DNSHandler{}
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to set tcp DNS listener %s\n", err.Error())
+// dnssecFiltered returns rrs without DNSSEC records unless do is set or they were asked for by qtype
+func dnssecFiltered(rrs []dns.RR, qtype uint16, do bool) []dns.RR {
+	if do {
+		return rrs
+	}
+	filtered := rrs[:0]
+	for _, rr := range rrs {
+		if rrtype := rr.Header().Rrtype; !isDNSSECType(rrtype) || rrtype == qtype {
+			filtered = append(filtered, rr)
 		}
-	}()
-	<-ctx.Done()
+	}
+	return filtered
 }
 
-func askUpstr(domain string) (string, bool) {
-	r := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: time.Millisecond * time.Duration(10000),
-			}
-			return d.DialContext(ctx, "udp", "1.1.1.1:53")
-		},
+func isDNSSECType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// udpSize returns largest udp answer the client of r accepts
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
 	}
-	ip, err := r.LookupHost(context.Background(), domain)
+	return dns.MinMsgSize
+}
+
+// DNSListener is the udp and tcp socket of a dns server
+type DNSListener struct {
+	Addr       string
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+// ListenDNS binds udp and tcp addr, so callers learn of failures before clients are sent to addr
+func ListenDNS(addr string) (*DNSListener, error) {
+	packetConn, err := net.ListenPacket("udp", addr)
 	if err != nil {
-		log.Println(err)
-		return "err", false
+		return nil, err
 	}
-	if len(ip) != 0 {
-		return ip[0], true
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	return &DNSListener{Addr: addr, packetConn: packetConn, listener: listener}, nil
+}
+
+// Serve serves handler until ctx is done and closes l, it returns early when serving fails
+func (l *DNSListener) Serve(ctx context.Context, handler *DNSHandler) error {
+	servers := []*dns.Server{
+		{PacketConn: l.packetConn, Handler: handler},
+		{Listener: l.listener, Handler: handler},
+	}
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			errs <- srv.ActivateAndServe()
+		}(srv)
+	}
+	var err error
+	select {
+	case err = <-errs:
+		log.Println("dns server on", l.Addr, "failed", err)
+	case <-ctx.Done():
+	}
+	for _, srv := range servers {
+		srv.Shutdown()
+	}
+	l.packetConn.Close() // Servers which haven't started yet stop too
+	l.listener.Close()
+	return err
+}
+
+// RunDNS serves handler on udp and tcp addr until ctx is done
+// it returns early when listening or serving fails
+func RunDNS(ctx context.Context, addr string, handler *DNSHandler) error {
+	l, err := ListenDNS(addr)
+	if err != nil {
+		return err
 	}
-	return "err", false
+	return l.Serve(ctx, handler)
 }
@@ -0,0 +1,189 @@
+package networkHandler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRunDNS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- RunDNS(ctx, "127.0.0.1:0", &DNSHandler{})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RunDNS()=%v after cancel, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RunDNS() didn't stop on cancel")
+	}
+}
+
+func TestRunDNS_AddrInUse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := RunDNS(context.Background(), conn.LocalAddr().String(), &DNSHandler{}); err == nil {
+		t.Errorf("RunDNS(%v) on address in use succeeded", conn.LocalAddr())
+	}
+	if l, err := ListenDNS(conn.LocalAddr().String()); err == nil {
+		t.Errorf("ListenDNS(%v) on address in use=%v", conn.LocalAddr(), l)
+	}
+}
+
+// testWriter records the message written by a handler
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+func newUDPWriter() *testWriter {
+	return &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 168, 100, 10), Port: 5000}}
+}
+
+// startUpstream runs handler on udp and tcp of a free localhost port
+func startUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpServer := &dns.Server{PacketConn: packetConn, Handler: handler}
+	tcpServer := &dns.Server{Listener: listener, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	t.Cleanup(func() {
+		udpServer.Shutdown()
+		tcpServer.Shutdown()
+	})
+	return packetConn.LocalAddr().String()
+}
+
+func TestDNSHandler_Forward(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		q := r.Question[0]
+		var rr string
+		switch q.Qtype {
+		case dns.TypeAAAA:
+			rr = q.Name + " 300 IN AAAA 2001:db8::1"
+		case dns.TypeMX:
+			rr = q.Name + " 300 IN MX 10 mail.example.com."
+		case dns.TypeTXT:
+			rr = q.Name + ` 300 IN TXT "v=spf1 -all"`
+		case dns.TypeSRV:
+			rr = q.Name + " 300 IN SRV 0 5 5060 sip.example.com."
+		case dns.TypePTR:
+			rr = q.Name + " 300 IN PTR host.example.com."
+		case dns.TypeCNAME:
+			rr = q.Name + " 300 IN CNAME www.example.com."
+		case dns.TypeHTTPS:
+			rr = q.Name + ` 300 IN HTTPS 1 . alpn="h2"`
+		}
+		if len(rr) != 0 {
+			answer, err := dns.NewRR(rr)
+			if err != nil {
+				t.Error(err)
+			}
+			msg.Answer = append(msg.Answer, answer)
+		}
+		w.WriteMsg(msg)
+	})
+	handler := &DNSHandler{Upstreams: testUpstreams(t, upstream, time.Second)}
+
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeMX, dns.TypeTXT, dns.TypeSRV, dns.TypePTR, dns.TypeCNAME, dns.TypeHTTPS} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qtype)
+		w := newUDPWriter()
+		handler.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Id != req.Id || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != qtype {
+			t.Errorf("ServeDNS(%s)=%v", dns.TypeToString[qtype], w.msg)
+			continue
+		}
+		if w.msg.IsEdns0() != nil {
+			t.Errorf("ServeDNS(%s) answered EDNS0 to client without it", dns.TypeToString[qtype])
+		}
+	}
+}
+
+func TestDNSHandler_Truncated(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			msg.Truncated = true
+			w.WriteMsg(msg)
+			return
+		}
+		if opt := r.IsEdns0(); opt != nil {
+			msg.SetEdns0(opt.UDPSize(), false)
+		}
+		for i := 0; i < 40; i++ {
+			answer, _ := dns.NewRR(fmt.Sprintf(`big.example.com. 300 IN TXT "record %d of a long answer which doesn't fit"`, i))
+			msg.Answer = append(msg.Answer, answer)
+		}
+		w.WriteMsg(msg)
+	})
+	handler := &DNSHandler{Upstreams: testUpstreams(t, upstream, time.Second)}
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.com.", dns.TypeTXT)
+	tcp := &testWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 168, 100, 10), Port: 5000}}
+	handler.ServeDNS(tcp, req)
+	if tcp.msg == nil || len(tcp.msg.Answer) != 40 || tcp.msg.Truncated {
+		t.Fatalf("ServeDNS() over tcp=%v, want all 40 records of tcp retry", tcp.msg)
+	}
+
+	udp := newUDPWriter()
+	handler.ServeDNS(udp, req)
+	if udp.msg == nil || !udp.msg.Truncated || udp.msg.Len() > dns.MinMsgSize {
+		t.Errorf("ServeDNS() over udp without EDNS0 answered %d bytes, truncated=%v", udp.msg.Len(), udp.msg.Truncated)
+	}
+
+	req.SetEdns0(4096, false)
+	udp = newUDPWriter()
+	handler.ServeDNS(udp, req)
+	if udp.msg == nil || udp.msg.Truncated || len(udp.msg.Answer) != 40 || udp.msg.IsEdns0() == nil {
+		t.Errorf("ServeDNS() over udp with EDNS0 4096=%v", udp.msg)
+	}
+}
+
+func TestDNSHandler_UpstreamDown(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // Nobody answers
+	handler := &DNSHandler{Upstreams: testUpstreams(t, conn.LocalAddr().String(), 100*time.Millisecond)}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := newUDPWriter()
+	handler.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("ServeDNS() without upstream=%v, want SERVFAIL", w.msg)
+	}
+}
@@ -0,0 +1,63 @@
+package networkHandler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DNSStats are counters of a running dns server, shared with the cli through a stats file
+type DNSStats struct {
+	Time       time.Time         `json:"time"`
+	Cache      *CacheStats       `json:"cache,omitempty"`
+	Blocklists map[string]uint64 `json:"blocklists,omitempty"` // Blocked queries by blocklist
+	Upstreams  []UpstreamHealth  `json:"upstreams,omitempty"`
+}
+
+// Stats returns current counters of handler
+func (h *DNSHandler) Stats() DNSStats {
+	stats := DNSStats{Time: time.Now()}
+	if h.Cache != nil {
+		cacheStats := h.Cache.Stats()
+		stats.Cache = &cacheStats
+	}
+	if h.Blocker != nil {
+		stats.Blocklists = h.Blocker.Hits()
+	}
+	if h.Upstreams != nil {
+		stats.Upstreams = h.Upstreams.Health()
+	}
+	for _, rule := range h.Forwards {
+		stats.Upstreams = append(stats.Upstreams, rule.Upstreams.Health()...)
+	}
+	return stats
+}
+
+// WriteDNSStats replaces stats file of path atomically
+func WriteDNSStats(path string, stats DNSStats) error {
+	content, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadDNSStats reads stats file of path
+func ReadDNSStats(path string) (DNSStats, error) {
+	var stats DNSStats
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return stats, err
+	}
+	err = json.Unmarshal(content, &stats)
+	return stats, err
+}
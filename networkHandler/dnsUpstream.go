@@ -0,0 +1,310 @@
+package networkHandler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxUpstreamFailures = 3                // Consecutive failures which mark an upstream down
+	upstreamDownTime    = 30 * time.Second // How long a down upstream is only tried after the others
+)
+
+type UpstreamStrategy int
+
+const (
+	Failover   UpstreamStrategy = iota // First healthy upstream in order
+	RoundRobin                         // Healthy upstreams in turn
+	Fastest                            // Healthy upstream with lowest response time
+)
+
+// ParseUpstreamStrategy parses failover, round-robin or fastest
+func ParseUpstreamStrategy(strategy string) (UpstreamStrategy, error) {
+	switch strings.ToLower(strategy) {
+	case "failover":
+		return Failover, nil
+	case "round-robin", "roundrobin":
+		return RoundRobin, nil
+	case "fastest":
+		return Fastest, nil
+	}
+	return 0, fmt.Errorf("unknown dns upstream strategy %q", strategy)
+}
+
+// Upstream is a resolver queries are forwarded to over udp (tcp on truncation), tls or https
+type Upstream struct {
+	Addr       string // Resolver as host:port or https url
+	Net        string // udp, tcp-tls or https
+	ServerName string // Certificate name of tls upstreams
+
+	client *http.Client
+
+	mu       sync.Mutex
+	health   UpstreamHealth
+	failures int       // Consecutive failures
+	downTill time.Time // When a down upstream is tried first again
+}
+
+// UpstreamHealth reports how an upstream answers
+type UpstreamHealth struct {
+	Upstream  string        `json:"upstream"`
+	Queries   uint64        `json:"queries"`
+	Failures  uint64        `json:"failures"`
+	RTT       time.Duration `json:"rtt"` // Moving average of answer time
+	Down      bool          `json:"down"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// ParseUpstream parses upstream address, forms are
+// 1.1.1.1, 1.1.1.1:53, tls://1.1.1.1:853#cloudflare-dns.com, tls://dns.google and https://dns.google/dns-query
+func ParseUpstream(spec string) (*Upstream, error) {
+	switch {
+	case strings.HasPrefix(spec, "https://"):
+		if _, err := url.Parse(spec); err != nil {
+			return nil, err
+		}
+		return &Upstream{
+			Addr:   spec,
+			Net:    "https",
+			client: &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true}},
+		}, nil
+	case strings.HasPrefix(spec, "tls://"):
+		addr := strings.TrimPrefix(spec, "tls://")
+		serverName := ""
+		if i := strings.IndexByte(addr, '#'); i != -1 {
+			addr, serverName = addr[:i], addr[i+1:]
+		}
+		addr = withDefaultPort(addr, "853")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(serverName) == 0 {
+			if net.ParseIP(host) != nil {
+				return nil, fmt.Errorf("tls upstream %s needs a certificate name as #name", spec)
+			}
+			serverName = host
+		}
+		return &Upstream{Addr: addr, Net: "tcp-tls", ServerName: serverName}, nil
+	}
+	addr := withDefaultPort(strings.TrimPrefix(spec, "udp://"), "53")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) == 0 {
+		return nil, fmt.Errorf("dns upstream %q has no address", spec)
+	}
+	return &Upstream{Addr: addr, Net: "udp"}, nil
+}
+
+// withDefaultPort adds port to addr without one, ipv6 addresses may be bare or in brackets
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+func (u *Upstream) String() string {
+	if u.Net == "tcp-tls" {
+		return "tls://" + u.Addr
+	}
+	return u.Addr
+}
+
+// Exchange sends req to upstream and returns its answer
+func (u *Upstream) Exchange(req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if u.Net == "https" {
+		return u.exchangeHTTPS(req, timeout)
+	}
+	client := &dns.Client{Net: u.Net, UDPSize: ednsSize, Timeout: timeout}
+	if u.Net == "tcp-tls" {
+		client.TLSConfig = &tls.Config{ServerName: u.ServerName}
+	}
+	resp, _, err := client.Exchange(req, u.Addr)
+	if err == nil && resp.Truncated && u.Net == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(req, u.Addr)
+	}
+	return resp, err
+}
+
+// exchangeHTTPS posts req as RFC 8484 dns message
+func (u *Upstream) exchangeHTTPS(req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	id := req.Id
+	req.Id = 0 // Lets http caches share answers
+	packed, err := req.Pack()
+	req.Id = id
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, u.Addr, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+	client := *u.client
+	client.Timeout = timeout
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u.Addr, httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = id
+	return resp, nil
+}
+
+// record updates health of upstream with the result of an exchange
+func (u *Upstream) record(rtt time.Duration, err error, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.health.Queries++
+	if err != nil {
+		u.health.Failures++
+		u.health.LastError = err.Error()
+		u.failures++
+		if u.failures >= maxUpstreamFailures {
+			if !u.health.Down {
+				log.Println("dns upstream", u, "is down:", err)
+			}
+			u.health.Down = true
+			u.downTill = now.Add(upstreamDownTime)
+		}
+		return
+	}
+	u.failures = 0
+	if u.health.Down {
+		log.Println("dns upstream", u, "is up again")
+		u.health.Down = false
+	}
+	if u.health.RTT == 0 {
+		u.health.RTT = rtt
+	} else {
+		u.health.RTT += (rtt - u.health.RTT) / 4
+	}
+}
+
+// available reports whether upstream should be tried before down ones
+func (u *Upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.health.Down || !now.Before(u.downTill)
+}
+
+// Health returns health of upstream
+func (u *Upstream) Health() UpstreamHealth {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	health := u.health
+	health.Upstream = u.String()
+	return health
+}
+
+func (u *Upstream) rtt() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.health.RTT
+}
+
+// Upstreams forwards queries to a set of upstreams according to Strategy
+// an upstream failing in a row is skipped for a while, unless all upstreams are down
+type Upstreams struct {
+	List     []*Upstream
+	Strategy UpstreamStrategy
+	Timeout  time.Duration // Exchange timeout of each upstream, 5s when zero
+
+	next uint32 // Round robin position
+}
+
+// NewUpstreams parses upstream specs, see ParseUpstream
+func NewUpstreams(strategy UpstreamStrategy, specs ...string) (*Upstreams, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no dns upstream")
+	}
+	upstreams := &Upstreams{Strategy: strategy}
+	for _, spec := range specs {
+		upstream, err := ParseUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		upstreams.List = append(upstreams.List, upstream)
+	}
+	return upstreams, nil
+}
+
+// Exchange sends req to upstreams in strategy order until one answers, returning the answering upstream
+func (p *Upstreams) Exchange(req *dns.Msg) (*dns.Msg, *Upstream, error) {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	var err error
+	for _, upstream := range p.order(time.Now()) {
+		var resp *dns.Msg
+		start := time.Now()
+		resp, err = upstream.Exchange(req, timeout)
+		upstream.record(time.Since(start), err, time.Now())
+		if err == nil {
+			return resp, upstream, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// order returns upstreams in the order they are tried, down upstreams last
+func (p *Upstreams) order(now time.Time) []*Upstream {
+	list := make([]*Upstream, len(p.List))
+	copy(list, p.List)
+	switch p.Strategy {
+	case RoundRobin:
+		n := int(atomic.AddUint32(&p.next, 1)-1) % len(list)
+		list = append(list[n:], list[:n]...)
+	case Fastest:
+		sort.SliceStable(list, func(i, j int) bool { return list[i].rtt() < list[j].rtt() })
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].available(now) && !list[j].available(now) })
+	return list
+}
+
+// Health returns health of every upstream
+func (p *Upstreams) Health() []UpstreamHealth {
+	health := make([]UpstreamHealth, len(p.List))
+	for i, upstream := range p.List {
+		health[i] = upstream.Health()
+	}
+	return health
+}
+
+func (p *Upstreams) String() string {
+	names := make([]string, len(p.List))
+	for i, upstream := range p.List {
+		names[i] = upstream.String()
+	}
+	return strings.Join(names, ",")
+}
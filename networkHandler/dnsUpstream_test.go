@@ -0,0 +1,170 @@
+package networkHandler
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testUpstreams(t *testing.T, addr string, timeout time.Duration) *Upstreams {
+	upstreams, err := NewUpstreams(Failover, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams.Timeout = timeout
+	return upstreams
+}
+
+// countingUpstream answers A queries with ip and counts them
+func countingUpstream(t *testing.T, ip string, count *int32) string {
+	return startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(count, 1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	})
+}
+
+// deadUpstream returns address of a socket which never answers
+func deadUpstream(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func testQuery() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	return req
+}
+
+func TestParseUpstream(t *testing.T) {
+	var tests = []struct {
+		spec       string
+		addr       string
+		net        string
+		serverName string
+		ok         bool
+	}{
+		{"1.1.1.1", "1.1.1.1:53", "udp", "", true},
+		{"1.1.1.1:5353", "1.1.1.1:5353", "udp", "", true},
+		{"2606:4700:4700::1111", "[2606:4700:4700::1111]:53", "udp", "", true},
+		{"tls://1.1.1.1#cloudflare-dns.com", "1.1.1.1:853", "tcp-tls", "cloudflare-dns.com", true},
+		{"tls://dns.google:8853", "dns.google:8853", "tcp-tls", "dns.google", true},
+		{"tls://1.1.1.1", "", "", "", false},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query", "https", "", true},
+	}
+	for _, test := range tests {
+		upstream, err := ParseUpstream(test.spec)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseUpstream(%s)=%v", test.spec, err)
+			continue
+		}
+		if err == nil && (upstream.Addr != test.addr || upstream.Net != test.net || upstream.ServerName != test.serverName) {
+			t.Errorf("ParseUpstream(%s)=%+v", test.spec, upstream)
+		}
+	}
+}
+
+func TestUpstreams_Failover(t *testing.T) {
+	var count int32
+	upstreams, err := NewUpstreams(Failover, deadUpstream(t), countingUpstream(t, "192.0.2.1", &count))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams.Timeout = 50 * time.Millisecond
+	for i := 0; i < maxUpstreamFailures+2; i++ {
+		if resp, upstream, err := upstreams.Exchange(testQuery()); err != nil || len(resp.Answer) != 1 || upstream != upstreams.List[1] {
+			t.Fatalf("Exchange()=%v %v %v, want answer of second upstream", resp, upstream, err)
+		}
+	}
+	health := upstreams.Health()
+	if !health[0].Down || health[0].Queries != maxUpstreamFailures || health[1].Down || health[1].Queries != maxUpstreamFailures+2 {
+		t.Errorf("Health()=%+v, want dead upstream down and skipped", health)
+	}
+}
+
+func TestUpstreams_RoundRobin(t *testing.T) {
+	var first, second int32
+	upstreams, err := NewUpstreams(RoundRobin, countingUpstream(t, "192.0.2.1", &first), countingUpstream(t, "192.0.2.2", &second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := upstreams.Exchange(testQuery()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&first) != 5 || atomic.LoadInt32(&second) != 5 {
+		t.Errorf("round robin sent %d and %d queries, want 5 each", atomic.LoadInt32(&first), atomic.LoadInt32(&second))
+	}
+}
+
+func TestUpstreams_Fastest(t *testing.T) {
+	var slow, fast int32
+	slowAddr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&slow, 1)
+		time.Sleep(50 * time.Millisecond)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		w.WriteMsg(msg)
+	})
+	upstreams, err := NewUpstreams(Fastest, slowAddr, countingUpstream(t, "192.0.2.1", &fast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams.List[0].record(50*time.Millisecond, nil, time.Now())
+	upstreams.List[1].record(time.Millisecond, nil, time.Now())
+	for i := 0; i < 5; i++ {
+		if _, _, err := upstreams.Exchange(testQuery()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&slow) != 0 || atomic.LoadInt32(&fast) != 5 {
+		t.Errorf("fastest sent %d queries to slow and %d to fast upstream", atomic.LoadInt32(&slow), atomic.LoadInt32(&fast))
+	}
+}
+
+func TestUpstream_HTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || req.Unpack(body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			t.Errorf("doh request id=%d, want 0", req.Id)
+		}
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN AAAA 2001:db8::1")
+		msg.Answer = append(msg.Answer, rr)
+		packed, _ := msg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	upstream, err := ParseUpstream(server.URL + "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.client = server.Client()
+	req := testQuery()
+	resp, err := upstream.Exchange(req, time.Second)
+	if err != nil || resp.Id != req.Id || len(resp.Answer) != 1 {
+		t.Errorf("Exchange() over https=%v %v", resp, err)
+	}
+}
@@ -0,0 +1,589 @@
+package networkHandler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxKeyCacheTime bounds how long validated zone keys are kept
+const maxKeyCacheTime = time.Hour
+
+// ErrBogus is returned for answers whose signatures or denial proofs don't validate
+var ErrBogus = errors.New("dnssec validation failed")
+
+// LoadTrustAnchors reads DS or DNSKEY records of a zone file like /usr/share/dns/root.key
+func LoadTrustAnchors(path string) (map[string][]dns.RR, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	anchors := make(map[string][]dns.RR)
+	parser := dns.NewZoneParser(file, ".", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			zone := strings.ToLower(rr.Header().Name)
+			anchors[zone] = append(anchors[zone], rr)
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%s: no DS or DNSKEY trust anchor", path)
+	}
+	return anchors, nil
+}
+
+// zoneKeys are validated keys of a zone, a zone proven unsigned has no keys
+type zoneKeys struct {
+	keys    []*dns.DNSKEY
+	secure  bool
+	expires time.Time
+}
+
+// DNSSECValidator validates answers through the chain of DS and DNSKEY records down from trust anchors
+// unsigned answers are accepted as insecure only when their zone is proven to be unsigned
+type DNSSECValidator struct {
+	Anchors   map[string][]dns.RR // DS or DNSKEY trust anchors by zone fqdn
+	Upstreams *Upstreams          // Resolvers asked for keys and delegation proofs
+
+	mu    sync.Mutex
+	zones map[string]zoneKeys // Validated keys by lowercase zone fqdn
+}
+
+// NewDNSSECValidator returns validator of anchors asking upstreams for keys
+func NewDNSSECValidator(anchors map[string][]dns.RR, upstreams *Upstreams) *DNSSECValidator {
+	return &DNSSECValidator{Anchors: anchors, Upstreams: upstreams, zones: make(map[string]zoneKeys)}
+}
+
+// rrsetKey identifies rrset of a message section
+type rrsetKey struct {
+	name   string // Lowercase
+	rrtype uint16
+}
+
+// rrsets groups rrs by owner and type, and their RRSIGs by covered type
+func rrsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.OPT:
+		case *dns.RRSIG:
+			key := rrsetKey{strings.ToLower(hdr.Name), rr.TypeCovered}
+			sigs[key] = append(sigs[key], rr)
+		default:
+			key := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+			sets[key] = append(sets[key], rr)
+		}
+	}
+	return sets, sigs
+}
+
+// Validate checks signatures of resp, secure is true when every answer rrset or the denial proof is validated
+// answers of zones proven unsigned are insecure, other failures are ErrBogus
+func (v *DNSSECValidator) Validate(resp *dns.Msg) (secure bool, err error) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return false, nil
+	}
+	q := resp.Question[0]
+	secure = true
+	var expanded []*dns.RRSIG // Signatures of answers expanded from a wildcard
+	sets, sigs := rrsets(resp.Answer)
+	for key, rrset := range sets {
+		sig, ok, err := v.verifyOrInsecure(key.name, rrset, sigs[key])
+		if err != nil {
+			return false, err
+		}
+		if ok && int(sig.Labels) < labelCount(key.name) {
+			expanded = append(expanded, sig)
+		}
+		secure = secure && ok
+	}
+	answered := len(sets) != 0 && resp.Rcode == dns.RcodeSuccess
+	if answered && len(expanded) == 0 {
+		return secure, nil
+	}
+
+	// Negative or wildcard answer, the authority section should prove the name, type or a closer match doesn't exist
+	sets, sigs = rrsets(resp.Ns)
+	var nsecs []dns.RR
+	signed := false
+	for key, rrset := range sets {
+		if len(sigs[key]) == 0 {
+			continue
+		}
+		signed = true
+		ok, err := v.verify(rrset, sigs[key])
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+		if key.rrtype == dns.TypeNSEC || key.rrtype == dns.TypeNSEC3 {
+			nsecs = append(nsecs, rrset...)
+		}
+	}
+	for _, sig := range expanded {
+		if !noCloserMatch(nsecs, sig.Hdr.Name, int(sig.Labels)) {
+			return false, fmt.Errorf("%w: no denial proof of closer match of wildcard answer %s", ErrBogus, sig.Hdr.Name)
+		}
+	}
+	if answered {
+		return secure, nil
+	}
+	name := cnameTarget(resp.Answer, q.Name)
+	if !signed {
+		ok, err := v.insecure(name)
+		if err != nil || !ok {
+			return false, fmt.Errorf("%w: unsigned negative answer of %s", ErrBogus, name)
+		}
+		return false, nil
+	}
+	if !denies(nsecs, name, q.Qtype, resp.Rcode == dns.RcodeNameError) {
+		return false, fmt.Errorf("%w: no denial proof of %s %s", ErrBogus, name, dns.TypeToString[q.Qtype])
+	}
+	return secure, nil
+}
+
+// cnameTarget follows CNAME records of answer from name to the name the answer ends with
+func cnameTarget(answer []dns.RR, name string) string {
+	for i := 0; i < len(answer); i++ { // Bounded, CNAME loops stop after len(answer) steps
+		found := false
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				name, found = cname.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+// verifyOrInsecure verifies rrset of name, an unsigned rrset is insecure when its zone is proven unsigned
+func (v *DNSSECValidator) verifyOrInsecure(name string, rrset []dns.RR, sigs []*dns.RRSIG) (*dns.RRSIG, bool, error) {
+	if len(sigs) != 0 {
+		return v.verifySig(rrset, sigs)
+	}
+	ok, err := v.insecure(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, fmt.Errorf("%w: unsigned %s in signed zone", ErrBogus, name)
+	}
+	return nil, false, nil
+}
+
+// verify checks rrset against one of sigs, secure is false when the signer zone is proven unsigned
+func (v *DNSSECValidator) verify(rrset []dns.RR, sigs []*dns.RRSIG) (secure bool, err error) {
+	_, secure, err = v.verifySig(rrset, sigs)
+	return secure, err
+}
+
+// verifySig is verify returning the signature which validates rrset
+func (v *DNSSECValidator) verifySig(rrset []dns.RR, sigs []*dns.RRSIG) (valid *dns.RRSIG, secure bool, err error) {
+	owner := rrset[0].Header().Name
+	now := time.Now()
+	err = fmt.Errorf("%w: no valid signature of %s", ErrBogus, owner)
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		zone, keyErr := v.zoneKeys(sig.SignerName)
+		if keyErr != nil {
+			err = keyErr
+			continue
+		}
+		if !zone.secure {
+			return nil, false, nil
+		}
+		for _, key := range zone.keys {
+			if key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+				return sig, true, nil
+			}
+		}
+	}
+	return nil, false, err
+}
+
+// zoneKeys returns validated keys of zone, from a trust anchor or the DS records of its parent
+func (v *DNSSECValidator) zoneKeys(zone string) (zoneKeys, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	v.mu.Lock()
+	cached, ok := v.zones[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	anchors, anchored := v.Anchors[zone]
+	if !anchored {
+		if zone == "." {
+			return zoneKeys{}, fmt.Errorf("%w: no trust anchor", ErrBogus)
+		}
+		resp, err := v.query(zone, dns.TypeDS)
+		if err != nil {
+			return zoneKeys{}, err
+		}
+		sets, sigs := rrsets(resp.Answer)
+		key := rrsetKey{zone, dns.TypeDS}
+		if len(sets[key]) == 0 {
+			unsigned, err := v.insecure(zone)
+			if err != nil || !unsigned {
+				return zoneKeys{}, fmt.Errorf("%w: no DS of signed zone %s", ErrBogus, zone)
+			}
+			return v.cacheKeys(zone, zoneKeys{}, resp), nil
+		}
+		secure, err := v.verify(sets[key], sigs[key])
+		if err != nil {
+			return zoneKeys{}, err
+		}
+		if !secure {
+			return v.cacheKeys(zone, zoneKeys{}, resp), nil
+		}
+		anchors = sets[key]
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return zoneKeys{}, err
+	}
+	sets, sigs := rrsets(resp.Answer)
+	key := rrsetKey{zone, dns.TypeDNSKEY}
+	var keys []*dns.DNSKEY
+	for _, rr := range sets[key] {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+	now := time.Now()
+	for _, sig := range sigs[key] {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && trusted(k, anchors) && sig.Verify(k, sets[key]) == nil {
+				return v.cacheKeys(zone, zoneKeys{keys: keys, secure: true}, resp), nil
+			}
+		}
+	}
+	return zoneKeys{}, fmt.Errorf("%w: no trusted key of %s", ErrBogus, zone)
+}
+
+// cacheKeys keeps keys of zone for the ttl of resp
+func (v *DNSSECValidator) cacheKeys(zone string, keys zoneKeys, resp *dns.Msg) zoneKeys {
+	ttl := maxKeyCacheTime
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	keys.expires = time.Now().Add(ttl)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.zones[zone] = keys
+	return keys
+}
+
+// trusted reports whether key matches one of anchors, DS or DNSKEY records
+func trusted(key *dns.DNSKEY, anchors []dns.RR) bool {
+	for _, anchor := range anchors {
+		switch anchor := anchor.(type) {
+		case *dns.DS:
+			ds := key.ToDS(anchor.DigestType)
+			if ds != nil && ds.KeyTag == anchor.KeyTag && ds.Algorithm == anchor.Algorithm && strings.EqualFold(ds.Digest, anchor.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if key.Flags == anchor.Flags && key.Algorithm == anchor.Algorithm && key.PublicKey == anchor.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// insecure reports whether name is in a zone proven unsigned, walking DS records up to a trust anchor
+// names found insecure are cached as unsigned zones
+func (v *DNSSECValidator) insecure(name string) (bool, error) {
+	var walked []string
+	for n := strings.ToLower(dns.Fqdn(name)); ; {
+		if _, anchored := v.Anchors[n]; anchored {
+			return false, nil
+		}
+		v.mu.Lock()
+		cached, ok := v.zones[n]
+		v.mu.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return !cached.secure, nil
+		}
+		if n == "." {
+			return false, fmt.Errorf("%w: no trust anchor", ErrBogus)
+		}
+
+		resp, err := v.query(n, dns.TypeDS)
+		if err != nil {
+			return false, err
+		}
+		sets, sigs := rrsets(resp.Answer)
+		if ds := sets[rrsetKey{n, dns.TypeDS}]; len(ds) != 0 {
+			secure, err := v.verify(ds, sigs[rrsetKey{n, dns.TypeDS}])
+			return !secure, err // A signed zone has no unsigned names
+		}
+		sets, sigs = rrsets(resp.Ns)
+		var nsecs []dns.RR
+		for key, rrset := range sets {
+			if (key.rrtype != dns.TypeNSEC && key.rrtype != dns.TypeNSEC3) || len(sigs[key]) == 0 {
+				continue
+			}
+			secure, err := v.verify(rrset, sigs[key])
+			if err != nil {
+				return false, err
+			}
+			if !secure {
+				return true, nil
+			}
+			nsecs = append(nsecs, rrset...)
+		}
+		if len(nsecs) != 0 {
+			if !insecureDelegation(nsecs, n) {
+				return false, nil // Name is inside a signed zone
+			}
+			for _, name := range append(walked, n) {
+				v.cacheKeys(name, zoneKeys{}, resp)
+			}
+			return true, nil
+		}
+		walked = append(walked, n)
+		n = parentZone(n) // Unsigned answer, the cut is further up
+	}
+}
+
+// query asks upstreams for name and qtype with DNSSEC records and without upstream validation
+func (v *DNSSECValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(ednsSize, true)
+	req.CheckingDisabled = true
+	resp, _, err := v.Upstreams.Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// parentZone returns name without its first label
+func parentZone(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// insecureDelegation reports whether nsecs prove name is a delegation without DS records
+func insecureDelegation(nsecs []dns.RR, name string) bool {
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeDS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeDS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+			}
+			if rr.Flags&1 == 1 && nsec3Covers(rr, name) { // Opt-out span may hold unsigned delegations
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denies reports whether nsecs prove that name doesn't exist (nxdomain) or has no qtype records
+// a missing name also needs proof that the wildcard of its closest encloser doesn't answer instead
+func denies(nsecs []dns.RR, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain && noData(nsecs, name, qtype) {
+		return true
+	}
+	if encloser, ok := nsecEncloser(nsecs, name); ok && wildcardDenied(nsecs, encloser, qtype, nxdomain) {
+		return true
+	}
+	encloser, ok := closestEncloserProof(nsecs, name)
+	return ok && wildcardDenied(nsecs, encloser, qtype, nxdomain)
+}
+
+// noData reports whether nsecs prove that name exists without qtype records
+func noData(nsecs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if nsecCovers(rr, name) && dns.IsSubDomain(name, rr.NextDomain) { // Empty non-terminal
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if qtype == dns.TypeDS && rr.Flags&1 == 1 && nsec3Covers(rr, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wildcardDenied reports whether nsecs prove that the wildcard of encloser doesn't exist (nxdomain) or has no qtype records
+func wildcardDenied(nsecs []dns.RR, encloser string, qtype uint16, nxdomain bool) bool {
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	if !nxdomain && noData(nsecs, wildcard, qtype) {
+		return true
+	}
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, wildcard) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nsec3Covers(rr, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// noCloserMatch reports whether nsecs prove that no name closer to name than its wildcard of labels labels exists (RFC 4035 5.3.4, RFC 5155 8.8)
+func noCloserMatch(nsecs []dns.RR, name string, labels int) bool {
+	nextCloser := ancestor(name, labels+1)
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nsec3Covers(rr, nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecEncloser returns the closest encloser of name, the longest ancestor shared with an NSEC covering name
+func nsecEncloser(nsecs []dns.RR, name string) (string, bool) {
+	for _, rr := range nsecs {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || !nsecCovers(nsec, name) {
+			continue
+		}
+		labels := dns.CompareDomainName(name, nsec.Hdr.Name)
+		if n := dns.CompareDomainName(name, nsec.NextDomain); n > labels {
+			labels = n
+		}
+		if labels < dns.CountLabel(name) {
+			return ancestor(name, labels), true
+		}
+	}
+	return "", false
+}
+
+// closestEncloserProof returns the ancestor of name matched by NSEC3 records, if they cover the next closer name (RFC 5155 8.3)
+func closestEncloserProof(nsecs []dns.RR, name string) (string, bool) {
+	for nextCloser, encloser := name, parentZone(name); nextCloser != "."; nextCloser, encloser = encloser, parentZone(encloser) {
+		matched, covered := false, false
+		for _, rr := range nsecs {
+			if nsec3, ok := rr.(*dns.NSEC3); ok {
+				matched = matched || nsec3.Match(encloser)
+				covered = covered || nsec3Covers(nsec3, nextCloser)
+			}
+		}
+		if matched {
+			return encloser, covered
+		}
+	}
+	return "", false
+}
+
+// ancestor returns the last labels labels of name
+func ancestor(name string, labels int) string {
+	indexes := dns.Split(name)
+	if labels <= 0 || len(indexes) == 0 {
+		return "."
+	}
+	if labels >= len(indexes) {
+		return name
+	}
+	return name[indexes[len(indexes)-labels]:]
+}
+
+// labelCount returns labels of name as counted by RRSIG records, without a leading wildcard
+func labelCount(name string) int {
+	labels := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		labels--
+	}
+	return labels
+}
+
+// nsecCovers reports whether name sorts strictly between owner and next name of nsec
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+	return canonicalLess(owner, name) || canonicalLess(name, next) // Last NSEC of the zone
+}
+
+// nsec3Covers reports whether the hash of name sorts strictly between owner and next hash of nsec3
+// dns.NSEC3.Cover also covers the owner hash itself
+func nsec3Covers(nsec3 *dns.NSEC3, name string) bool {
+	return nsec3.Cover(name) && !nsec3.Match(name)
+}
+
+// canonicalLess reports whether a sorts before b in canonical dns order (RFC 4034 6.1)
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,326 @@
+package networkHandler
+
+import (
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testKey is a signing key of a test zone
+type testKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestKey(t *testing.T, zone string) testKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrset with its RRSIG
+func (k testKey) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+	}
+	if err := sig.Sign(k.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// signedUpstream serves signed zones . and example., and test. delegated to an unsigned zone
+// it returns the upstream and a trust anchor file of the root key
+func signedUpstream(t *testing.T) (string, string) {
+	root, example := newTestKey(t, "."), newTestKey(t, "example.")
+	tampered := example.sign(t, newRR(t, "bad.example. 60 IN A 192.0.2.2"))
+	tampered[0].(*dns.A).A[3] = 66
+	answers := map[rrsetKey][]dns.RR{
+		{".", dns.TypeDNSKEY}:              root.sign(t, root.key),
+		{"example.", dns.TypeDS}:           root.sign(t, example.key.ToDS(dns.SHA256)),
+		{"example.", dns.TypeDNSKEY}:       example.sign(t, example.key),
+		{"www.example.", dns.TypeA}:        example.sign(t, newRR(t, "www.example. 60 IN A 192.0.2.1")),
+		{"bad.example.", dns.TypeA}:        tampered,
+		{"unsigned.example.", dns.TypeA}:   {newRR(t, "unsigned.example. 60 IN A 192.0.2.4")},
+		{"host.insecure.test.", dns.TypeA}: {newRR(t, "host.insecure.test. 60 IN A 192.0.2.3")},
+	}
+	exampleNSEC := example.sign(t, newRR(t, "example. 60 IN NSEC *.wild.example. SOA NS RRSIG NSEC DNSKEY"))
+	wildNSEC := example.sign(t, newRR(t, "*.wild.example. 60 IN NSEC www.example. A RRSIG NSEC"))
+	wildA := example.sign(t, newRR(t, "*.wild.example. 60 IN A 192.0.2.5"))
+	wwwNSEC := example.sign(t, newRR(t, "www.example. 60 IN NSEC example. A RRSIG NSEC"))
+	testNSEC := root.sign(t, newRR(t, "test. 60 IN NSEC zzz. NS RRSIG NSEC"))
+
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		name := strings.ToLower(q.Name)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if rrs, ok := answers[rrsetKey{name, q.Qtype}]; ok {
+			msg.Answer = rrs
+		} else if dns.IsSubDomain("wild.example.", name) && name != "wild.example." && q.Qtype == dns.TypeA {
+			for _, rr := range wildA { // Expanded from the wildcard, with proof that name doesn't exist
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Name
+				msg.Answer = append(msg.Answer, rr)
+			}
+			if name != "noproof.wild.example." {
+				msg.Ns = wildNSEC
+			}
+		} else if name == "www.example." {
+			msg.Ns = wwwNSEC
+		} else if dns.IsSubDomain("example.", name) {
+			msg.Rcode = dns.RcodeNameError
+			msg.Ns = exampleNSEC
+		} else if name == "test." && q.Qtype == dns.TypeDS {
+			msg.Ns = testNSEC
+		}
+		w.WriteMsg(msg)
+	})
+
+	anchorPath := filepath.Join(t.TempDir(), "root.key")
+	if err := ioutil.WriteFile(anchorPath, []byte(root.key.ToDS(dns.SHA256).String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return addr, anchorPath
+}
+
+func TestLoadTrustAnchors(t *testing.T) {
+	_, anchorPath := signedUpstream(t)
+	anchors, err := LoadTrustAnchors(anchorPath)
+	if err != nil || len(anchors["."]) != 1 {
+		t.Errorf("LoadTrustAnchors(%s)=%v, %v", anchorPath, anchors, err)
+	}
+	emptyPath := filepath.Join(t.TempDir(), "empty.key")
+	if err := ioutil.WriteFile(emptyPath, []byte(". 60 IN NS a.root-servers.net.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if anchors, err := LoadTrustAnchors(emptyPath); err == nil {
+		t.Errorf("LoadTrustAnchors(%s)=%v, want error", emptyPath, anchors)
+	}
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	addr, anchorPath := signedUpstream(t)
+	anchors, err := LoadTrustAnchors(anchorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams := testUpstreams(t, addr, time.Second)
+	handler := &DNSHandler{Upstreams: upstreams, Validator: NewDNSSECValidator(anchors, upstreams)}
+
+	var tests = []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ad    bool
+	}{
+		{"www.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"www.example.", dns.TypeAAAA, dns.RcodeSuccess, true},
+		{"nx.example.", dns.TypeA, dns.RcodeNameError, true},
+		{"host.wild.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"noproof.wild.example.", dns.TypeA, dns.RcodeServerFailure, false},
+		{"bad.example.", dns.TypeA, dns.RcodeServerFailure, false},
+		{"unsigned.example.", dns.TypeA, dns.RcodeServerFailure, false},
+		{"host.insecure.test.", dns.TypeA, dns.RcodeSuccess, false},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		req.SetEdns0(1232, true)
+		w := newUDPWriter()
+		handler.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != test.rcode || w.msg.AuthenticatedData != test.ad {
+			t.Errorf("ServeDNS(%s %s)=%v, want rcode %s ad %v", test.name, dns.TypeToString[test.qtype], w.msg,
+				dns.RcodeToString[test.rcode], test.ad)
+		}
+	}
+}
+
+func TestDNSSECValidator_NoDO(t *testing.T) {
+	addr, anchorPath := signedUpstream(t)
+	anchors, err := LoadTrustAnchors(anchorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams := testUpstreams(t, addr, time.Second)
+	handler := &DNSHandler{Upstreams: upstreams, Validator: NewDNSSECValidator(anchors, upstreams)}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.", dns.TypeA)
+	w := newUDPWriter()
+	handler.ServeDNS(w, req)
+	if w.msg == nil || w.msg.AuthenticatedData || len(w.msg.Answer) != 1 {
+		t.Errorf("ServeDNS(www.example.)=%v, want one A record without AD", w.msg)
+	}
+	req.AuthenticatedData = true
+	handler.ServeDNS(w, req)
+	if w.msg == nil || !w.msg.AuthenticatedData || len(w.msg.Answer) != 1 {
+		t.Errorf("ServeDNS(www.example. AD)=%v, want one A record with AD", w.msg)
+	}
+
+	if _, err := handler.Validator.Validate(tamperedAnswer(t, handler)); !errors.Is(err, ErrBogus) {
+		t.Errorf("Validate(tampered)=%v, want %v", err, ErrBogus)
+	}
+}
+
+// tamperedAnswer returns signed answer of www.example. with a changed address
+func tamperedAnswer(t *testing.T, handler *DNSHandler) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.", dns.TypeA)
+	req.SetEdns0(1232, true)
+	resp, _, err := handler.Upstreams.Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			a.A = a.A.To4()
+			a.A[3] = 99
+		}
+	}
+	return resp
+}
+
+func TestNSECCovers(t *testing.T) {
+	var tests = []struct {
+		owner, next, name string
+		covers            bool
+	}{
+		{"example.", "www.example.", "nx.example.", true},
+		{"example.", "www.example.", "a.www.example.", false},
+		{"example.", "www.example.", "www.example.", false},
+		{"example.", "b.example.", "a.example.", true},
+		{"www.example.", "example.", "zzz.example.", true},
+		{"www.example.", "example.", "a.example.", false},
+		{"Example.", "WWW.example.", "nx.EXAMPLE.", true},
+	}
+	for _, test := range tests {
+		nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: test.owner}, NextDomain: test.next}
+		if covers := nsecCovers(nsec, test.name); covers != test.covers {
+			t.Errorf("nsecCovers(%s %s, %s)=%v", test.owner, test.next, test.name, covers)
+		}
+	}
+}
+
+// nsec3Chain returns NSEC3 records of names with their types, hashed without salt and iterations
+func nsec3Chain(zone string, names map[string][]uint16) []dns.RR {
+	var hashes []string
+	types := make(map[string][]uint16)
+	for name, bitmap := range names {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, hash)
+		types[hash] = bitmap
+	}
+	sort.Strings(hashes)
+	chain := make([]dns.RR, len(hashes))
+	for i, hash := range hashes {
+		chain[i] = &dns.NSEC3{Hdr: dns.RR_Header{Name: hash + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+			Hash: dns.SHA1, NextDomain: hashes[(i+1)%len(hashes)], TypeBitMap: types[hash]}
+	}
+	return chain
+}
+
+// nsec3Proof returns records of chain matching or covering one of names
+func nsec3Proof(chain []dns.RR, names ...string) []dns.RR {
+	var proof []dns.RR
+	for _, rr := range chain {
+		for _, name := range names {
+			if rr.(*dns.NSEC3).Match(name) || rr.(*dns.NSEC3).Cover(name) {
+				proof = append(proof, rr)
+				break
+			}
+		}
+	}
+	return proof
+}
+
+func TestDenies(t *testing.T) {
+	nsec := func(s string) dns.RR {
+		return newRR(t, strings.Replace(s, " ", " 60 IN NSEC ", 1))
+	}
+	apex := []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+	host := []uint16{dns.TypeA, dns.TypeRRSIG}
+	// nx.example. and *.example. hash into different NSEC3 records, and neither into the one of example.
+	plain := nsec3Chain("example.", map[string][]uint16{"example.": apex, "a.example.": host, "www.example.": host})
+	wild := nsec3Chain("example.", map[string][]uint16{"example.": apex, "a.example.": host, "www.example.": host, "*.example.": host})
+	var tests = []struct {
+		nsecs    []dns.RR
+		name     string
+		qtype    uint16
+		nxdomain bool
+		denies   bool
+	}{
+		{[]dns.RR{nsec("www.example. example. A RRSIG NSEC")}, "www.example.", dns.TypeAAAA, false, true},
+		{[]dns.RR{nsec("www.example. example. A RRSIG NSEC")}, "www.example.", dns.TypeA, false, false},
+		{[]dns.RR{nsec("example. www.example. SOA NS RRSIG NSEC")}, "nx.example.", dns.TypeA, true, true},
+		{[]dns.RR{nsec("www.example. example. A RRSIG NSEC")}, "zzz.example.", dns.TypeA, true, false},
+		{[]dns.RR{nsec("www.example. example. A RRSIG NSEC"), nsec("example. www.example. SOA NS RRSIG NSEC")},
+			"zzz.example.", dns.TypeA, true, true},
+		{[]dns.RR{nsec("*.example. www.example. A RRSIG NSEC")}, "nx.example.", dns.TypeA, true, false},
+		{[]dns.RR{nsec("*.example. www.example. A RRSIG NSEC")}, "nx.example.", dns.TypeAAAA, false, true},
+		{[]dns.RR{nsec("*.example. www.example. A RRSIG NSEC")}, "nx.example.", dns.TypeA, false, false},
+		{[]dns.RR{nsec("*.example. a.b.example. A RRSIG NSEC")}, "b.example.", dns.TypeA, false, true},
+		{nsec3Proof(plain, "example.", "nx.example.", "*.example."), "nx.example.", dns.TypeA, true, true},
+		{nsec3Proof(plain, "example.", "nx.example."), "nx.example.", dns.TypeA, true, false},
+		{nsec3Proof(plain, "www.example."), "www.example.", dns.TypeAAAA, false, true},
+		{nsec3Proof(wild, "example.", "nx.example.", "*.example."), "nx.example.", dns.TypeA, true, false},
+		{nsec3Proof(wild, "example.", "nx.example.", "*.example."), "nx.example.", dns.TypeAAAA, false, true},
+		{nsec3Proof(wild, "example.", "nx.example.", "*.example."), "nx.example.", dns.TypeA, false, false},
+	}
+	for _, test := range tests {
+		if denies := denies(test.nsecs, test.name, test.qtype, test.nxdomain); denies != test.denies {
+			t.Errorf("denies(%v, %s %s, %v)=%v", test.nsecs, test.name, dns.TypeToString[test.qtype], test.nxdomain, denies)
+		}
+	}
+}
+
+func TestNoCloserMatch(t *testing.T) {
+	wild := nsec3Chain("example.", map[string][]uint16{"example.": {dns.TypeSOA}, "*.example.": {dns.TypeA}})
+	var tests = []struct {
+		nsecs  []dns.RR
+		name   string
+		labels int
+		proves bool
+	}{
+		{[]dns.RR{newRR(t, "*.example. 60 IN NSEC www.example. A RRSIG NSEC")}, "host.example.", 1, true},
+		{[]dns.RR{newRR(t, "*.example. 60 IN NSEC www.example. A RRSIG NSEC")}, "zzz.example.", 1, false},
+		{nsec3Proof(wild, "host.example."), "host.example.", 1, true},
+		{nsec3Proof(wild, "host.example."), "a.host.example.", 1, true},
+		{nsec3Proof(wild, "example."), "host.example.", 1, false},
+		{nil, "host.example.", 1, false},
+	}
+	for _, test := range tests {
+		if proves := noCloserMatch(test.nsecs, test.name, test.labels); proves != test.proves {
+			t.Errorf("noCloserMatch(%v, %s, %d)=%v", test.nsecs, test.name, test.labels, proves)
+		}
+	}
+}
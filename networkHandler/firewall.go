@@ -0,0 +1,346 @@
+package networkHandler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Firewall installs packetify rules into chains of its own, rules added later take precedence
+// every change replaces all packetify rules by one atomic batch, a failed batch is rolled back
+type Firewall interface {
+	Name() string
+	Setup() error                       // Creates packetify chains, removing rules left by an earlier run
+	Cleanup() error                     // Removes packetify chains and their rules
+	Add(rules ...FirewallRule) error    // Installs rules
+	Delete(rules ...FirewallRule) error // Removes rules installed by Add
+	Render(rules []FirewallRule) string // Batch which makes rules the only packetify rules
+}
+
+// NewFirewall returns firewall of backend iptables or nftables, auto picks iptables unless it isn't installed
+// iptables rules also pass the FORWARD policy of the ip filter table, which docker and others set to drop
+func NewFirewall(backend string) (Firewall, error) {
+	switch backend {
+	case "iptables":
+		return &IPTables{}, nil
+	case "nftables", "nft":
+		return &NFTables{}, nil
+	case "", "auto":
+		if _, err := exec.LookPath("iptables"); err != nil {
+			return &NFTables{}, nil
+		}
+		return &IPTables{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall %q, use iptables, nftables or auto", backend)
+}
+
+// firewallRules are the installed rules of a Firewall, oldest first
+type firewallRules struct {
+	mu    sync.Mutex
+	rules []FirewallRule
+}
+
+// add applies installed rules with rules
+func (s *firewallRules) add(apply func([]FirewallRule) error, rules []FirewallRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replace(apply, append(append([]FirewallRule(nil), s.rules...), rules...))
+}
+
+// remove applies installed rules without rules, the newest of equal rules is removed
+func (s *firewallRules) remove(apply func([]FirewallRule) error, rules []FirewallRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	installed := append([]FirewallRule(nil), s.rules...)
+	for _, rule := range rules {
+		i := indexOfRule(installed, rule)
+		if i == -1 {
+			return fmt.Errorf("firewall rule %+v isn't installed", rule)
+		}
+		installed = append(installed[:i], installed[i+1:]...)
+	}
+	return s.replace(apply, installed)
+}
+
+// reset forgets installed rules
+func (s *firewallRules) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = nil
+}
+
+// replace applies installed, applying the rules before again when it fails, callers must hold s.mu
+func (s *firewallRules) replace(apply func([]FirewallRule) error, installed []FirewallRule) error {
+	if err := apply(installed); err != nil {
+		if rollbackErr := apply(s.rules); rollbackErr != nil {
+			log.Println("error rolling back firewall rules", rollbackErr)
+		}
+		return err
+	}
+	s.rules = installed
+	return nil
+}
+
+// indexOfRule returns index of the newest rule of rules equal to rule, -1 when there's none
+func indexOfRule(rules []FirewallRule, rule FirewallRule) int {
+	want := fmt.Sprintf("%#v", rule)
+	for i := len(rules) - 1; i >= 0; i-- {
+		if fmt.Sprintf("%#v", rules[i]) == want {
+			return i
+		}
+	}
+	return -1
+}
+
+// FirewallRule is a kind of packetify rule which renders itself for each backend
+type FirewallRule interface {
+	iptables() []iptablesRule
+	nftables() []nftablesRule
+}
+
+// ipv6FirewallRule is a FirewallRule with ip6tables rules too, its nftables rules cover both families
+type ipv6FirewallRule interface {
+	ip6tables() []iptablesRule
+}
+
+// iptablesRule is a rule spec of the packetify chain of hook in table
+type iptablesRule struct {
+	table string
+	hook  string
+	spec  []string
+}
+
+// nftablesRule is a rule statement of the packetify chain of hook
+type nftablesRule struct {
+	hook string
+	rule string
+}
+
+// Packetify chains by hook, iptables chains are jumped to from the builtin chain of the hook
+const (
+	hookInput       = "input"
+	hookForward     = "forward"
+	hookPrerouting  = "prerouting"
+	hookPostrouting = "postrouting"
+)
+
+var firewallHooks = []string{hookInput, hookForward, hookPrerouting, hookPostrouting}
+
+// NAT masquerades traffic of IPRange which leaves through other interfaces than Iface
+type NAT struct {
+	Iface   string
+	IPRange net.IPNet
+}
+
+func (r NAT) iptables() []iptablesRule {
+	return []iptablesRule{
+		{"nat", hookPostrouting, []string{"-s", r.IPRange.String(), "!", "-o", r.Iface, "-j", "MASQUERADE"}},
+	}
+}
+
+func (r NAT) nftables() []nftablesRule {
+	return []nftablesRule{
+		{hookPostrouting, fmt.Sprintf("ip saddr %s oifname != %q masquerade", r.IPRange.String(), r.Iface)},
+	}
+}
+
+// AcceptForward forwards traffic of IPRange from Iface and answers to it from ShareIface
+type AcceptForward struct {
+	Iface      string
+	ShareIface string
+	IPRange    net.IPNet
+}
+
+func (r AcceptForward) iptables() []iptablesRule {
+	return []iptablesRule{
+		{"filter", hookForward, []string{"-i", r.Iface, "-s", r.IPRange.String(), "-j", "ACCEPT"}},
+		{"filter", hookForward, []string{"-i", r.ShareIface, "-d", r.IPRange.String(), "-j", "ACCEPT"}},
+	}
+}
+
+func (r AcceptForward) nftables() []nftablesRule {
+	return []nftablesRule{
+		{hookForward, fmt.Sprintf("iifname %q ip saddr %s accept", r.Iface, r.IPRange.String())},
+		{hookForward, fmt.Sprintf("iifname %q ip daddr %s accept", r.ShareIface, r.IPRange.String())},
+	}
+}
+
+// AcceptInput accepts Proto (tcp or udp) traffic to Port of the host
+type AcceptInput struct {
+	Proto string
+	Port  uint16
+}
+
+func (r AcceptInput) iptables() []iptablesRule {
+	port := strconv.Itoa(int(r.Port))
+	return []iptablesRule{
+		{"filter", hookInput, []string{"-p", r.Proto, "-m", r.Proto, "--dport", port, "-j", "ACCEPT"}},
+	}
+}
+
+func (r AcceptInput) nftables() []nftablesRule {
+	return []nftablesRule{{hookInput, fmt.Sprintf("%s dport %d accept", r.Proto, r.Port)}}
+}
+
+// DNSRedirect sends dns queries of IPRange to the AP address to a dns server on Port of the AP
+// Intercept redirects queries to any address entering Iface and drops dns over tls, so clients can't bypass policies
+// with IPv6 ipv6 queries are intercepted too, for the dns server on port 53 of that AP address
+type DNSRedirect struct {
+	IPRange   net.IPNet
+	Port      uint16
+	Iface     string
+	Intercept bool
+	IPv6      net.IP
+}
+
+func (r DNSRedirect) iptables() []iptablesRule {
+	port := strconv.Itoa(int(r.Port))
+	var rules []iptablesRule
+	for _, proto := range []string{"tcp", "udp"} {
+		rules = append(rules, iptablesRule{"filter", hookInput, []string{"-p", proto, "-m", proto, "--dport", port, "-j", "ACCEPT"}})
+		if r.Intercept {
+			rules = append(rules,
+				iptablesRule{"filter", hookForward, []string{"-i", r.Iface, "-p", proto, "-m", proto, "--dport", "853", "-j", "DROP"}},
+				iptablesRule{"nat", hookPrerouting, []string{"-i", r.Iface,
+					"-p", proto, "-m", proto, "--dport", "53", "-j", "REDIRECT", "--to-ports", port}})
+		} else {
+			rules = append(rules, iptablesRule{"nat", hookPrerouting, []string{"-s", r.IPRange.String(), "-d", r.IPRange.IP.String(),
+				"-p", proto, "-m", proto, "--dport", "53", "-j", "REDIRECT", "--to-ports", port}})
+		}
+	}
+	return rules
+}
+
+func (r DNSRedirect) ip6tables() []iptablesRule {
+	if !r.Intercept || r.IPv6 == nil {
+		return nil
+	}
+	var rules []iptablesRule
+	for _, proto := range []string{"tcp", "udp"} {
+		rules = append(rules,
+			iptablesRule{"filter", hookInput, []string{"-d", r.IPv6.String(), "-p", proto, "-m", proto, "--dport", "53", "-j", "ACCEPT"}},
+			iptablesRule{"filter", hookForward, []string{"-i", r.Iface, "-p", proto, "-m", proto, "--dport", "853", "-j", "DROP"}},
+			iptablesRule{"nat", hookPrerouting, []string{"-i", r.Iface, "!", "-d", r.IPv6.String(),
+				"-p", proto, "-m", proto, "--dport", "53", "-j", "DNAT", "--to-destination", fmt.Sprintf("[%s]:53", r.IPv6)}})
+	}
+	return rules
+}
+
+func (r DNSRedirect) nftables() []nftablesRule {
+	var rules []nftablesRule
+	for _, proto := range []string{"tcp", "udp"} {
+		rules = append(rules, nftablesRule{hookInput, fmt.Sprintf("%s dport %d accept", proto, r.Port)})
+		if !r.Intercept {
+			rules = append(rules, nftablesRule{hookPrerouting, fmt.Sprintf("ip saddr %s ip daddr %s %s dport 53 redirect to :%d",
+				r.IPRange.String(), r.IPRange.IP.String(), proto, r.Port)})
+			continue
+		}
+		rules = append(rules,
+			nftablesRule{hookForward, fmt.Sprintf("iifname %q %s dport 853 drop", r.Iface, proto)},
+			nftablesRule{hookPrerouting, fmt.Sprintf("iifname %q meta nfproto ipv4 %s dport 53 redirect to :%d", r.Iface, proto, r.Port)})
+		if r.IPv6 != nil {
+			rules = append(rules,
+				nftablesRule{hookInput, fmt.Sprintf("ip6 daddr %s %s dport 53 accept", r.IPv6, proto)},
+				nftablesRule{hookPrerouting, fmt.Sprintf("iifname %q ip6 daddr != %s %s dport 53 dnat ip6 to [%s]:53",
+					r.Iface, r.IPv6, proto, r.IPv6)})
+		}
+	}
+	return rules
+}
+
+// ClientBlock drops everything MAC sends through Iface
+type ClientBlock struct {
+	Iface string
+	MAC   net.HardwareAddr
+}
+
+func (r ClientBlock) iptables() []iptablesRule {
+	spec := []string{"-i", r.Iface, "-m", "mac", "--mac-source", r.MAC.String(), "-j", "DROP"}
+	return []iptablesRule{{"filter", hookInput, spec}, {"filter", hookForward, spec}}
+}
+
+func (r ClientBlock) nftables() []nftablesRule {
+	rule := fmt.Sprintf("iifname %q ether saddr %s drop", r.Iface, r.MAC.String())
+	return []nftablesRule{{hookInput, rule}, {hookForward, rule}}
+}
+
+// PortForward sends Proto connections to Port arriving on Iface to ToPort of client IP
+type PortForward struct {
+	Iface  string
+	Proto  string // tcp or udp
+	Port   uint16
+	IP     net.IP
+	ToPort uint16
+}
+
+// ParsePortForward parses proto:port=ip:port like tcp:8080=192.168.100.10:80 of connections arriving on iface
+func ParsePortForward(iface, spec string) (PortForward, error) {
+	pf := PortForward{Iface: iface}
+	i := strings.IndexByte(spec, '=')
+	if i == -1 {
+		return pf, fmt.Errorf("port forward %q isn't proto:port=ip:port", spec)
+	}
+	proto, port, err := net.SplitHostPort(spec[:i])
+	if err != nil {
+		return pf, fmt.Errorf("port forward %q: %v", spec, err)
+	}
+	if proto != "tcp" && proto != "udp" {
+		return pf, fmt.Errorf("port forward %q: protocol isn't tcp or udp", spec)
+	}
+	host, toPort, err := net.SplitHostPort(spec[i+1:])
+	if err != nil {
+		return pf, fmt.Errorf("port forward %q: %v", spec, err)
+	}
+	pf.Proto = proto
+	if pf.IP = net.ParseIP(host).To4(); pf.IP == nil {
+		return pf, fmt.Errorf("port forward %q: %q isn't an ipv4 address", spec, host)
+	}
+	if pf.Port, err = parsePort(port); err != nil {
+		return pf, fmt.Errorf("port forward %q: %v", spec, err)
+	}
+	if pf.ToPort, err = parsePort(toPort); err != nil {
+		return pf, fmt.Errorf("port forward %q: %v", spec, err)
+	}
+	return pf, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+func (r PortForward) String() string {
+	return fmt.Sprintf("%s:%d=%s:%d", r.Proto, r.Port, r.IP, r.ToPort)
+}
+
+func (r PortForward) iptables() []iptablesRule {
+	port, toPort := strconv.Itoa(int(r.Port)), strconv.Itoa(int(r.ToPort))
+	return []iptablesRule{
+		{"nat", hookPrerouting, []string{"-i", r.Iface, "-p", r.Proto, "-m", r.Proto, "--dport", port,
+			"-j", "DNAT", "--to-destination", net.JoinHostPort(r.IP.String(), toPort)}},
+		{"filter", hookForward, []string{"-i", r.Iface, "-d", r.IP.String(), "-p", r.Proto, "-m", r.Proto, "--dport", toPort, "-j", "ACCEPT"}},
+	}
+}
+
+func (r PortForward) nftables() []nftablesRule {
+	return []nftablesRule{
+		{hookPrerouting, fmt.Sprintf("iifname %q %s dport %d dnat to %s:%d", r.Iface, r.Proto, r.Port, r.IP, r.ToPort)},
+		{hookForward, fmt.Sprintf("iifname %q ip daddr %s %s dport %d accept", r.Iface, r.IP, r.Proto, r.ToPort)},
+	}
+}
+
+// InternetSharingRules are rules of an AP on iface sharing internet of shareIface with clients of ipRange
+func InternetSharingRules(iface string, shareIface string, ipRange net.IPNet) []FirewallRule {
+	return []FirewallRule{
+		NAT{Iface: iface, IPRange: ipRange},
+		AcceptForward{Iface: iface, ShareIface: shareIface, IPRange: ipRange},
+		AcceptInput{Proto: "udp", Port: 67},
+	}
+}
@@ -0,0 +1,223 @@
+package networkHandler
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParsePortForward(t *testing.T) {
+	var tests = []struct {
+		spec string
+		want string
+		ok   bool
+	}{
+		{"tcp:8080=192.168.100.10:80", "tcp:8080=192.168.100.10:80", true},
+		{"udp:51820=192.168.100.20:51820", "udp:51820=192.168.100.20:51820", true},
+		{"icmp:1=192.168.100.10:1", "", false},
+		{"tcp:8080=fd00::10:80", "", false},
+		{"tcp:0=192.168.100.10:80", "", false},
+		{"tcp:8080=192.168.100.10:70000", "", false},
+		{"tcp:8080", "", false},
+		{"8080=192.168.100.10:80", "", false},
+	}
+	for _, test := range tests {
+		pf, err := ParsePortForward("eth0", test.spec)
+		if (err == nil) != test.ok || (test.ok && (pf.String() != test.want || pf.Iface != "eth0")) {
+			t.Errorf("ParsePortForward(%s)=%v, %v", test.spec, pf, err)
+		}
+	}
+}
+
+func TestNewFirewall(t *testing.T) {
+	var tests = []struct {
+		backend string
+		name    string
+		ok      bool
+	}{
+		{"iptables", "iptables", true},
+		{"nftables", "nftables", true},
+		{"nft", "nftables", true},
+		{"pf", "", false},
+	}
+	for _, test := range tests {
+		firewall, err := NewFirewall(test.backend)
+		if (err == nil) != test.ok || (test.ok && firewall.Name() != test.name) {
+			t.Errorf("NewFirewall(%s)=%v, %v", test.backend, firewall, err)
+		}
+	}
+}
+
+func TestIPTablesRules(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("192.168.100.0/24")
+	ipRange.IP = net.IPv4(192, 168, 100, 1).To4()
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	var tests = []struct {
+		rule FirewallRule
+		want []string
+	}{
+		{NAT{Iface: "wlan1", IPRange: *ipRange}, []string{
+			"-A PACKETIFY-NAT -s 192.168.100.1/24 ! -o wlan1 -j MASQUERADE",
+		}},
+		{DNSRedirect{IPRange: *ipRange, Port: 5300}, []string{
+			"-A PACKETIFY-INPUT -p tcp -m tcp --dport 5300 -j ACCEPT",
+			"-A PACKETIFY-INPUT -p udp -m udp --dport 5300 -j ACCEPT",
+			"-A PACKETIFY-PRE -s 192.168.100.1/24 -d 192.168.100.1 -p tcp -m tcp --dport 53 -j REDIRECT --to-ports 5300",
+			"-A PACKETIFY-PRE -s 192.168.100.1/24 -d 192.168.100.1 -p udp -m udp --dport 53 -j REDIRECT --to-ports 5300",
+		}},
+		{DNSRedirect{IPRange: *ipRange, Port: 5300, Iface: "wlan1", Intercept: true}, []string{
+			"-A PACKETIFY-INPUT -p tcp -m tcp --dport 5300 -j ACCEPT",
+			"-A PACKETIFY-FWD -i wlan1 -p tcp -m tcp --dport 853 -j DROP",
+			"-A PACKETIFY-INPUT -p udp -m udp --dport 5300 -j ACCEPT",
+			"-A PACKETIFY-FWD -i wlan1 -p udp -m udp --dport 853 -j DROP",
+			"-A PACKETIFY-PRE -i wlan1 -p tcp -m tcp --dport 53 -j REDIRECT --to-ports 5300",
+			"-A PACKETIFY-PRE -i wlan1 -p udp -m udp --dport 53 -j REDIRECT --to-ports 5300",
+		}},
+		{ClientBlock{Iface: "wlan1", MAC: mac}, []string{
+			"-A PACKETIFY-INPUT -i wlan1 -m mac --mac-source 02:00:00:00:00:01 -j DROP",
+			"-A PACKETIFY-FWD -i wlan1 -m mac --mac-source 02:00:00:00:00:01 -j DROP",
+		}},
+		{PortForward{Iface: "eth0", Proto: "tcp", Port: 8080, IP: net.IPv4(192, 168, 100, 10), ToPort: 80}, []string{
+			"-A PACKETIFY-FWD -i eth0 -d 192.168.100.10 -p tcp -m tcp --dport 80 -j ACCEPT",
+			"-A PACKETIFY-PRE -i eth0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 192.168.100.10:80",
+		}},
+	}
+	firewall := &IPTables{}
+	for _, test := range tests {
+		var rules []string
+		for _, line := range strings.Split(firewall.Render([]FirewallRule{test.rule}), "\n") {
+			if strings.HasPrefix(line, "-A ") {
+				rules = append(rules, line)
+			}
+		}
+		if strings.Join(rules, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("Render(%T)=%v, want %v", test.rule, rules, test.want)
+		}
+	}
+}
+
+func TestIPTables_Render(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	rules := []FirewallRule{AcceptInput{Proto: "udp", Port: 67}, ClientBlock{Iface: "wlan1", MAC: mac}}
+	want := `*filter
+:PACKETIFY-INPUT - [0:0]
+:PACKETIFY-FWD - [0:0]
+-I INPUT -j PACKETIFY-INPUT
+-I FORWARD -j PACKETIFY-FWD
+-A PACKETIFY-INPUT -i wlan1 -m mac --mac-source 02:00:00:00:00:01 -j DROP
+-A PACKETIFY-FWD -i wlan1 -m mac --mac-source 02:00:00:00:00:01 -j DROP
+-A PACKETIFY-INPUT -p udp -m udp --dport 67 -j ACCEPT
+COMMIT
+*nat
+:PACKETIFY-PRE - [0:0]
+:PACKETIFY-NAT - [0:0]
+-I PREROUTING -j PACKETIFY-PRE
+-I POSTROUTING -j PACKETIFY-NAT
+COMMIT
+`
+	if batch := (&IPTables{}).Render(rules); batch != want {
+		t.Errorf("Render()=%s, want %s", batch, want)
+	}
+	jumped := &IPTables{jumped: make(map[string]bool)}
+	for _, hook := range firewallHooks {
+		jumped.jumped["iptables"+hook] = true
+	}
+	if batch := jumped.Render(rules); strings.Contains(batch, "-I ") {
+		t.Errorf("Render() with jumps in place=%s", batch)
+	}
+}
+
+func TestIPTables_RenderIPv6(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("192.168.100.0/24")
+	redirect := DNSRedirect{IPRange: *ipRange, Port: 5300, Iface: "wlan1", Intercept: true, IPv6: net.ParseIP("fd00::1")}
+	batch := (&IPTables{}).Render([]FirewallRule{redirect})
+	i := strings.Index(batch, "# ip6tables-restore\n")
+	if i == -1 {
+		t.Fatalf("Render()=%s, want ip6tables batch", batch)
+	}
+	for _, want := range []string{
+		"-A PACKETIFY-INPUT -d fd00::1 -p udp -m udp --dport 53 -j ACCEPT\n",
+		"-A PACKETIFY-FWD -i wlan1 -p tcp -m tcp --dport 853 -j DROP\n",
+		"-A PACKETIFY-PRE -i wlan1 ! -d fd00::1 -p udp -m udp --dport 53 -j DNAT --to-destination [fd00::1]:53\n",
+	} {
+		if !strings.Contains(batch[i:], want) {
+			t.Errorf("Render() ip6tables batch=%s, want %q in it", batch[i:], want)
+		}
+	}
+	redirect.IPv6 = nil
+	if batch := (&IPTables{}).Render([]FirewallRule{redirect}); strings.Contains(batch, "ip6tables") {
+		t.Errorf("Render() without ipv6 address=%s", batch)
+	}
+}
+
+func TestFirewallRules(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	dhcp, block := AcceptInput{Proto: "udp", Port: 67}, ClientBlock{Iface: "wlan1", MAC: mac}
+	var applied [][]FirewallRule
+	fail := false
+	apply := func(rules []FirewallRule) error {
+		applied = append(applied, rules)
+		if fail {
+			fail = false
+			return errors.New("batch failed")
+		}
+		return nil
+	}
+
+	var installed firewallRules
+	if err := installed.add(apply, []FirewallRule{dhcp, block}); err != nil || len(installed.rules) != 2 {
+		t.Errorf("add()=%v, installed %v", err, installed.rules)
+	}
+	fail = true
+	if err := installed.add(apply, []FirewallRule{AcceptInput{Proto: "tcp", Port: 22}}); err == nil || len(installed.rules) != 2 {
+		t.Errorf("add() of failing batch=%v, installed %v", err, installed.rules)
+	}
+	if rollback := applied[len(applied)-1]; len(rollback) != 2 {
+		t.Errorf("rolled back to %v, want the 2 installed rules", rollback)
+	}
+	if err := installed.remove(apply, []FirewallRule{ClientBlock{Iface: "wlan1", MAC: mac}}); err != nil || len(installed.rules) != 1 {
+		t.Errorf("remove()=%v, installed %v", err, installed.rules)
+	}
+	if err := installed.remove(apply, []FirewallRule{block}); err == nil {
+		t.Errorf("remove() of missing rule=%v, installed %v", err, installed.rules)
+	}
+	if len(applied) != 4 {
+		t.Errorf("applied %d batches, want 4", len(applied))
+	}
+}
+
+func TestRenderNFTables(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("192.168.100.0/24")
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	rules := append(InternetSharingRules("wlan1", "eth0", *ipRange), ClientBlock{Iface: "wlan1", MAC: mac})
+	script := renderNFTables(rules)
+	for _, want := range []string{
+		"add table inet packetify\ndelete table inet packetify\n",
+		"chain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n\t\tip saddr 192.168.100.0/24 oifname != \"wlan1\" masquerade\n",
+		"\t\tiifname \"wlan1\" ether saddr 02:00:00:00:00:01 drop\n\t\tiifname \"wlan1\" ip saddr 192.168.100.0/24 accept\n",
+		"\t\tudp dport 67 accept\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("renderNFTables()=%s, want %q in it", script, want)
+		}
+	}
+	redirect := DNSRedirect{IPRange: *ipRange, Port: 5300, Iface: "wlan1", Intercept: true, IPv6: net.ParseIP("fd00::1")}
+	script = renderNFTables([]FirewallRule{redirect})
+	for _, want := range []string{
+		"\t\tiifname \"wlan1\" tcp dport 853 drop\n",
+		"\t\tiifname \"wlan1\" meta nfproto ipv4 udp dport 53 redirect to :5300\n",
+		"\t\tiifname \"wlan1\" ip6 daddr != fd00::1 udp dport 53 dnat ip6 to [fd00::1]:53\n",
+		"\t\tip6 daddr fd00::1 tcp dport 53 accept\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("renderNFTables(%+v)=%s, want %q in it", redirect, script, want)
+		}
+	}
+	if i := indexOfRule(rules, ClientBlock{Iface: "wlan1", MAC: mac}); i != 3 {
+		t.Errorf("indexOfRule(ClientBlock)=%d, want 3", i)
+	}
+	if i := indexOfRule(rules, AcceptInput{Proto: "tcp", Port: 67}); i != -1 {
+		t.Errorf("indexOfRule(AcceptInput tcp)=%d, want -1", i)
+	}
+}
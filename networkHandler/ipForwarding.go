@@ -108,3 +108,40 @@ func (ns *NetworkService) DisableIpForwardingIface(iface net.Interface) error {
 	}
 	return nil
 }
+
+// EnableIPv6Forwarding enables ipv6 forwarding on all interfaces via sysctl
+func (ns *NetworkService) EnableIPv6Forwarding() error {
+	//do nothing if enabled
+	if ns.IPv6ForwardingStatus() {
+		return nil
+	}
+	if _, err := exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1").Output(); err != nil {
+		return fmt.Errorf(" Error Enable IPv6 forwarding %v", err)
+	}
+	return nil
+}
+
+// DisableIPv6Forwarding disables ipv6 forwarding on all interfaces via sysctl
+func (ns *NetworkService) DisableIPv6Forwarding() error {
+	if _, err := exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=0").Output(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IPv6ForwardingStatus reports whether ipv6 forwarding is enabled on all interfaces
+func (ns *NetworkService) IPv6ForwardingStatus() bool {
+	status, _ := ioutil.ReadFile("/proc/sys/net/ipv6/conf/all/forwarding")
+	return strings.TrimSpace(string(status)) == "1"
+}
+
+// AcceptRA returns accept_ra of iface, 2 keeps router advertisements accepted while forwarding
+func (ns *NetworkService) AcceptRA(iface string) (string, error) {
+	value, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", iface))
+	return strings.TrimSpace(string(value)), err
+}
+
+// SetAcceptRA sets accept_ra of iface
+func (ns *NetworkService) SetAcceptRA(iface, value string) error {
+	return ioutil.WriteFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", iface), []byte(value), 0644)
+}
@@ -1,104 +1,203 @@
 package networkHandler
 
 import (
+	"bytes"
 	"fmt"
 	"log"
-	"net"
 	"os/exec"
 	"strings"
 )
 
-func EnableDnsServer(ipRange net.IPNet, port uint16) error {
+// iptablesChain is a packetify chain of table and the builtin chain jumping to it
+// packetify rules live only in these chains so rules of docker, libvirt or ufw stay untouched
+type iptablesChain struct {
+	table   string
+	builtin string
+	name    string
+}
+
+// iptablesChains are packetify chains by hook
+var iptablesChains = map[string]iptablesChain{
+	hookInput:       {"filter", "INPUT", "PACKETIFY-INPUT"},
+	hookForward:     {"filter", "FORWARD", "PACKETIFY-FWD"},
+	hookPrerouting:  {"nat", "PREROUTING", "PACKETIFY-PRE"},
+	hookPostrouting: {"nat", "POSTROUTING", "PACKETIFY-NAT"},
+}
+
+// iptablesTables are tables of packetify chains in the order of iptables-restore batches
+var iptablesTables = []string{"filter", "nat"}
+
+// iptablesFamilies are commands of ipv4 and ipv6 chains, ip6tables is only used for rules with ipv6 rules
+var iptablesFamilies = []string{"iptables", "ip6tables"}
 
-	commands := []string{
-		fmt.Sprintf("-w -I INPUT -p tcp -m tcp --dport %d -j ACCEPT", port),
-		fmt.Sprintf("-w -I INPUT -p udp -m udp --dport %d -j ACCEPT", port),
-		fmt.Sprintf("-w -t nat -I PREROUTING -s %s -d %s -p tcp -m tcp --dport 53 -j REDIRECT --to-ports %d",
-			ipRange.String(), ipRange.IP.String(), port),
-		fmt.Sprintf("-w -t nat -I PREROUTING -s %s -d %s -p udp -m udp --dport 53 -j REDIRECT --to-ports %d",
-			ipRange.String(), ipRange.IP.String(), port),
+// IPTables is the Firewall of iptables chains, changed by iptables-restore batches which keep other chains
+type IPTables struct {
+	installed firewallRules
+	jumped    map[string]bool // Families and hooks whose builtin chain jumps to the packetify chain, the batch adds missing jumps
+	ipv6      bool            // Whether ip6tables chains were set up for ipv6 rules
+}
+
+func (f *IPTables) Name() string {
+	return "iptables"
+}
+
+// Setup creates packetify chains and the jumps to them, rules left in them by an earlier run are flushed
+func (f *IPTables) Setup() error {
+	f.installed.reset()
+	f.jumped = make(map[string]bool)
+	f.ipv6 = false
+	f.checkJumps("iptables")
+	return f.apply(nil)
+}
+
+// checkJumps records which builtin chains of family already jump to packetify chains
+func (f *IPTables) checkJumps(family string) {
+	for _, hook := range firewallHooks {
+		chain := iptablesChains[hook]
+		f.jumped[family+hook] = iptablesCheck(family, "-w", "-t", chain.table, "-C", chain.builtin, "-j", chain.name)
 	}
+}
 
-	for _, command := range commands {
-		cmd := exec.Command("iptables", strings.Split(command, " ")...)
-		log.Println(cmd.String())
-		if err := cmd.Run(); err != nil {
-			return err
+// Cleanup deletes jumps to packetify chains and the chains with their rules, other chains stay untouched
+func (f *IPTables) Cleanup() error {
+	f.installed.reset()
+	f.jumped = nil
+	f.ipv6 = false
+	for _, family := range iptablesFamilies {
+		if _, err := exec.LookPath(family); err != nil {
+			continue
+		}
+		for _, hook := range firewallHooks {
+			chain := iptablesChains[hook]
+			for iptablesCheck(family, "-w", "-t", chain.table, "-D", chain.builtin, "-j", chain.name) {
+				// A jump may be there twice after a crash
+			}
+			if !iptablesCheck(family, "-w", "-t", chain.table, "-n", "-L", chain.name) {
+				continue
+			}
+			if err := runIPTables(family, "-w", "-t", chain.table, "-F", chain.name); err != nil {
+				return err
+			}
+			if err := runIPTables(family, "-w", "-t", chain.table, "-X", chain.name); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
+}
 
+// Add inserts rules before older ones
+func (f *IPTables) Add(rules ...FirewallRule) error {
+	return f.installed.add(f.apply, rules)
 }
 
-func EnableInternetSharing(iface string, netSahreIface string, ipRange net.IPNet, flush bool) error {
-	if flush {
-		if err := IPTablesFlash(); err != nil {
-			return err
-		}
-	}
-	commands := []string{
-		fmt.Sprintf("-w -t nat -I POSTROUTING -s %s ! -o %s -j MASQUERADE", ipRange.String(), iface),
-		fmt.Sprintf("-w -I FORWARD -i %s -s %s -j ACCEPT", iface, ipRange.String()),
-		fmt.Sprintf("-w -I FORWARD -i %s -d %s -j ACCEPT", netSahreIface, ipRange.String()),
-		fmt.Sprintf("-w -I INPUT -p udp -m udp --dport 67 -j ACCEPT"),
+// Delete removes rules installed by Add
+func (f *IPTables) Delete(rules ...FirewallRule) error {
+	return f.installed.remove(f.apply, rules)
+}
+
+// Render returns iptables-restore --noflush input which replaces rules of packetify chains with rules
+// declaring a chain flushes it, chains of others stay untouched, builtin chains get jumps they miss
+// ipv6 rules follow as ip6tables-restore input
+func (f *IPTables) Render(rules []FirewallRule) string {
+	batch := f.render("iptables", rules)
+	if f.ipv6 || hasIPv6Rules(rules) {
+		batch += "# ip6tables-restore\n" + f.render("ip6tables", rules)
 	}
+	return batch
+}
 
-	for _, command := range commands {
-		cmd := exec.Command("iptables", strings.Split(command, " ")...)
-		log.Println(cmd.String())
-		if err := cmd.Run(); err != nil {
-			return err
+// render returns restore input of family for rules
+func (f *IPTables) render(family string, rules []FirewallRule) string {
+	var batch strings.Builder
+	for _, table := range iptablesTables {
+		fmt.Fprintf(&batch, "*%s\n", table)
+		for _, hook := range firewallHooks {
+			if chain := iptablesChains[hook]; chain.table == table {
+				fmt.Fprintf(&batch, ":%s - [0:0]\n", chain.name)
+			}
 		}
+		for _, hook := range firewallHooks {
+			if chain := iptablesChains[hook]; chain.table == table && !f.jumped[family+hook] {
+				fmt.Fprintf(&batch, "-I %s -j %s\n", chain.builtin, chain.name)
+			}
+		}
+		for i := len(rules) - 1; i >= 0; i-- {
+			for _, r := range familyRules(family, rules[i]) {
+				if r.table == table {
+					fmt.Fprintf(&batch, "-A %s %s\n", iptablesChains[r.hook].name, strings.Join(r.spec, " "))
+				}
+			}
+		}
+		batch.WriteString("COMMIT\n")
 	}
-	return nil
+	return batch.String()
 }
 
-func IPTablesFlash() error {
-
-	commandArgs := []string{
-		"-t nat -F",
-		"-F",
+// familyRules returns iptables or ip6tables rules of rule
+func familyRules(family string, rule FirewallRule) []iptablesRule {
+	if family == "iptables" {
+		return rule.iptables()
 	}
-	for _, command := range commandArgs {
-		if err := exec.Command("iptables", strings.Split(command, " ")...).Run(); err != nil {
-			return err
-		}
+	if rule, ok := rule.(ipv6FirewallRule); ok {
+		return rule.ip6tables()
 	}
 	return nil
 }
 
-func DisableInternetSharing(iface string, netSahreIface string, ipRange net.IPNet) error {
-	commands := []string{
-		fmt.Sprintf("-w -t nat -D POSTROUTING -s %s ! -o %s -j MASQUERADE", ipRange.String(), iface),
-		fmt.Sprintf("-w -D FORWARD -i %s -s %s -j ACCEPT", iface, ipRange.String()),
-		fmt.Sprintf("-w -D FORWARD -i %s -d %s -j ACCEPT", netSahreIface, ipRange.String()),
-	}
-	for _, command := range commands {
-		cmd := exec.Command("iptables", strings.Split(command, " ")...)
-		log.Println(cmd.String())
-		if err := cmd.Run(); err != nil {
-			return err
+// hasIPv6Rules reports whether one of rules has ip6tables rules
+func hasIPv6Rules(rules []FirewallRule) bool {
+	for _, rule := range rules {
+		if len(familyRules("ip6tables", rule)) != 0 {
+			return true
 		}
 	}
+	return false
+}
+
+// apply replaces rules of packetify chains, ip6tables chains are set up by the first rules with ipv6 rules
+func (f *IPTables) apply(rules []FirewallRule) error {
+	if f.jumped == nil {
+		f.jumped = make(map[string]bool)
+	}
+	if err := f.restore("iptables", rules); err != nil {
+		return err
+	}
+	if !f.ipv6 && !hasIPv6Rules(rules) {
+		return nil
+	}
+	if !f.ipv6 {
+		f.checkJumps("ip6tables")
+	}
+	if err := f.restore("ip6tables", rules); err != nil {
+		return err
+	}
+	f.ipv6 = true
 	return nil
 }
 
-func DisableDnsServer(ipRange net.IPNet, port uint16) error {
-	commands := []string{
-		fmt.Sprintf("-w -D INPUT -p tcp -m tcp --dport %s -j ACCEPT", port),
-		fmt.Sprintf("-w -D INPUT -p udp -m udp --dport %s -j ACCEPT", port),
-		fmt.Sprintf("-w -t nat -D PREROUTING -s %s -d %s -p tcp -m tcp --dport 53 -j REDIRECT --to-ports %s",
-			ipRange.String(), ipRange.IP.String(), port),
-		fmt.Sprintf("-w -t nat -D PREROUTING -s %s -d %s -p udp -m udp --dport 53 -j REDIRECT --to-ports %s",
-			ipRange.String(), ipRange.IP.String(), port),
-		fmt.Sprintf("-w -D INPUT -p udp -m udp --dport 67 -j ACCEPT"),
+// restore applies the batch of family for rules, builtin chains jump to packetify chains afterwards
+func (f *IPTables) restore(family string, rules []FirewallRule) error {
+	cmd := exec.Command(family+"-restore", "-w", "--noflush")
+	cmd.Stdin = strings.NewReader(f.render(family, rules))
+	log.Println(cmd.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", cmd.String(), err, bytes.TrimSpace(output))
 	}
-	for _, command := range commands {
-		cmd := exec.Command("iptables", strings.Split(command, " ")...)
-		log.Println(cmd.String())
-		if err := cmd.Run(); err != nil {
-			return err
-		}
+	for _, hook := range firewallHooks {
+		f.jumped[family+hook] = true
 	}
 	return nil
 }
+
+// runIPTables runs iptables command of family with args
+func runIPTables(family string, args ...string) error {
+	cmd := exec.Command(family, args...)
+	log.Println(cmd.String())
+	return cmd.Run()
+}
+
+// iptablesCheck reports whether iptables command of family with args succeeds, for listing and checking rules
+func iptablesCheck(family string, args ...string) bool {
+	return exec.Command(family, args...).Run() == nil
+}
@@ -0,0 +1,94 @@
+package networkHandler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+)
+
+// nftablesTable is the table of packetify chains of ipv4 and ipv6, other tables stay untouched
+const nftablesTable = "inet packetify"
+
+// nftablesChains are base chain specs of packetify chains by hook
+var nftablesChains = map[string]string{
+	hookInput:       "type filter hook input priority filter; policy accept;",
+	hookForward:     "type filter hook forward priority filter; policy accept;",
+	hookPrerouting:  "type nat hook prerouting priority dstnat; policy accept;",
+	hookPostrouting: "type nat hook postrouting priority srcnat; policy accept;",
+}
+
+// NFTables is the Firewall of the packetify nftables table
+// the table is replaced as a whole by one nft -f transaction on every change
+// accepting in it doesn't override drops of other tables, like those of iptables-nft
+type NFTables struct {
+	installed firewallRules
+}
+
+func (f *NFTables) Name() string {
+	return "nftables"
+}
+
+// Setup replaces the packetify table by an empty one
+func (f *NFTables) Setup() error {
+	f.installed.reset()
+	return f.apply(nil)
+}
+
+// Cleanup deletes the packetify table
+func (f *NFTables) Cleanup() error {
+	f.installed.reset()
+	return runNFT(fmt.Sprintf("add table %s\ndelete table %s\n", nftablesTable, nftablesTable))
+}
+
+// Add installs rules before older ones
+func (f *NFTables) Add(rules ...FirewallRule) error {
+	return f.installed.add(f.apply, rules)
+}
+
+// Delete removes rules installed by Add
+func (f *NFTables) Delete(rules ...FirewallRule) error {
+	return f.installed.remove(f.apply, rules)
+}
+
+// Render returns nft script replacing the packetify table with one of rules
+func (f *NFTables) Render(rules []FirewallRule) string {
+	return renderNFTables(rules)
+}
+
+func (f *NFTables) apply(rules []FirewallRule) error {
+	return runNFT(renderNFTables(rules))
+}
+
+// renderNFTables returns nft script replacing the packetify table with one of rules, newest rules first
+func renderNFTables(rules []FirewallRule) string {
+	byHook := make(map[string][]string)
+	for i := len(rules) - 1; i >= 0; i-- {
+		for _, r := range rules[i].nftables() {
+			byHook[r.hook] = append(byHook[r.hook], r.rule)
+		}
+	}
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "add table %s\ndelete table %s\n", nftablesTable, nftablesTable) // Adding first makes deleting a missing table fine
+	fmt.Fprintf(&script, "table %s {\n", nftablesTable)
+	for _, hook := range firewallHooks {
+		fmt.Fprintf(&script, "\tchain %s {\n\t\t%s\n", hook, nftablesChains[hook])
+		for _, rule := range byHook[hook] {
+			fmt.Fprintf(&script, "\t\t%s\n", rule)
+		}
+		script.WriteString("\t}\n")
+	}
+	script.WriteString("}\n")
+	return script.String()
+}
+
+// runNFT runs nft script as one transaction
+func runNFT(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(script)
+	log.Println(cmd.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", cmd.String(), err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package packetParser
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// rateWindow is the time constant of the moving average of client rates
+const rateWindow = 10 * time.Second
+
+// Usage is traffic of a client, up is sent by the client and down is sent to it
+// totals survive restarts through the usage file, rates start at zero
+type Usage struct {
+	MAC         string    `json:"mac"`
+	IP          string    `json:"ip,omitempty"` // Last address of the client in the AP range
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+	PacketsUp   uint64    `json:"packets_up"`
+	PacketsDown uint64    `json:"packets_down"`
+	RateUp      float64   `json:"rate_up"`   // Bytes per second
+	RateDown    float64   `json:"rate_down"` // Bytes per second
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// clientUsage is usage of a client with the totals of the last rate update
+type clientUsage struct {
+	Usage
+	lastUp   uint64
+	lastDown uint64
+}
+
+// Accounting counts frames on the AP interface per client mac
+// frames from a mac other than the AP are up for it, frames to one are down for it
+type Accounting struct {
+	IPRange net.IPNet
+
+	mu       sync.Mutex
+	clients  map[string]*clientUsage
+	lastTick time.Time
+	stopped  bool
+}
+
+// NewAccounting returns empty accounting of clients in ipRange
+func NewAccounting(ipRange net.IPNet) *Accounting {
+	return &Accounting{IPRange: ipRange, clients: make(map[string]*clientUsage)}
+}
+
+// Restore continues totals of usages, read from the usage file of an earlier run
+func (a *Accounting) Restore(usages []Usage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, usage := range usages {
+		usage.RateUp, usage.RateDown = 0, 0
+		a.clients[usage.MAC] = &clientUsage{Usage: usage, lastUp: usage.BytesUp, lastDown: usage.BytesDown}
+	}
+}
+
+// Count counts an ethernet frame of length bytes on the wire, local is the mac of the AP
+func (a *Accounting) Count(data []byte, length int, local net.HardwareAddr, t time.Time) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return
+	}
+	eth := ethLayer.(*layers.Ethernet)
+	var srcIP, dstIP net.IP
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv4)
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return
+	}
+	if client := a.client(eth.SrcMAC, local, srcIP, t); client != nil {
+		client.BytesUp += uint64(length)
+		client.PacketsUp++
+	}
+	if client := a.client(eth.DstMAC, local, dstIP, t); client != nil {
+		client.BytesDown += uint64(length)
+		client.PacketsDown++
+	}
+}
+
+// client returns usage of mac seen at t with address ip, nil for the AP and group macs, callers must hold a.mu
+func (a *Accounting) client(mac, local net.HardwareAddr, ip net.IP, t time.Time) *clientUsage {
+	if len(mac) != 6 || mac[0]&1 == 1 || bytes.Equal(mac, local) {
+		return nil
+	}
+	client, ok := a.clients[mac.String()]
+	if !ok {
+		client = &clientUsage{Usage: Usage{MAC: mac.String(), FirstSeen: t}}
+		a.clients[client.MAC] = client
+	}
+	if ip != nil && a.IPRange.Contains(ip) && !ip.Equal(a.IPRange.IP) {
+		client.IP = ip.String()
+	}
+	client.LastSeen = t
+	return client
+}
+
+// Tick updates moving averages of client rates with traffic since the last tick
+func (a *Accounting) Tick(t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return
+	}
+	elapsed := t.Sub(a.lastTick)
+	if a.lastTick.IsZero() || elapsed <= 0 {
+		elapsed = 0
+	}
+	a.lastTick = t
+	// Weight of the last interval, a full interval of rateWindow counts 63%
+	weight := 1 - math.Exp(-elapsed.Seconds()/rateWindow.Seconds())
+	for _, client := range a.clients {
+		if elapsed != 0 {
+			up := float64(client.BytesUp-client.lastUp) / elapsed.Seconds()
+			down := float64(client.BytesDown-client.lastDown) / elapsed.Seconds()
+			client.RateUp += (up - client.RateUp) * weight
+			client.RateDown += (down - client.RateDown) * weight
+		}
+		client.lastUp, client.lastDown = client.BytesUp, client.BytesDown
+	}
+}
+
+// Stop ends counting and rate updates, usages stay as they are for a last write of the usage file
+func (a *Accounting) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+}
+
+// Usages returns usage of all clients seen, sorted by mac
+func (a *Accounting) Usages() []Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usages := make([]Usage, 0, len(a.clients))
+	for _, client := range a.clients {
+		usages = append(usages, client.Usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].MAC < usages[j].MAC
+	})
+	return usages
+}
+
+// usageFile is the content of a usage file
+type usageFile struct {
+	Time    time.Time `json:"time"`
+	Clients []Usage   `json:"clients"`
+}
+
+// WriteUsage replaces usage file of path with usages at t atomically
+func WriteUsage(path string, t time.Time, usages []Usage) error {
+	content, err := json.MarshalIndent(usageFile{Time: t, Clients: usages}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadUsage reads usage file of path with the time it was written, a missing file has no usage
+func ReadUsage(path string) (time.Time, []Usage, error) {
+	var file usageFile
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file.Time, nil, nil
+	}
+	if err != nil {
+		return file.Time, nil, err
+	}
+	err = json.Unmarshal(content, &file)
+	return file.Time, file.Clients, err
+}
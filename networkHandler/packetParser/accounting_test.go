@@ -0,0 +1,124 @@
+package packetParser
+
+import (
+	"math"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	apMAC       = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	clientMAC   = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0, 0, 1}
+	_, apNet, _ = net.ParseCIDR("192.168.100.0/24")
+)
+
+// frame returns an ethernet frame of an ipv4 udp packet from src to dst
+func frame(t *testing.T, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP string) []byte {
+	eth := layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP(srcIP).To4(), DstIP: net.ParseIP(dstIP).To4()}
+	udp := layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(&ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &ip, &udp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAccounting_Count(t *testing.T) {
+	accounting := NewAccounting(net.IPNet{IP: net.ParseIP("192.168.100.1"), Mask: apNet.Mask})
+	now := time.Now()
+	var tests = []struct {
+		data   []byte
+		length int
+	}{
+		{frame(t, clientMAC, apMAC, "192.168.100.10", "1.1.1.1"), 1000},
+		{frame(t, apMAC, clientMAC, "1.1.1.1", "192.168.100.10"), 1500},
+		{frame(t, apMAC, clientMAC, "1.1.1.1", "192.168.100.10"), 1500},
+		{frame(t, clientMAC, layers.EthernetBroadcast, "0.0.0.0", "255.255.255.255"), 300},
+		{frame(t, apMAC, layers.EthernetBroadcast, "192.168.100.1", "192.168.100.255"), 300},
+		{[]byte{0x01}, 1},
+	}
+	for _, test := range tests {
+		accounting.Count(test.data, test.length, apMAC, now)
+	}
+	usages := accounting.Usages()
+	want := Usage{MAC: clientMAC.String(), IP: "192.168.100.10", BytesUp: 1300, BytesDown: 3000,
+		PacketsUp: 2, PacketsDown: 2, FirstSeen: now, LastSeen: now}
+	if len(usages) != 1 || usages[0] != want {
+		t.Errorf("Usages()=%+v, want %+v", usages, want)
+	}
+}
+
+func TestAccounting_Stop(t *testing.T) {
+	accounting := NewAccounting(*apNet)
+	now := time.Now()
+	data := frame(t, apMAC, clientMAC, "1.1.1.1", "192.168.100.10")
+	accounting.Count(data, 1000, apMAC, now)
+	accounting.Stop()
+	accounting.Count(data, 1000, apMAC, now)
+	accounting.Tick(now.Add(time.Second))
+	if usages := accounting.Usages(); len(usages) != 1 || usages[0].BytesDown != 1000 || usages[0].RateDown != 0 {
+		t.Errorf("Usages() after Stop()=%+v, want 1000 bytes down", usages)
+	}
+}
+
+func TestAccounting_Tick(t *testing.T) {
+	accounting := NewAccounting(*apNet)
+	start := time.Now()
+	accounting.Restore([]Usage{{MAC: clientMAC.String(), BytesUp: 5000, BytesDown: 7000, RateUp: 42}})
+	accounting.Tick(start)
+	if usage := accounting.Usages()[0]; usage.RateUp != 0 || usage.RateDown != 0 {
+		t.Errorf("Tick() after Restore()=%+v, want no rates", usage)
+	}
+
+	// A steady 1000 bytes per second down approaches 1000
+	data := frame(t, apMAC, clientMAC, "1.1.1.1", "192.168.100.10")
+	for i := 1; i <= 60; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		accounting.Count(data, 1000, apMAC, now)
+		accounting.Tick(now)
+	}
+	usage := accounting.Usages()[0]
+	if math.Abs(usage.RateDown-1000) > 10 || usage.RateUp != 0 {
+		t.Errorf("Tick()=%+v, want 1000 bytes per second down", usage)
+	}
+	if usage.BytesDown != 67000 || usage.BytesUp != 5000 {
+		t.Errorf("Tick()=%+v, want restored totals", usage)
+	}
+}
+
+func TestUsageFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	if _, usages, err := ReadUsage(path); err != nil || len(usages) != 0 {
+		t.Errorf("ReadUsage(missing)=%v, %v", usages, err)
+	}
+	now := time.Now().UTC().Round(time.Second)
+	usages := []Usage{
+		{MAC: "aa:bb:cc:00:00:01", IP: "192.168.100.10", BytesUp: 1 << 30, BytesDown: 1 << 32, PacketsUp: 3, PacketsDown: 4,
+			RateUp: 12.5, RateDown: 1000, FirstSeen: now.Add(-time.Hour), LastSeen: now},
+		{MAC: "aa:bb:cc:00:00:02", FirstSeen: now, LastSeen: now},
+	}
+	if err := WriteUsage(path, now, usages); err != nil {
+		t.Fatal(err)
+	}
+	written, loaded, err := ReadUsage(path)
+	if err != nil || !written.Equal(now) || len(loaded) != len(usages) {
+		t.Fatalf("ReadUsage()=%v, %v, %v", written, loaded, err)
+	}
+	for i, usage := range usages {
+		if !loaded[i].FirstSeen.Equal(usage.FirstSeen) || !loaded[i].LastSeen.Equal(usage.LastSeen) {
+			t.Errorf("ReadUsage()[%d]=%+v, want %+v", i, loaded[i], usage)
+		}
+		loaded[i].FirstSeen, loaded[i].LastSeen = usage.FirstSeen, usage.LastSeen
+		if loaded[i] != usage {
+			t.Errorf("ReadUsage()[%d]=%+v, want %+v", i, loaded[i], usage)
+		}
+	}
+}
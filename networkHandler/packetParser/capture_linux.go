@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package packetParser
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+// captureLength is enough for ethernet and ip headers, lengths on the wire are counted in full
+const captureLength = 128
+
+// Capture counts frames of iface into a until ctx is done or iface goes away
+func (a *Accounting) Capture(ctx context.Context, iface string) error {
+	handle, err := pcapgo.NewEthernetHandle(iface)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetCaptureLength(captureLength); err != nil {
+		log.Println(err)
+		return err
+	}
+	local := handle.LocalAddr()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				a.Tick(t)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		// Reads block until the next frame, deleting iface on cleanup ends them with an error
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		a.Count(data, ci.Length, local, ci.Timestamp)
+	}
+}
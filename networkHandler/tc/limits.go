@@ -0,0 +1,182 @@
+package tc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Limit is a rate limit of a client, zero rates are unlimited
+type Limit struct {
+	Down  uint64 // Bits per second to the client
+	Up    uint64 // Bits per second from the client
+	Burst uint64 // Bytes sent at full speed above the rates, 0 lets tc pick it
+}
+
+// IsZero reports whether limit doesn't limit anything
+func (l Limit) IsZero() bool {
+	return l.Down == 0 && l.Up == 0
+}
+
+func (l Limit) String() string {
+	s := fmt.Sprintf("down %s up %s", FormatRate(l.Down), FormatRate(l.Up))
+	if l.Burst != 0 {
+		s += " burst " + FormatSize(l.Burst)
+	}
+	return s
+}
+
+// rateUnits are tc rate units in bits per second
+var rateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// ParseRate parses a tc rate like 5mbit or 512kbit into bits per second, bps units are bytes per second
+// a bare number is bits per second, empty is unlimited
+func ParseRate(s string) (uint64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	number, multiplier := strings.ToLower(s), 1.0
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(number, unit.suffix), unit.bits
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, use a number with bit, kbit, mbit or gbit", s)
+	}
+	return uint64(value * multiplier), nil
+}
+
+// FormatRate returns bits per second as tc rate, unlimited for 0
+func FormatRate(bits uint64) string {
+	switch {
+	case bits == 0:
+		return "unlimited"
+	case bits%1e9 == 0:
+		return fmt.Sprintf("%dgbit", bits/1e9)
+	case bits%1e6 == 0:
+		return fmt.Sprintf("%dmbit", bits/1e6)
+	case bits%1e3 == 0:
+		return fmt.Sprintf("%dkbit", bits/1e3)
+	}
+	return fmt.Sprintf("%dbit", bits)
+}
+
+// ParseSize parses a tc size like 32kb or 1500 into bytes, empty is 0
+func ParseSize(s string) (uint64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	number, multiplier := strings.TrimSuffix(strings.ToLower(s), "b"), uint64(1)
+	switch {
+	case strings.HasSuffix(number, "k"):
+		number, multiplier = strings.TrimSuffix(number, "k"), 1<<10
+	case strings.HasSuffix(number, "m"):
+		number, multiplier = strings.TrimSuffix(number, "m"), 1<<20
+	}
+	value, err := strconv.ParseUint(number, 10, 64)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("invalid size %q, use bytes with b, kb or mb", s)
+	}
+	return value * multiplier, nil
+}
+
+// FormatSize returns bytes as tc size
+func FormatSize(bytes uint64) string {
+	switch {
+	case bytes != 0 && bytes%(1<<20) == 0:
+		return fmt.Sprintf("%dmb", bytes>>20)
+	case bytes != 0 && bytes%(1<<10) == 0:
+		return fmt.Sprintf("%dkb", bytes>>10)
+	}
+	return fmt.Sprintf("%db", bytes)
+}
+
+// limitConfig is the json form of Limit
+type limitConfig struct {
+	Down  string `json:"down,omitempty"`
+	Up    string `json:"up,omitempty"`
+	Burst string `json:"burst,omitempty"`
+}
+
+// ParseLimit returns limit of tc rates down and up and tc size burst, empty rates are unlimited
+func ParseLimit(down, up, burst string) (Limit, error) {
+	var limit Limit
+	var err error
+	if limit.Down, err = ParseRate(down); err != nil {
+		return limit, err
+	}
+	if limit.Up, err = ParseRate(up); err != nil {
+		return limit, err
+	}
+	if limit.Burst, err = ParseSize(burst); err != nil {
+		return limit, err
+	}
+	return limit, nil
+}
+
+// LoadLimits reads limits by client mac from a json file, a missing file has no limits
+func LoadLimits(path string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return limits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]limitConfig
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for mac, c := range configs {
+		limit, err := ParseLimit(c.Down, c.Up, c.Burst)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, mac, err)
+		}
+		limits[mac] = limit
+	}
+	return limits, nil
+}
+
+// WriteLimits replaces json file of path with limits by client mac atomically
+func WriteLimits(path string, limits map[string]Limit) error {
+	configs := make(map[string]limitConfig, len(limits))
+	for mac, limit := range limits {
+		c := limitConfig{}
+		if limit.Down != 0 {
+			c.Down = FormatRate(limit.Down)
+		}
+		if limit.Up != 0 {
+			c.Up = FormatRate(limit.Up)
+		}
+		if limit.Burst != 0 {
+			c.Burst = FormatSize(limit.Burst)
+		}
+		configs[mac] = c
+	}
+	content, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,103 @@
+package tc
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	var tests = []struct {
+		rate string
+		bits uint64
+		ok   bool
+	}{
+		{"5mbit", 5e6, true},
+		{"512kbit", 512e3, true},
+		{"1.5Mbit", 15e5, true},
+		{"1gbit", 1e9, true},
+		{"1mbps", 8e6, true},
+		{"8000", 8000, true},
+		{"", 0, true},
+		{"0mbit", 0, false},
+		{"fast", 0, false},
+		{"-1mbit", 0, false},
+	}
+	for _, test := range tests {
+		bits, err := ParseRate(test.rate)
+		if (err == nil) != test.ok || bits != test.bits {
+			t.Errorf("ParseRate(%s)=%d, %v", test.rate, bits, err)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	var tests = []struct {
+		bits uint64
+		rate string
+	}{
+		{5e6, "5mbit"},
+		{15e5, "1500kbit"},
+		{2e9, "2gbit"},
+		{1234, "1234bit"},
+		{0, "unlimited"},
+	}
+	for _, test := range tests {
+		if rate := FormatRate(test.bits); rate != test.rate {
+			t.Errorf("FormatRate(%d)=%s, want %s", test.bits, rate, test.rate)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		size  string
+		bytes uint64
+		ok    bool
+	}{
+		{"32kb", 32 << 10, true},
+		{"32k", 32 << 10, true},
+		{"1mb", 1 << 20, true},
+		{"1500", 1500, true},
+		{"1500b", 1500, true},
+		{"", 0, true},
+		{"32kbit", 0, false},
+		{"0", 0, false},
+	}
+	for _, test := range tests {
+		bytes, err := ParseSize(test.size)
+		if (err == nil) != test.ok || bytes != test.bytes {
+			t.Errorf("ParseSize(%s)=%d, %v", test.size, bytes, err)
+		}
+	}
+}
+
+func TestLimitsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	if limits, err := LoadLimits(path); err != nil || len(limits) != 0 {
+		t.Errorf("LoadLimits(missing)=%v, %v", limits, err)
+	}
+	limits := map[string]Limit{
+		"aa:bb:cc:00:00:01": {Down: 5e6, Up: 1e6, Burst: 32 << 10},
+		"aa:bb:cc:00:00:02": {Down: 512e3},
+	}
+	if err := WriteLimits(path, limits); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLimits(path)
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("LoadLimits()=%v, %v", loaded, err)
+	}
+	for mac, limit := range limits {
+		if loaded[mac] != limit {
+			t.Errorf("LoadLimits()[%s]=%v, want %v", mac, loaded[mac], limit)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"aa:bb:cc:00:00:01": {"down": "fast"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if limits, err := LoadLimits(path); err == nil {
+		t.Errorf("LoadLimits(invalid rate)=%v", limits)
+	}
+}
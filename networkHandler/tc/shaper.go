@@ -0,0 +1,222 @@
+package tc
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// maxClasses bounds class minors, ffff is the handle of the ingress qdisc
+const maxClasses = 0xfffe
+
+// Shaper limits traffic of clients on Iface with a HTB class and fq_codel queue per client
+// downloads are shaped on Iface egress, uploads on the egress of IFB which gets Iface ingress
+// clients are matched by mac so limits stay valid when their address changes, unmatched traffic isn't shaped
+type Shaper struct {
+	Iface string
+	IFB   string
+
+	mu      sync.Mutex
+	limits  map[string]Limit  // Applied limits by client mac
+	classes map[string]uint16 // Class minor by client mac
+	next    uint16
+}
+
+// NewShaper returns shaper of iface using an ifb device named after it
+func NewShaper(iface string) *Shaper {
+	ifb := "ifb-" + iface
+	if len(ifb) > 15 {
+		ifb = ifb[:15] // Longest interface name
+	}
+	return &Shaper{
+		Iface:   iface,
+		IFB:     ifb,
+		limits:  make(map[string]Limit),
+		classes: make(map[string]uint16),
+		next:    2, // 1 is the root
+	}
+}
+
+// Setup creates IFB and HTB root qdiscs, removing qdiscs left by an earlier run
+func (s *Shaper) Setup() error {
+	s.Cleanup() // Best effort, there is usually nothing to clean up
+	commands := [][]string{
+		{"ip", "link", "add", s.IFB, "type", "ifb"},
+		{"ip", "link", "set", "dev", s.IFB, "up"},
+		{"tc", "qdisc", "replace", "dev", s.Iface, "root", "handle", "1:", "htb"},
+		{"tc", "qdisc", "replace", "dev", s.Iface, "handle", "ffff:", "ingress"},
+		{"tc", "filter", "add", "dev", s.Iface, "parent", "ffff:", "protocol", "all", "prio", "1",
+			"matchall", "action", "mirred", "egress", "redirect", "dev", s.IFB},
+		{"tc", "qdisc", "replace", "dev", s.IFB, "root", "handle", "1:", "htb"},
+	}
+	for _, command := range commands {
+		if err := run(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup removes qdiscs of Iface and the IFB device with all client limits
+func (s *Shaper) Cleanup() error {
+	s.mu.Lock()
+	s.limits = make(map[string]Limit)
+	s.classes = make(map[string]uint16)
+	s.mu.Unlock()
+	exec.Command("tc", "qdisc", "del", "dev", s.Iface, "ingress").Run()
+	exec.Command("tc", "qdisc", "del", "dev", s.Iface, "root").Run()
+	if err := exec.Command("ip", "link", "show", s.IFB).Run(); err != nil {
+		return nil
+	}
+	return run([]string{"ip", "link", "del", s.IFB})
+}
+
+// Set limits traffic of client mac, a zero limit removes it
+func (s *Shaper) Set(mac net.HardwareAddr, limit Limit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.set(mac.String(), limit)
+}
+
+// Remove drops limits of client mac
+func (s *Shaper) Remove(mac net.HardwareAddr) error {
+	return s.Set(mac, Limit{})
+}
+
+// Apply makes limits by client mac the only limits, unchanged limits are kept as they are
+func (s *Shaper) Apply(limits map[string]Limit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for mac := range s.limits {
+		if _, ok := limits[mac]; !ok {
+			if err := s.set(mac, Limit{}); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for mac, limit := range limits {
+		if err := s.set(mac, limit); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Limits returns applied limits by client mac
+func (s *Shaper) Limits() map[string]Limit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limits := make(map[string]Limit, len(s.limits))
+	for mac, limit := range s.limits {
+		limits[mac] = limit
+	}
+	return limits
+}
+
+// set replaces classes of client mac by those of limit, callers must hold s.mu
+func (s *Shaper) set(mac string, limit Limit) error {
+	if s.limits[mac] == limit {
+		return nil // Unchanged, zero for clients without limit
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	minor, ok := s.classes[mac]
+	if !ok {
+		if minor, err = s.allocate(); err != nil {
+			return err
+		}
+		s.classes[mac] = minor
+	}
+	for _, command := range removeCommands(s.Iface, s.IFB, minor) {
+		exec.Command(command[0], command[1:]...).Run() // Classes may not exist yet
+	}
+	delete(s.limits, mac)
+	if limit.IsZero() {
+		delete(s.classes, mac)
+		log.Println("tc removed limit of", mac)
+		return nil
+	}
+	for _, command := range limitCommands(s.Iface, s.IFB, minor, hwAddr, limit) {
+		if err := run(command); err != nil {
+			return err
+		}
+	}
+	s.limits[mac] = limit
+	log.Println("tc limited", mac, "to", limit)
+	return nil
+}
+
+// allocate returns a class minor no client uses, callers must hold s.mu
+func (s *Shaper) allocate() (uint16, error) {
+	used := make(map[uint16]bool, len(s.classes))
+	for _, minor := range s.classes {
+		used[minor] = true
+	}
+	for i := 0; i < maxClasses; i++ {
+		minor := s.next
+		s.next++
+		if s.next > maxClasses {
+			s.next = 2
+		}
+		if !used[minor] {
+			return minor, nil
+		}
+	}
+	return 0, fmt.Errorf("no free tc class on %s", s.Iface)
+}
+
+// limitCommands returns tc commands shaping client mac with class minor, downloads on iface and uploads on ifb
+func limitCommands(iface, ifb string, minor uint16, mac net.HardwareAddr, limit Limit) [][]string {
+	var commands [][]string
+	if limit.Down != 0 {
+		commands = append(commands, classCommands(iface, minor, limit.Down, limit.Burst, "dst_mac", mac)...)
+	}
+	if limit.Up != 0 {
+		commands = append(commands, classCommands(ifb, minor, limit.Up, limit.Burst, "src_mac", mac)...)
+	}
+	return commands
+}
+
+// classCommands returns tc commands of a HTB class of rate with fq_codel queue and a filter of mac matched as match
+func classCommands(dev string, minor uint16, rate, burst uint64, match string, mac net.HardwareAddr) [][]string {
+	classID := fmt.Sprintf("1:%x", minor)
+	class := []string{"tc", "class", "add", "dev", dev, "parent", "1:", "classid", classID,
+		"htb", "rate", FormatRate(rate), "ceil", FormatRate(rate)}
+	if burst != 0 {
+		class = append(class, "burst", strconv.FormatUint(burst, 10), "cburst", strconv.FormatUint(burst, 10))
+	}
+	return [][]string{
+		class,
+		{"tc", "qdisc", "add", "dev", dev, "parent", classID, "handle", fmt.Sprintf("%x:", minor), "fq_codel"},
+		{"tc", "filter", "add", "dev", dev, "parent", "1:", "protocol", "all", "prio", strconv.Itoa(int(minor)),
+			"flower", match, mac.String(), "classid", classID},
+	}
+}
+
+// removeCommands returns tc commands deleting filters and classes of minor on iface and ifb
+func removeCommands(iface, ifb string, minor uint16) [][]string {
+	var commands [][]string
+	for _, dev := range []string{iface, ifb} {
+		commands = append(commands,
+			[]string{"tc", "filter", "del", "dev", dev, "parent", "1:", "prio", strconv.Itoa(int(minor))},
+			[]string{"tc", "class", "del", "dev", dev, "classid", fmt.Sprintf("1:%x", minor)})
+	}
+	return commands
+}
+
+// run runs command, its output is part of the error
+func run(command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	log.Println(cmd.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", cmd.String(), err, bytes.TrimSpace(output))
+	}
+	return nil
+}
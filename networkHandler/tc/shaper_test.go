@@ -0,0 +1,67 @@
+package tc
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewShaper(t *testing.T) {
+	var tests = []struct {
+		iface string
+		ifb   string
+	}{
+		{"hotSpot0", "ifb-hotSpot0"},
+		{"wlp0s20f3-ap0", "ifb-wlp0s20f3-a"},
+	}
+	for _, test := range tests {
+		if shaper := NewShaper(test.iface); shaper.IFB != test.ifb {
+			t.Errorf("NewShaper(%s).IFB=%s, want %s", test.iface, shaper.IFB, test.ifb)
+		}
+	}
+}
+
+func TestLimitCommands(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:00:00:01")
+	var tests = []struct {
+		limit Limit
+		want  []string
+	}{
+		{Limit{Down: 5e6, Up: 1e6}, []string{
+			"tc class add dev ap0 parent 1: classid 1:1a htb rate 5mbit ceil 5mbit",
+			"tc qdisc add dev ap0 parent 1:1a handle 1a: fq_codel",
+			"tc filter add dev ap0 parent 1: protocol all prio 26 flower dst_mac aa:bb:cc:00:00:01 classid 1:1a",
+			"tc class add dev ifb-ap0 parent 1: classid 1:1a htb rate 1mbit ceil 1mbit",
+			"tc qdisc add dev ifb-ap0 parent 1:1a handle 1a: fq_codel",
+			"tc filter add dev ifb-ap0 parent 1: protocol all prio 26 flower src_mac aa:bb:cc:00:00:01 classid 1:1a",
+		}},
+		{Limit{Up: 512e3, Burst: 16 << 10}, []string{
+			"tc class add dev ifb-ap0 parent 1: classid 1:1a htb rate 512kbit ceil 512kbit burst 16384 cburst 16384",
+			"tc qdisc add dev ifb-ap0 parent 1:1a handle 1a: fq_codel",
+			"tc filter add dev ifb-ap0 parent 1: protocol all prio 26 flower src_mac aa:bb:cc:00:00:01 classid 1:1a",
+		}},
+	}
+	for _, test := range tests {
+		commands := limitCommands("ap0", "ifb-ap0", 26, mac, test.limit)
+		if len(commands) != len(test.want) {
+			t.Errorf("limitCommands(%v)=%v, want %v", test.limit, commands, test.want)
+			continue
+		}
+		for i, command := range commands {
+			if line := strings.Join(command, " "); line != test.want[i] {
+				t.Errorf("limitCommands(%v)[%d]=%s, want %s", test.limit, i, line, test.want[i])
+			}
+		}
+	}
+}
+
+func TestShaper_Allocate(t *testing.T) {
+	shaper := NewShaper("ap0")
+	shaper.classes["aa:bb:cc:00:00:01"] = 3
+	shaper.next = maxClasses
+	for _, want := range []uint16{maxClasses, 2, 4} {
+		if minor, err := shaper.allocate(); err != nil || minor != want {
+			t.Errorf("allocate()=%d, %v, want %d", minor, err, want)
+		}
+	}
+}
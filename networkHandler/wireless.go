@@ -190,6 +190,23 @@ func (wifiDev WifiDevice) SetupIpToVirtIface(gatewayIP *net.IPNet, virtIface str
 	return nil
 }
 
+// SetupIPv6ToVirtIface assigns ipv6 address to virtual interface
+func (wifiDev WifiDevice) SetupIPv6ToVirtIface(ip *net.IPNet, virtIface string) error {
+	if !wifiDev.IsVirtInterfaceAdded(virtIface) {
+		return errors.New("ipv6 assign failed, virtual iface not created before")
+	}
+	//interface must not autoconfigure itself from advertisements it sends
+	acceptRA := fmt.Sprintf("net.ipv6.conf.%s.accept_ra=0", virtIface)
+	if err := exec.Command("sysctl", "-w", acceptRA).Run(); err != nil {
+		return fmt.Errorf("error disabling accept_ra on %s: %v", virtIface, err)
+	}
+	//nodad makes the address usable at once, so servers can bind it
+	if err := exec.Command("ip", "-6", "addr", "add", ip.String(), "dev", virtIface, "nodad").Run(); err != nil {
+		return fmt.Errorf("error assigning %s to %s: %v", ip.String(), virtIface, err)
+	}
+	return nil
+}
+
 // GetPhyOfDevice returns phy of wifi devices by iface
 // returns empty string if iface wasn't 80211 or not exist
 func GetPhyOfDevice(iface string) (string, error) {